@@ -24,6 +24,14 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 
@@ -33,6 +41,9 @@ import (
 
 var (
 	flagPort *int
+	// shutdownTimeout is the maximum duration to drain the requests in
+	// progress and to close the storages on shutdown
+	shutdownTimeout = 30 * time.Second
 	// serveCmd represents the serve command
 	serveCmd = &cobra.Command{
 		Use:   "serve",
@@ -47,7 +58,30 @@ var (
 				log.Fatal().Err(err).Msg("failed to create server")
 			}
 
-			log.Fatal().Err(srv.Serve()).Msg("Error during server start")
+			go func() {
+				if err := srv.Serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Fatal().Err(err).Msg("Error during server start")
+				}
+			}()
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+			for sig := <-signals; sig == syscall.SIGHUP; sig = <-signals {
+				log.Info().Msg("Reloading the configuration...")
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				if err := srv.Reload(ctx, configFilePath); err != nil {
+					log.Error().Err(err).Msg("Error during configuration reload, the current configuration is kept")
+				}
+				cancel()
+			}
+
+			log.Info().Msg("Shutting down the server...")
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+
+			if err := srv.Stop(ctx); err != nil {
+				log.Error().Err(err).Msg("Error during server shutdown")
+			}
 		},
 	}
 )
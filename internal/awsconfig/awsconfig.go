@@ -0,0 +1,82 @@
+package awsconfig
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// Config is the struct contains the AWS configuration shared by storages
+// using an AWS service. The fields left empty are resolved by the default
+// chain of the SDK (environment variables, shared files, instance role...)
+type Config struct {
+	// Region is the region of the service (eg: eu-west-1)
+	Region string `mapstructure:"region" json:"region"`
+	// Endpoint overrides the endpoint of the service, used to target a
+	// compatible service like ElasticMQ or LocalStack
+	// (eg: http://localhost:4566)
+	Endpoint string `mapstructure:"endpoint" json:"endpoint"`
+	// Profile is the name of the shared configuration profile to use
+	Profile string `mapstructure:"profile" json:"profile"`
+	// AccessKeyID, SecretAccessKey and SessionToken are static credentials
+	// used instead of the default chain when the access key is defined
+	AccessKeyID     valuable.Valuable `mapstructure:"accessKeyId" json:"-"`
+	SecretAccessKey valuable.Valuable `mapstructure:"secretAccessKey" json:"-"`
+	SessionToken    valuable.Valuable `mapstructure:"sessionToken" json:"-"`
+}
+
+// Load builds the aws.Config described by the configuration
+func (c *Config) Load(ctx context.Context) (aws.Config, error) {
+	var options []func(*awsconfig.LoadOptions) error
+
+	if c.Region != "" {
+		options = append(options, awsconfig.WithRegion(c.Region))
+	}
+
+	if c.Profile != "" {
+		options = append(options, awsconfig.WithSharedConfigProfile(c.Profile))
+	}
+
+	if accessKeyID := c.AccessKeyID.First(); accessKeyID != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(accessKeyID, c.SecretAccessKey.First(), c.SessionToken.First()),
+		))
+	}
+
+	if c.Endpoint != "" {
+		options = append(options, awsconfig.WithEndpointResolverWithOptions(
+			aws.EndpointResolverWithOptionsFunc(func(service, region string, _ ...interface{}) (aws.Endpoint, error) {
+				return aws.Endpoint{
+					URL:               c.Endpoint,
+					SigningRegion:     region,
+					HostnameImmutable: true,
+				}, nil
+			}),
+		))
+	}
+
+	return awsconfig.LoadDefaultConfig(ctx, options...)
+}
+
+// ClassifyError marks the error of a request rejected by the service as
+// permanent (invalid message, unknown queue or topic, denied access...),
+// the push is not retried. The throttled requests and the server errors
+// stay retryable
+func ClassifyError(err error) error {
+	var response interface{ HTTPStatusCode() int }
+	if !errors.As(err, &response) || !retry.IsPermanentStatus(response.HTTPStatusCode()) {
+		return err
+	}
+
+	if awsretry.IsErrorThrottles(awsretry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary {
+		return err
+	}
+	return retry.Permanent(err)
+}
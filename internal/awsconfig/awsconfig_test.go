@@ -0,0 +1,63 @@
+package awsconfig
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// responseError is an error of the service with its status and error code
+type responseError struct {
+	statusCode int
+	code       string
+}
+
+func (e responseError) Error() string       { return e.code }
+func (e responseError) HTTPStatusCode() int { return e.statusCode }
+func (e responseError) ErrorCode() string   { return e.code }
+
+func TestConfig_Load(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Config{
+		Region:          "eu-west-1",
+		Endpoint:        "http://localhost:4566",
+		AccessKeyID:     valuable.Valuable{Values: []string{"access"}},
+		SecretAccessKey: valuable.Valuable{Values: []string{"secret"}},
+	}
+
+	cfg, err := c.Load(context.Background())
+	assert.NoError(err)
+	assert.Equal("eu-west-1", cfg.Region)
+
+	credentials, err := cfg.Credentials.Retrieve(context.Background())
+	assert.NoError(err)
+	assert.Equal("access", credentials.AccessKeyID)
+	assert.Equal("secret", credentials.SecretAccessKey)
+
+	endpoint, err := cfg.EndpointResolverWithOptions.ResolveEndpoint("SQS", "eu-west-1")
+	assert.NoError(err)
+	assert.Equal("http://localhost:4566", endpoint.URL)
+	assert.Equal("eu-west-1", endpoint.SigningRegion)
+
+	cfg, err = (&Config{Region: "us-east-1"}).Load(context.Background())
+	assert.NoError(err)
+	assert.Nil(cfg.EndpointResolverWithOptions)
+}
+
+func TestClassifyError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(ClassifyError(nil))
+	assert.True(retry.IsRetryable(ClassifyError(errors.New("connection refused"))))
+	assert.True(retry.IsRetryable(ClassifyError(responseError{http.StatusInternalServerError, "InternalError"})))
+	assert.True(retry.IsRetryable(ClassifyError(responseError{http.StatusBadRequest, "ThrottlingException"})))
+	assert.False(retry.IsRetryable(ClassifyError(responseError{http.StatusBadRequest, "InvalidMessageContents"})))
+	assert.False(retry.IsRetryable(ClassifyError(responseError{http.StatusForbidden, "AccessDenied"})))
+}
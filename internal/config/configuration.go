@@ -2,11 +2,16 @@ package config
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/parsers/yaml"
@@ -15,17 +20,30 @@ import (
 	"github.com/mitchellh/mapstructure"
 	"github.com/rs/zerolog/log"
 
+	"atomys.codes/webhooked/internal/idempotency"
 	"atomys.codes/webhooked/pkg/factory"
+	"atomys.codes/webhooked/pkg/formatting"
 	"atomys.codes/webhooked/pkg/storage"
+	"atomys.codes/webhooked/pkg/storage/batch"
+	"atomys.codes/webhooked/pkg/storage/retry"
 )
 
 var (
 	currentConfig = &Configuration{}
+	// currentMu protects the current configuration during a reload. The
+	// requests hold it in read mode with Acquire
+	currentMu sync.RWMutex
 	// ErrSpecNotFound is returned when the spec is not found
 	ErrSpecNotFound = errors.New("spec not found")
 	// defaultPayloadTemplate is the default template for the payload
 	// when no template is defined
 	defaultPayloadTemplate = `{{ .Payload }}`
+	// defaultDeadLetterTemplate is the default template for the payload sent
+	// to the dead letter storage when no template is defined
+	defaultDeadLetterTemplate = `{"storage":{{ toJson .DeadLetter.Storage }},"error":{{ toJson .DeadLetter.Error }},"attempts":{{ .DeadLetter.Attempts }},"timestamp":{{ toJson .DeadLetter.Timestamp }},"payload":{{ toJson .Payload }}}`
+	// defaultBatchTemplate is the default template for the batch of
+	// payloads, a JSON array of the formatted payloads
+	defaultBatchTemplate = `[{{ range $i, $event := .Events }}{{ if $i }},{{ end }}{{ $event }}{{ end }}]`
 	// defaultResponseTemplate is the default template for the response
 	// when no template is defined
 	defaultResponseTemplate = ``
@@ -34,6 +52,53 @@ var (
 // Load loads the configuration from the configuration file
 // if an error is occurred, it will be returned
 func Load(cfgFile string) error {
+	newConfig, err := load(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	currentMu.Lock()
+	*currentConfig = *newConfig
+	currentMu.Unlock()
+	return nil
+}
+
+// Reload loads the configuration from the configuration file and replaces
+// the current configuration once the requests in progress are released.
+// The previous configuration is returned to let the caller close its
+// storages. On error, the current configuration is kept and the storages
+// already loaded from the file are closed
+func Reload(ctx context.Context, cfgFile string) (*Configuration, error) {
+	// a missing file must not replace the configuration by an empty one
+	if _, err := os.Stat(cfgFile); err != nil {
+		return nil, err
+	}
+
+	newConfig, err := load(cfgFile)
+	if err != nil {
+		newConfig.CloseStorages(ctx)
+		return nil, err
+	}
+
+	currentMu.Lock()
+	var previousConfig = *currentConfig
+	*currentConfig = *newConfig
+	currentMu.Unlock()
+
+	return &previousConfig, nil
+}
+
+// Acquire holds the current configuration until the returned function is
+// called, the reloads wait for the release of the configuration
+func Acquire() (release func()) {
+	currentMu.RLock()
+	return currentMu.RUnlock
+}
+
+// load reads the configuration file, loads the specs and returns the new
+// configuration. The returned configuration is partially loaded on error
+func load(cfgFile string) (*Configuration, error) {
+	var newConfig = &Configuration{}
 	var k = koanf.New(".")
 
 	// Load YAML config.
@@ -56,41 +121,93 @@ func Load(cfgFile string) error {
 		k.Print()
 	}
 
-	err = k.UnmarshalWithConf("", &currentConfig, koanf.UnmarshalConf{
+	err = k.UnmarshalWithConf("", newConfig, koanf.UnmarshalConf{
 		DecoderConfig: &mapstructure.DecoderConfig{
 			DecodeHook: mapstructure.ComposeDecodeHookFunc(
 				mapstructure.StringToTimeDurationHookFunc(),
 				factory.DecodeHook,
 			),
-			Result:           &currentConfig,
+			Result:           newConfig,
 			WeaklyTypedInput: true,
 		},
 	})
 	if err != nil {
-		log.Fatal().Msgf("error loading config: %v", err)
-		return err
+		return newConfig, fmt.Errorf("error loading config: %v", err)
 	}
 
-	for _, spec := range currentConfig.Specs {
+	if err = validateConcurrency(&newConfig.Concurrency); err != nil {
+		return newConfig, fmt.Errorf("configured concurrency received an error: %s", err.Error())
+	}
+
+	for _, spec := range newConfig.Specs {
 		if err := loadSecurityFactory(spec); err != nil {
-			return err
+			return newConfig, err
 		}
 
 		if spec.Formatting, err = loadTemplate(spec.Formatting, nil, defaultPayloadTemplate); err != nil {
-			return fmt.Errorf("configured storage for %s received an error: %s", spec.Name, err.Error())
+			return newConfig, fmt.Errorf("configured storage for %s received an error: %s", spec.Name, err.Error())
 		}
 
 		if err = loadStorage(spec); err != nil {
-			return fmt.Errorf("configured storage for %s received an error: %s", spec.Name, err.Error())
+			return newConfig, fmt.Errorf("configured storage for %s received an error: %s", spec.Name, err.Error())
+		}
+
+		if err = validateDelivery(spec); err != nil {
+			return newConfig, fmt.Errorf("configured delivery for %s received an error: %s", spec.Name, err.Error())
+		}
+
+		if err = validateRoutes(spec); err != nil {
+			return newConfig, fmt.Errorf("configured routes for %s received an error: %s", spec.Name, err.Error())
+		}
+
+		if err = validateAsync(spec); err != nil {
+			return newConfig, fmt.Errorf("configured async for %s received an error: %s", spec.Name, err.Error())
+		}
+
+		if err = validateConcurrency(&spec.Concurrency); err != nil {
+			return newConfig, fmt.Errorf("configured concurrency for %s received an error: %s", spec.Name, err.Error())
+		}
+
+		if err = loadIdempotency(spec); err != nil {
+			return newConfig, fmt.Errorf("configured idempotency for %s received an error: %s", spec.Name, err.Error())
 		}
 
 		if spec.Response.Formatting, err = loadTemplate(spec.Response.Formatting, nil, defaultResponseTemplate); err != nil {
-			return fmt.Errorf("configured response for %s received an error: %s", spec.Name, err.Error())
+			return newConfig, fmt.Errorf("configured response for %s received an error: %s", spec.Name, err.Error())
 		}
 	}
 
-	log.Info().Msgf("Load %d configurations", len(currentConfig.Specs))
-	return Validate(currentConfig)
+	log.Info().Msgf("Load %d configurations", len(newConfig.Specs))
+	return newConfig, Validate(newConfig)
+}
+
+// CloseStorages closes the loaded storages of the configuration
+// implementing storage.Closer and the idempotency stores, the errors are
+// logged
+func (c *Configuration) CloseStorages(ctx context.Context) {
+	for _, spec := range c.Specs {
+		for _, s := range spec.Storage {
+			if s.Client == nil {
+				continue
+			}
+
+			if err := storage.Close(ctx, s.Client); err != nil {
+				log.Error().Err(err).Msgf("Error during closing of storage %s/%s", spec.Name, s.Type)
+			}
+		}
+
+		if spec.HasDeadLetter() && spec.DeadLetter.Client != nil {
+			if err := storage.Close(ctx, spec.DeadLetter.Client); err != nil {
+				log.Error().Err(err).Msgf("Error during closing of dead letter storage %s/%s", spec.Name, spec.DeadLetter.Type)
+			}
+		}
+
+		if spec.HasIdempotency() && spec.Idempotency.Client != nil {
+			if err := spec.Idempotency.Client.Close(); err != nil {
+				log.Error().Err(err).Msgf("Error during closing of idempotency store of %s", spec.Name)
+			}
+		}
+	}
 }
 
 // loadSecurityFactory loads the security factory for the given spec
@@ -119,6 +236,7 @@ func loadSecurityFactory(spec *WebhookSpec) error {
 func Validate(config *Configuration) error {
 	var uniquenessName = make(map[string]bool)
 	var uniquenessUrl = make(map[string]bool)
+	var uniquenessDirectory = make(map[string]bool)
 
 	for _, spec := range config.Specs {
 		log.Debug().Str("name", spec.Name).Msgf("Load spec: %+v", spec)
@@ -134,6 +252,226 @@ func Validate(config *Configuration) error {
 			return fmt.Errorf("specification entrypoint url %s must be unique", spec.EntrypointURL)
 		}
 		uniquenessUrl[spec.EntrypointURL] = true
+
+		// Validate the uniqueness of all write-ahead log directories
+		if spec.Async.Enabled {
+			directory := filepath.Clean(spec.Async.Directory)
+			if _, ok := uniquenessDirectory[directory]; ok {
+				return fmt.Errorf("specification async directory %s must be unique", spec.Async.Directory)
+			}
+			uniquenessDirectory[directory] = true
+		}
+	}
+
+	return nil
+}
+
+// Delivery policies, see DeliverySpec
+const (
+	DeliveryPolicyAll      = "all"
+	DeliveryPolicyAny      = "any"
+	DeliveryPolicyQuorum   = "quorum"
+	DeliveryPolicyRequired = "required"
+)
+
+// Batch acknowledgment policies, see BatchSpec
+const (
+	BatchAckFlush  = "flush"
+	BatchAckBuffer = "buffer"
+)
+
+// validateDelivery validates the uniqueness of the storage names and the
+// delivery policy of the spec and sets the default policy. The storages are
+// identified by their name in the delivery results, the routes and the
+// health checks
+func validateDelivery(spec *WebhookSpec) error {
+	var uniquenessName = make(map[string]bool)
+	for _, s := range spec.Storage {
+		if _, ok := uniquenessName[s.Name]; ok {
+			return fmt.Errorf("storage name %s must be unique, set the name of the storages of the same type", s.Name)
+		}
+		uniquenessName[s.Name] = true
+	}
+
+	if spec.HasDeadLetter() && uniquenessName[spec.DeadLetter.Name] {
+		return fmt.Errorf("dead letter storage name %s must be unique", spec.DeadLetter.Name)
+	}
+
+	switch spec.Delivery.Policy {
+	case "":
+		spec.Delivery.Policy = DeliveryPolicyAll
+	case DeliveryPolicyAll, DeliveryPolicyAny, DeliveryPolicyQuorum:
+	case DeliveryPolicyRequired:
+		if len(spec.Delivery.Required) == 0 {
+			return fmt.Errorf("the required storages must be defined with the %s policy", DeliveryPolicyRequired)
+		}
+	default:
+		return fmt.Errorf("invalid delivery policy %s, must be one of %s, %s, %s or %s", spec.Delivery.Policy, DeliveryPolicyAll, DeliveryPolicyAny, DeliveryPolicyQuorum, DeliveryPolicyRequired)
+	}
+
+	for _, name := range spec.Delivery.Required {
+		var found bool
+		for _, s := range spec.Storage {
+			found = found || s.Name == name
+		}
+
+		if !found {
+			return fmt.Errorf("required storage %s is not defined", name)
+		}
+	}
+
+	return nil
+}
+
+// validateRoutes validates the conditions of the storages and the routes
+// of the spec. The conditions written as expressions are converted to
+// templates
+func validateRoutes(spec *WebhookSpec) error {
+	var names = make(map[string]bool)
+	for _, s := range spec.Storage {
+		names[s.Name] = true
+
+		if s.When == "" {
+			continue
+		}
+
+		s.When = conditionTemplate(s.When)
+		if err := formatting.Validate(s.When); err != nil {
+			return fmt.Errorf("invalid condition of storage %s: %s", s.Name, err.Error())
+		}
+	}
+
+	for i, route := range spec.Routes {
+		if route.Name == "" {
+			route.Name = strconv.Itoa(i)
+		}
+
+		if len(route.Storage) == 0 {
+			return fmt.Errorf("route %s must select at least one storage", route.Name)
+		}
+
+		for _, name := range route.Storage {
+			if !names[name] {
+				return fmt.Errorf("storage %s of route %s is not defined", name, route.Name)
+			}
+		}
+
+		if route.When == "" {
+			continue
+		}
+
+		route.When = conditionTemplate(route.When)
+		if err := formatting.Validate(route.When); err != nil {
+			return fmt.Errorf("invalid condition of route %s: %s", route.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// conditionTemplate returns the template of the condition, the condition
+// without template action is an expression wrapped in an action
+func conditionTemplate(when string) string {
+	if strings.Contains(when, "{{") {
+		return when
+	}
+	return "{{ " + when + " }}"
+}
+
+// validateAsync validates the asynchronous delivery of the spec and sets
+// the default values
+func validateAsync(spec *WebhookSpec) error {
+	if !spec.Async.Enabled {
+		return nil
+	}
+
+	if spec.Async.Directory == "" {
+		return fmt.Errorf("the directory is required when the async delivery is enabled")
+	}
+
+	if spec.Async.Workers == 0 {
+		spec.Async.Workers = 1
+	}
+
+	if spec.Async.MaxPending == 0 {
+		spec.Async.MaxPending = 10000
+	}
+
+	if spec.Async.SegmentSize == 0 {
+		spec.Async.SegmentSize = 64 << 20
+	}
+
+	if spec.Async.RetryInterval == 0 {
+		spec.Async.RetryInterval = time.Second
+	}
+
+	if spec.Async.MaxRetryInterval == 0 {
+		spec.Async.MaxRetryInterval = time.Minute
+	}
+
+	if spec.Async.Timeout == 0 {
+		spec.Async.Timeout = time.Minute
+	}
+
+	if spec.Async.Workers < 0 || spec.Async.MaxPending < 0 || spec.Async.SegmentSize < 0 || spec.Async.MaxAttempts < 0 || spec.Async.Timeout < 0 {
+		return fmt.Errorf("the async settings must be positive")
+	}
+
+	if spec.Async.MaxRetryInterval < spec.Async.RetryInterval {
+		return fmt.Errorf("the max retry interval must be greater than the retry interval")
+	}
+
+	return nil
+}
+
+// validateConcurrency validates the concurrency limit and sets the default
+// values
+func validateConcurrency(concurrency *ConcurrencySpec) error {
+	if concurrency.MaxWait == 0 {
+		concurrency.MaxWait = time.Second
+	}
+
+	if concurrency.RetryAfter == 0 {
+		concurrency.RetryAfter = time.Second
+	}
+
+	if concurrency.MaxConcurrent < 0 || concurrency.MaxQueued < 0 || concurrency.MaxWait < 0 || concurrency.RetryAfter < 0 {
+		return fmt.Errorf("the concurrency settings must be positive")
+	}
+
+	return nil
+}
+
+// loadIdempotency validates the idempotency of the spec, sets the default
+// values and loads the store of the keys
+func loadIdempotency(spec *WebhookSpec) (err error) {
+	if !spec.HasIdempotency() {
+		return nil
+	}
+
+	if spec.Idempotency.Key == "" {
+		return fmt.Errorf("the key is required")
+	}
+
+	if err := formatting.Validate(spec.Idempotency.Key); err != nil {
+		return fmt.Errorf("invalid key: %s", err.Error())
+	}
+
+	if spec.Idempotency.TTL == 0 {
+		spec.Idempotency.TTL = 24 * time.Hour
+	}
+
+	if spec.Idempotency.LockTimeout == 0 {
+		spec.Idempotency.LockTimeout = time.Minute
+	}
+
+	if spec.Idempotency.TTL < 0 || spec.Idempotency.LockTimeout < 0 {
+		return fmt.Errorf("the ttl and the lock timeout must be positive")
+	}
+
+	spec.Idempotency.Client, err = idempotency.New(spec.Idempotency.Store.Type, spec.Idempotency.Store.Specs)
+	if err != nil {
+		return fmt.Errorf("store %s cannot be loaded properly: %s", spec.Idempotency.Store.Type, err.Error())
 	}
 
 	return nil
@@ -145,9 +483,8 @@ func Validate(config *Configuration) error {
 // validation
 func loadStorage(spec *WebhookSpec) (err error) {
 	for _, s := range spec.Storage {
-		s.Client, err = storage.Load(s.Type, s.Specs)
-		if err != nil {
-			return fmt.Errorf("storage %s cannot be loaded properly: %s", s.Type, err.Error())
+		if err = loadStorageClient(spec, s); err != nil {
+			return err
 		}
 
 		if s.Formatting, err = loadTemplate(s.Formatting, spec.Formatting, defaultPayloadTemplate); err != nil {
@@ -155,10 +492,97 @@ func loadStorage(spec *WebhookSpec) (err error) {
 		}
 	}
 
+	// the dead letter storage receives the payload already formatted for
+	// the failed storage, the global formatting is not inherited
+	if spec.HasDeadLetter() {
+		if spec.DeadLetter.Name == "" {
+			spec.DeadLetter.Name = "deadLetter"
+		}
+
+		if err = loadStorageClient(spec, spec.DeadLetter); err != nil {
+			return fmt.Errorf("dead letter %s", err.Error())
+		}
+
+		if spec.DeadLetter.Formatting, err = loadTemplate(spec.DeadLetter.Formatting, nil, defaultDeadLetterTemplate); err != nil {
+			return fmt.Errorf("dead letter storage %s cannot be loaded properly: %s", spec.DeadLetter.Type, err.Error())
+		}
+	}
+
 	log.Debug().Msgf("%d storages loaded for spec %s", len(spec.Storage), spec.Name)
 	return
 }
 
+// loadStorageClient loads the client of the storage, wrapped with the
+// retry and the circuit breaker of the storage
+func loadStorageClient(spec *WebhookSpec, s *StorageSpec) (err error) {
+	if s.Name == "" {
+		s.Name = s.Type
+	}
+
+	s.Client, err = storage.Load(s.Type, s.Specs)
+	if err != nil {
+		return fmt.Errorf("storage %s cannot be loaded properly: %s", s.Type, err.Error())
+	}
+
+	// the client is kept unwrapped on error to be closed by the caller
+	client, err := retry.Wrap(s.Client, s.Retry, s.CircuitBreaker, spec.Name, s.Name)
+	if err != nil {
+		return fmt.Errorf("storage %s cannot be loaded properly: %s", s.Type, err.Error())
+	}
+
+	// the batches are retried as a whole
+	if s.Batch != nil {
+		if client, err = loadBatch(spec, s, client); err != nil {
+			return fmt.Errorf("storage %s cannot be loaded properly: %s", s.Type, err.Error())
+		}
+	}
+	s.Client = client
+
+	return nil
+}
+
+// loadBatch validates the batching of the storage, sets the default values
+// and returns the client wrapped with the batching
+func loadBatch(spec *WebhookSpec, s *StorageSpec, client storage.Pusher) (storage.Pusher, error) {
+	if s.Batch.Size == 0 {
+		s.Batch.Size = 100
+	}
+
+	if s.Batch.Interval == 0 {
+		s.Batch.Interval = time.Second
+	}
+
+	if s.Batch.Size < 0 || s.Batch.Interval < 0 {
+		return nil, fmt.Errorf("the batch size and interval must be positive")
+	}
+
+	switch s.Batch.Ack {
+	case "":
+		s.Batch.Ack = BatchAckFlush
+	case BatchAckFlush, BatchAckBuffer:
+	default:
+		return nil, fmt.Errorf("invalid batch ack %s, must be one of %s or %s", s.Batch.Ack, BatchAckFlush, BatchAckBuffer)
+	}
+
+	var err error
+	if s.Batch.Formatting, err = loadTemplate(s.Batch.Formatting, nil, defaultBatchTemplate); err != nil {
+		return nil, err
+	}
+
+	if err = formatting.Validate(s.Batch.Formatting.Template); err != nil {
+		return nil, fmt.Errorf("invalid batch formatting: %s", err.Error())
+	}
+
+	return batch.Wrap(client, batch.Options{
+		Size:      s.Batch.Size,
+		Interval:  s.Batch.Interval,
+		Timeout:   s.Timeout,
+		Template:  s.Batch.Formatting.Template,
+		Data:      map[string]interface{}{"Spec": spec, "Storage": s},
+		WaitFlush: s.Batch.Ack == BatchAckFlush,
+	}, spec.Name, s.Name), nil
+}
+
 // loadTemplate loads the template for the given `spec`. When no spec is defined
 // we try to load the template from the parentSpec and fallback to the default
 // template if parentSpec is not given.
@@ -1,15 +1,87 @@
 package config
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"atomys.codes/webhooked/internal/valuable"
 	"atomys.codes/webhooked/pkg/factory"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage"
+	"atomys.codes/webhooked/pkg/storage/capability"
+	"atomys.codes/webhooked/pkg/storage/retry"
 )
 
+func TestLoadStorageDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &WebhookSpec{
+		Name:       "test",
+		Formatting: &FormattingSpec{Template: "global"},
+		DeadLetter: &StorageSpec{Type: "stderr", Specs: map[string]interface{}{}},
+	}
+	assert.NoError(loadStorage(spec))
+	assert.True(spec.HasDeadLetter())
+	assert.Equal("deadLetter", spec.DeadLetter.Name)
+	assert.NotNil(spec.DeadLetter.Client)
+
+	payload, err := formatting.New().
+		WithTemplate(spec.DeadLetter.Formatting.Template).
+		WithPayload([]byte(`{"id":1}`)).
+		WithData("DeadLetter", struct {
+			Storage   string
+			Error     string
+			Attempts  int
+			Timestamp time.Time
+		}{"redis", "connection refused", 3, time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)}).
+		Render()
+	assert.NoError(err)
+	assert.JSONEq(`{
+		"storage":"redis",
+		"error":"connection refused",
+		"attempts":3,
+		"timestamp":"2023-01-02T03:04:05Z",
+		"payload":"{\"id\":1}"
+	}`, payload)
+}
+
+func TestLoadStorageBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &WebhookSpec{
+		Name:    "test",
+		Storage: []*StorageSpec{{Type: "stdout", Specs: map[string]interface{}{}, Batch: &BatchSpec{}}},
+	}
+	assert.NoError(loadStorage(spec))
+	assert.Equal(100, spec.Storage[0].Batch.Size)
+	assert.Equal(time.Second, spec.Storage[0].Batch.Interval)
+	assert.Equal(BatchAckFlush, spec.Storage[0].Batch.Ack)
+	assert.Contains(storage.Capabilities(spec.Storage[0].Client), capability.Batch)
+	(&Configuration{Specs: []*WebhookSpec{spec}}).CloseStorages(context.Background())
+
+	payload, err := formatting.New().
+		WithTemplate(spec.Storage[0].Batch.Formatting.Template).
+		WithData("Events", []string{`{"id":1}`, `{"id":2}`}).
+		Render()
+	assert.NoError(err)
+	assert.JSONEq(`[{"id":1},{"id":2}]`, payload)
+
+	for _, batch := range []*BatchSpec{
+		{Size: -1},
+		{Ack: "unknown"},
+		{Formatting: &FormattingSpec{TemplateString: "{{ .Events"}},
+	} {
+		assert.Error(loadStorage(&WebhookSpec{
+			Name:    "test",
+			Storage: []*StorageSpec{{Type: "stdout", Specs: map[string]interface{}{}, Batch: batch}},
+		}))
+	}
+}
+
 func TestLoad(t *testing.T) {
 	os.Setenv("WH_APIVERSION", "v1alpha1_test")
 	assert := assert.New(t)
@@ -17,6 +89,9 @@ func TestLoad(t *testing.T) {
 
 	assert.Equal(true, currentConfig.Observability.MetricsEnabled)
 	assert.Equal("v1alpha1_test", currentConfig.APIVersion)
+	assert.Equal(100, currentConfig.Concurrency.MaxConcurrent)
+	assert.Equal(50, currentConfig.Concurrency.MaxQueued)
+	assert.Equal(time.Second, currentConfig.Concurrency.MaxWait)
 	assert.Len(currentConfig.Specs, 1)
 
 	currentSpec := currentConfig.Specs[0]
@@ -34,9 +109,131 @@ func TestLoad(t *testing.T) {
 	// Storage block
 	assert.Len(currentSpec.Storage, 1)
 	assert.Equal("postgres", currentSpec.Storage[0].Type)
+	assert.Equal("postgres", currentSpec.Storage[0].Name)
+	assert.Equal(DeliveryPolicyAll, currentSpec.Delivery.Policy)
+	assert.Equal(4, currentSpec.Storage[0].Retry.MaxAttempts)
+	assert.Equal(200*time.Millisecond, currentSpec.Storage[0].Retry.InitialInterval)
+	assert.Equal(10, currentSpec.Storage[0].CircuitBreaker.FailureThreshold)
+	assert.Equal(30*time.Second, currentSpec.Storage[0].CircuitBreaker.OpenDuration)
+	assert.True(currentSpec.HasIdempotency())
+	assert.Equal(time.Hour, currentSpec.Idempotency.TTL)
+	assert.Equal(time.Minute, currentSpec.Idempotency.LockTimeout)
+	assert.NotNil(currentSpec.Idempotency.Client)
 	assert.NotEmpty("postgres", currentSpec.Storage[0].Specs["args"])
 }
 
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(Load("../../tests/webhooks.tests.yaml"))
+	current := currentConfig.Specs[0]
+
+	_, err := Reload(context.Background(), "../../tests/unknown.yaml")
+	assert.Error(err)
+	assert.Same(current, currentConfig.Specs[0])
+
+	// the reload waits for the release of the configuration
+	release := Acquire()
+	reloaded := make(chan *Configuration)
+	go func() {
+		previous, err := Reload(context.Background(), "../../tests/webhooks.tests.yaml")
+		assert.NoError(err)
+		reloaded <- previous
+	}()
+
+	select {
+	case <-reloaded:
+		t.Fatal("the configuration has been reloaded while acquired")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	previous := <-reloaded
+	assert.Same(current, previous.Specs[0])
+	assert.NotSame(current, currentConfig.Specs[0])
+	assert.Equal("exampleHook", currentConfig.Specs[0].Name)
+
+	previous.CloseStorages(context.Background())
+}
+
+func TestValidateDelivery(t *testing.T) {
+	assert := assert.New(t)
+	storages := []*StorageSpec{{Name: "redis"}, {Name: "postgres"}}
+
+	spec := &WebhookSpec{Storage: storages}
+	assert.NoError(validateDelivery(spec))
+	assert.Equal(DeliveryPolicyAll, spec.Delivery.Policy)
+
+	for _, policy := range []string{DeliveryPolicyAny, DeliveryPolicyQuorum} {
+		assert.NoError(validateDelivery(&WebhookSpec{Storage: storages, Delivery: DeliverySpec{Policy: policy}}))
+	}
+
+	assert.NoError(validateDelivery(&WebhookSpec{Storage: storages, Delivery: DeliverySpec{Policy: DeliveryPolicyRequired, Required: []string{"postgres"}}}))
+	assert.Error(validateDelivery(&WebhookSpec{Storage: storages, Delivery: DeliverySpec{Policy: DeliveryPolicyRequired}}))
+	assert.Error(validateDelivery(&WebhookSpec{Storage: storages, Delivery: DeliverySpec{Policy: DeliveryPolicyRequired, Required: []string{"mysql"}}}))
+	assert.Error(validateDelivery(&WebhookSpec{Storage: storages, Delivery: DeliverySpec{Policy: "unknown"}}))
+
+	// the storage names are unique, the dead letter storage included
+	assert.Error(validateDelivery(&WebhookSpec{Storage: []*StorageSpec{{Name: "redis"}, {Name: "redis"}}}))
+	assert.Error(validateDelivery(&WebhookSpec{Storage: storages, DeadLetter: &StorageSpec{Name: "redis"}}))
+	assert.NoError(validateDelivery(&WebhookSpec{Storage: storages, DeadLetter: &StorageSpec{Name: "deadLetter"}}))
+}
+
+func TestValidateRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &WebhookSpec{
+		Storage: []*StorageSpec{{Name: "push", When: `eq (.Request.Header | getHeader "X-GitHub-Event") "push"`}, {Name: "pull"}},
+		Routes:  []*RouteSpec{{When: "{{ true }}", Storage: []string{"pull"}}, {Name: "default", Storage: []string{"push", "pull"}}},
+	}
+	assert.NoError(validateRoutes(spec))
+	assert.Equal(`{{ eq (.Request.Header | getHeader "X-GitHub-Event") "push" }}`, spec.Storage[0].When)
+	assert.Equal("", spec.Storage[1].When)
+	assert.Equal("0", spec.Routes[0].Name)
+	assert.Equal("{{ true }}", spec.Routes[0].When)
+	assert.Equal("default", spec.Routes[1].Name)
+
+	assert.Error(validateRoutes(&WebhookSpec{Storage: []*StorageSpec{{Name: "push", When: "{{ eq"}}}))
+	assert.Error(validateRoutes(&WebhookSpec{Storage: []*StorageSpec{{Name: "push", When: "unknownFunction"}}}))
+	assert.Error(validateRoutes(&WebhookSpec{Storage: []*StorageSpec{{Name: "push"}}, Routes: []*RouteSpec{{Name: "empty"}}}))
+	assert.Error(validateRoutes(&WebhookSpec{Storage: []*StorageSpec{{Name: "push"}}, Routes: []*RouteSpec{{Storage: []string{"pull"}}}}))
+	assert.Error(validateRoutes(&WebhookSpec{Storage: []*StorageSpec{{Name: "push"}}, Routes: []*RouteSpec{{When: "{{ if }}", Storage: []string{"push"}}}}))
+}
+
+func TestValidateConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	concurrency := &ConcurrencySpec{MaxConcurrent: 10, MaxQueued: 5}
+	assert.NoError(validateConcurrency(concurrency))
+	assert.Equal(time.Second, concurrency.MaxWait)
+	assert.Equal(time.Second, concurrency.RetryAfter)
+
+	concurrency = &ConcurrencySpec{MaxWait: 100 * time.Millisecond, RetryAfter: 5 * time.Second}
+	assert.NoError(validateConcurrency(concurrency))
+	assert.Equal(100*time.Millisecond, concurrency.MaxWait)
+	assert.Equal(5*time.Second, concurrency.RetryAfter)
+
+	assert.Error(validateConcurrency(&ConcurrencySpec{MaxConcurrent: -1}))
+	assert.Error(validateConcurrency(&ConcurrencySpec{MaxQueued: -1}))
+	assert.Error(validateConcurrency(&ConcurrencySpec{MaxWait: -time.Second}))
+}
+
+func TestLoadIdempotency(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(loadIdempotency(&WebhookSpec{}))
+
+	spec := &WebhookSpec{Idempotency: &IdempotencySpec{Key: `{{ .Request.Header | getHeader "X-GitHub-Delivery" }}`}}
+	assert.NoError(loadIdempotency(spec))
+	assert.Equal(24*time.Hour, spec.Idempotency.TTL)
+	assert.Equal(time.Minute, spec.Idempotency.LockTimeout)
+	assert.NotNil(spec.Idempotency.Client)
+
+	assert.Error(loadIdempotency(&WebhookSpec{Idempotency: &IdempotencySpec{}}))
+	assert.Error(loadIdempotency(&WebhookSpec{Idempotency: &IdempotencySpec{Key: "{{ .Payload"}}))
+	assert.Error(loadIdempotency(&WebhookSpec{Idempotency: &IdempotencySpec{Key: "{{ .Payload }}", TTL: -time.Second}}))
+	assert.Error(loadIdempotency(&WebhookSpec{Idempotency: &IdempotencySpec{Key: "{{ .Payload }}", Store: IdempotencyStoreSpec{Type: "unknown"}}}))
+}
+
 func TestValidate(t *testing.T) {
 	assert.NoError(t, Validate(&Configuration{}))
 	assert.NoError(t, Validate(&Configuration{
@@ -73,6 +270,39 @@ func TestValidate(t *testing.T) {
 			},
 		},
 	}))
+
+	assert.Error(t, Validate(&Configuration{
+		Specs: []*WebhookSpec{
+			{
+				Name:          "test",
+				EntrypointURL: "/test",
+				Async:         AsyncSpec{Enabled: true, Directory: "/var/lib/webhooked"},
+			},
+			{
+				Name:          "test2",
+				EntrypointURL: "/test2",
+				Async:         AsyncSpec{Enabled: true, Directory: "/var/lib/webhooked/"},
+			},
+		},
+	}))
+}
+
+func TestValidateAsync(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateAsync(&WebhookSpec{}))
+	assert.Error(validateAsync(&WebhookSpec{Async: AsyncSpec{Enabled: true}}))
+	assert.Error(validateAsync(&WebhookSpec{Async: AsyncSpec{Enabled: true, Directory: "wal", Workers: -1}}))
+	assert.Error(validateAsync(&WebhookSpec{Async: AsyncSpec{Enabled: true, Directory: "wal", RetryInterval: time.Hour}}))
+
+	spec := &WebhookSpec{Async: AsyncSpec{Enabled: true, Directory: "wal"}}
+	assert.NoError(validateAsync(spec))
+	assert.Equal(1, spec.Async.Workers)
+	assert.Equal(10000, spec.Async.MaxPending)
+	assert.Equal(int64(64<<20), spec.Async.SegmentSize)
+	assert.Equal(time.Second, spec.Async.RetryInterval)
+	assert.Equal(time.Minute, spec.Async.MaxRetryInterval)
+	assert.Equal(time.Minute, spec.Async.Timeout)
 }
 
 func TestCurrent(t *testing.T) {
@@ -222,6 +452,54 @@ func TestLoadStorage(t *testing.T) {
 			false,
 			false,
 		},
+		{
+			"storage with retry and circuit breaker",
+			&WebhookSpec{
+				Name: "test",
+				Storage: []*StorageSpec{
+					{
+						Type:           "stdout",
+						Specs:          map[string]interface{}{},
+						Retry:          &retry.Config{MaxAttempts: 5},
+						CircuitBreaker: &retry.BreakerConfig{},
+					},
+				},
+			},
+			false,
+			true,
+		},
+		{
+			"storage with dead letter",
+			&WebhookSpec{
+				Name: "test",
+				Storage: []*StorageSpec{
+					{Type: "stdout", Specs: map[string]interface{}{}},
+				},
+				DeadLetter: &StorageSpec{Type: "stderr", Specs: map[string]interface{}{}},
+			},
+			false,
+			true,
+		},
+		{
+			"invalid dead letter storage",
+			&WebhookSpec{
+				Name:       "test",
+				DeadLetter: &StorageSpec{Type: "unknown"},
+			},
+			true,
+			false,
+		},
+		{
+			"invalid retry configuration",
+			&WebhookSpec{
+				Name: "test",
+				Storage: []*StorageSpec{
+					{Type: "stdout", Specs: map[string]interface{}{}, Retry: &retry.Config{MaxAttempts: -1}},
+				},
+			},
+			true,
+			false,
+		},
 		{
 			"invalid storage name in configuration",
 			&WebhookSpec{
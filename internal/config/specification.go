@@ -10,6 +10,21 @@ func (s WebhookSpec) HasGlobalFormatting() bool {
 	return s.Formatting != nil && (s.Formatting.TemplatePath != "" || s.Formatting.TemplateString != "")
 }
 
+// HasDeadLetter returns true if the spec has a dead letter storage
+func (s WebhookSpec) HasDeadLetter() bool {
+	return s.DeadLetter != nil
+}
+
+// HasRoutes returns true if the spec selects its storages with routes
+func (s WebhookSpec) HasRoutes() bool {
+	return len(s.Routes) > 0
+}
+
+// HasIdempotency returns true if the spec deduplicates the webhook calls
+func (s WebhookSpec) HasIdempotency() bool {
+	return s.Idempotency != nil
+}
+
 // HasFormatting returns true if the storage spec has a formatting
 func (s StorageSpec) HasFormatting() bool {
 	return s.Formatting != nil && (s.Formatting.TemplatePath != "" || s.Formatting.TemplateString != "")
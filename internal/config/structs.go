@@ -1,8 +1,12 @@
 package config
 
 import (
+	"time"
+
+	"atomys.codes/webhooked/internal/idempotency"
 	"atomys.codes/webhooked/pkg/factory"
 	"atomys.codes/webhooked/pkg/storage"
+	"atomys.codes/webhooked/pkg/storage/retry"
 )
 
 // Configuration is the struct contains all the configuration
@@ -12,6 +16,10 @@ type Configuration struct {
 	APIVersion string `mapstructure:"apiVersion" json:"apiVersion"`
 	// Observability is the configuration for observability
 	Observability Observability `mapstructure:"observability" json:"observability"`
+	// Concurrency is the limit of the webhook calls processed concurrently
+	// by the server, all specs included. It is defined by the user and can
+	// be empty. (default: unlimited)
+	Concurrency ConcurrencySpec `mapstructure:"concurrency" json:"concurrency"`
 	// Specs is the configuration for the webhooks specs
 	Specs []*WebhookSpec `mapstructure:"specs" json:"specs"`
 }
@@ -55,6 +63,155 @@ type WebhookSpec struct {
 	// Response is the configuration for the response of the webhook sent
 	// to the caller. It is defined by the user and can be empty.
 	Response ResponseSpec `mapstructure:"response" json:"-"`
+	// Delivery is the configuration of the delivery of the payload to the
+	// storages. It is defined by the user and can be empty.
+	Delivery DeliverySpec `mapstructure:"delivery" json:"-"`
+	// DeadLetter is the storage receiving the payload of a storage when its
+	// push finally fails, with the failure metadata available in the
+	// `.DeadLetter` formatting data (Storage, Error, Attempts, Timestamp).
+	// It is defined by the user and can be empty. See HasDeadLetter() method
+	// to know if the webhook spec has a dead letter storage
+	DeadLetter *StorageSpec `mapstructure:"deadLetter" json:"-"`
+	// Async is the configuration of the asynchronous delivery of the
+	// payload to the storages. It is defined by the user and can be empty.
+	Async AsyncSpec `mapstructure:"async" json:"-"`
+	// Routes selects the storages receiving the payload of each request.
+	// The first route with a true condition is used, the request is not
+	// stored when no route matches. When empty, all the storages are
+	// selected. It is defined by the user and can be empty. See HasRoutes()
+	// method to know if the webhook spec has routes
+	Routes []*RouteSpec `mapstructure:"routes" json:"-"`
+	// Idempotency is the configuration of the deduplication of the webhook
+	// calls retried by the caller. It is defined by the user and can be
+	// empty. See HasIdempotency() method to know if the webhook spec has
+	// idempotency
+	Idempotency *IdempotencySpec `mapstructure:"idempotency" json:"-"`
+	// Concurrency is the limit of the calls of the webhook spec processed
+	// concurrently. It is defined by the user and can be empty. (default:
+	// unlimited)
+	Concurrency ConcurrencySpec `mapstructure:"concurrency" json:"-"`
+}
+
+// ConcurrencySpec is the struct contains the configuration of a limit of
+// the webhook calls processed concurrently. The calls above the limit wait
+// in a bounded queue for a free slot, then are rejected with a
+// `Retry-After` header: 429 Too Many Requests for the limit of a spec and
+// 503 Service Unavailable for the limit of the server.
+type ConcurrencySpec struct {
+	// MaxConcurrent is the maximum number of calls processed concurrently
+	// (default: 0, unlimited)
+	MaxConcurrent int `mapstructure:"maxConcurrent" json:"maxConcurrent"`
+	// MaxQueued is the maximum number of calls waiting for a free slot, the
+	// next calls are rejected immediately (default: 0, no queue)
+	MaxQueued int `mapstructure:"maxQueued" json:"maxQueued"`
+	// MaxWait is the maximum duration a call waits in the queue before
+	// being rejected (default: 1s)
+	MaxWait time.Duration `mapstructure:"maxWait" json:"maxWait"`
+	// RetryAfter is the delay sent in the `Retry-After` header of the
+	// rejected calls, rounded up to the second (default: 1s)
+	RetryAfter time.Duration `mapstructure:"retryAfter" json:"retryAfter"`
+}
+
+// IdempotencySpec is the struct contains the configuration of the
+// idempotency of a webhook spec. The first call with a key is processed,
+// the next calls with the same key receive the response of the first call
+// without being processed again. A call received while the first one is
+// still in progress waits for its response.
+type IdempotencySpec struct {
+	// Key is the template rendering the idempotency key of the call, the
+	// calls rendering an empty key are not deduplicated. It is required.
+	//   eg: {{ .Request.Header | getHeader "X-GitHub-Delivery" }}
+	Key string `mapstructure:"key" json:"key"`
+	// TTL is the duration the processed keys are remembered (default: 24h)
+	TTL time.Duration `mapstructure:"ttl" json:"ttl"`
+	// LockTimeout is the maximum duration a key is reserved by a call in
+	// progress. The next calls wait for its response until the reservation
+	// expires, then the first waiting call is processed (default: 1m)
+	LockTimeout time.Duration `mapstructure:"lockTimeout" json:"lockTimeout"`
+	// Store is the configuration of the store of the keys
+	Store IdempotencyStoreSpec `mapstructure:"store" json:"store"`
+	// Client is the store client. It is defined by the configuration
+	// loader and cannot be overridden
+	Client idempotency.Store `mapstructure:"-" json:"-"`
+}
+
+// IdempotencyStoreSpec is the struct contains the configuration of the
+// store of the idempotency keys
+type IdempotencyStoreSpec struct {
+	// Type is the type of the store: memory or redis. The memory store is
+	// local to the instance and emptied by a reload or a restart, the redis
+	// store is shared between the instances (default: memory)
+	Type string `mapstructure:"type" json:"type"`
+	// Specs is the configuration of the redis store (host, port, username,
+	// password, database, addresses, tls and prefix of the keys)
+	Specs map[string]interface{} `mapstructure:"specs" json:"-"`
+}
+
+// RouteSpec is the struct contains the configuration of a route of a
+// webhook spec
+type RouteSpec struct {
+	// Name is the name of the route, used in the logs. (default: the index
+	// of the route)
+	Name string `mapstructure:"name" json:"name"`
+	// When is the condition of the route, see StorageSpec.When. A route
+	// without condition always matches
+	When string `mapstructure:"when" json:"when"`
+	// Storage is the list of the names of the storages selected by the
+	// route
+	Storage []string `mapstructure:"storage" json:"storage"`
+}
+
+// AsyncSpec is the struct contains the configuration of the asynchronous
+// delivery of a webhook spec. When enabled, the request is written in a
+// write-ahead log on the local disk and the caller receives the response
+// immediately. Background workers deliver the payload to the storages and
+// retry it until the delivery policy is satisfied, the entries not
+// delivered are replayed after a restart.
+type AsyncSpec struct {
+	// Enabled enables the asynchronous delivery (default: false)
+	Enabled bool `mapstructure:"enabled" json:"enabled"`
+	// Directory is the directory of the write-ahead log. It must be unique
+	// for each spec and is required when the asynchronous delivery is enabled
+	Directory string `mapstructure:"directory" json:"directory"`
+	// Workers is the number of payloads delivered concurrently (default: 1)
+	Workers int `mapstructure:"workers" json:"workers"`
+	// MaxPending is the maximum number of payloads waiting for their
+	// delivery, the webhook calls are rejected when it is reached
+	// (default: 10000)
+	MaxPending int `mapstructure:"maxPending" json:"maxPending"`
+	// SegmentSize is the size in bytes of the files of the write-ahead log
+	// (default: 64MiB)
+	SegmentSize int64 `mapstructure:"segmentSize" json:"segmentSize"`
+	// RetryInterval is the delay before the first retry of a failed
+	// delivery, doubled after each retry (default: 1s)
+	RetryInterval time.Duration `mapstructure:"retryInterval" json:"retryInterval"`
+	// MaxRetryInterval is the maximum delay between two retries of a failed
+	// delivery (default: 1m)
+	MaxRetryInterval time.Duration `mapstructure:"maxRetryInterval" json:"maxRetryInterval"`
+	// MaxAttempts is the maximum number of attempts of a delivery, the
+	// payload is dropped after the last attempt. (default: 0, unlimited)
+	MaxAttempts int `mapstructure:"maxAttempts" json:"maxAttempts"`
+	// Timeout is the maximum duration of the push of the payload to the
+	// storages without their own timeout, the interrupted pushes are retried
+	// by the next attempt (default: 1m)
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout"`
+}
+
+// DeliverySpec is the struct contains the configuration of the delivery of
+// the payload to the storages of a webhook spec. The storages receive the
+// payload concurrently.
+type DeliverySpec struct {
+	// Policy is the policy deciding if the webhook call is successful from
+	// the result of each storage. It is defined by the user and can be
+	// empty. (default: all)
+	//   - all: every storage must succeed
+	//   - any: at least one storage must succeed
+	//   - quorum: more than half of the storages must succeed
+	//   - required: the storages listed in Required must succeed
+	Policy string `mapstructure:"policy" json:"policy"`
+	// Required is the list of the names of the storages that must succeed
+	// with the required policy
+	Required []string `mapstructure:"required" json:"required"`
 }
 
 type ResponseSpec struct {
@@ -93,6 +250,34 @@ type StorageSpec struct {
 	// Type is the type of the storage. It must be a valid storage type
 	// defined in the storage package.
 	Type string `mapstructure:"type" json:"type"`
+	// Name is the name of the storage, used in the logs and by the delivery
+	// policy. It must be unique in the webhook spec, the dead letter storage
+	// included. It is defined by the user and can be empty. (default: Type)
+	Name string `mapstructure:"name" json:"name"`
+	// Timeout is the maximum duration of the push of the payload to this
+	// storage. It is defined by the user and can be empty. (default: no
+	// timeout other than the request one). The timeout includes the retries
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout"`
+	// Retry is the configuration of the retry of the failed pushes to this
+	// storage. It is defined by the user and can be empty. (default: the
+	// default retry policy of the storage type when it has one, eg: http
+	// and rabbitmq, otherwise no retry)
+	Retry *retry.Config `mapstructure:"retry" json:"retry"`
+	// CircuitBreaker is the configuration of the circuit breaker failing
+	// the pushes immediately while this storage is down. It is defined by
+	// the user and can be empty. (default: no circuit breaker)
+	CircuitBreaker *retry.BreakerConfig `mapstructure:"circuitBreaker" json:"circuitBreaker"`
+	// Batch is the configuration of the batching of the payloads pushed to
+	// this storage. It is defined by the user and can be empty. (default:
+	// each payload is pushed alone)
+	Batch *BatchSpec `mapstructure:"batch" json:"batch"`
+	// When is the condition to push the payload to this storage. It is a
+	// template (see pkg/formatting) or a template expression without the
+	// braces, rendered with the request and the payload and that must
+	// render `true` or `false`. It is defined by the user and can be empty.
+	// (default: always)
+	//   eg: eq (.Request.Header | getHeader "X-GitHub-Event") "push"
+	When string `mapstructure:"when" json:"when"`
 	// Specs is the configuration for the storage. It is defined by the user
 	// following the storage type specification
 	// NOTE: this field is hidden for json to prevent mistake of the user
@@ -109,6 +294,33 @@ type StorageSpec struct {
 	Client storage.Pusher `mapstructure:"-" json:"-"`
 }
 
+// BatchSpec is the struct contains the configuration of the batching of a
+// storage. The formatted payloads are accumulated and pushed at once,
+// rendered with the batch formatting. The batch is pushed when it is full,
+// when its interval is elapsed and when the server shuts down. The storage
+// timeout applies to the wait of the request and to the push of the batch.
+type BatchSpec struct {
+	// Size is the maximum number of payloads of a batch (default: 100)
+	Size int `mapstructure:"size" json:"size"`
+	// Interval is the maximum duration a payload waits in the batch before
+	// the push of the batch (default: 1s)
+	Interval time.Duration `mapstructure:"interval" json:"interval"`
+	// Ack is the policy of the response to the request of each payload
+	// (default: flush)
+	//   - flush: the request waits for the push of the batch and fails
+	//     with it
+	//   - buffer: the request succeeds once the payload is added to the
+	//     batch, the failed batches are only logged and the payloads
+	//     waiting in memory are lost on crash
+	Ack string `mapstructure:"ack" json:"ack"`
+	// Formatting is used to define the batch pushed to the storage, with
+	// the formatted payloads in the `.Events` list and the `.Storage`. The
+	// `.Request`, `.Spec` and `.Config` are those of the first payload of
+	// the batch. When this configuration is empty, the payloads are pushed
+	// as a JSON array
+	Formatting *FormattingSpec `mapstructure:"formatting" json:"-"`
+}
+
 // FormattingSpec is the struct contains the configuration to formatting the
 // payload of the webhook spec. The field TempalteString is prioritized
 // over the field TemplatePath when both are defined.
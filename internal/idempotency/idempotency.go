@@ -0,0 +1,74 @@
+// Package idempotency implements the stores remembering the idempotency
+// keys of the processed webhook calls. A key is reserved by the first call
+// during its processing, then completed with the response sent to the
+// caller so the retries of the call receive the same response without
+// being processed again.
+package idempotency
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// State is the state of a key returned by Store.Acquire
+type State int
+
+const (
+	// Acquired means the key is reserved by the caller, which must complete
+	// or release it
+	Acquired State = iota
+	// InFlight means the key is reserved by another call still in progress
+	InFlight
+	// Completed means the key is already processed, the response of the
+	// processing is returned
+	Completed
+)
+
+const (
+	// StoreMemory keeps the keys in the memory of the instance
+	StoreMemory = "memory"
+	// StoreRedis keeps the keys in redis, shared between the instances
+	StoreRedis = "redis"
+)
+
+// Store remembers the idempotency keys
+type Store interface {
+	// Acquire reserves the key during the lock TTL when the key is unknown.
+	// It returns the state of the key with the token of the reservation
+	// when the key is acquired, or the response of the key when it is
+	// completed
+	Acquire(ctx context.Context, key string, lockTTL time.Duration) (State, string, error)
+	// Complete records the response of the processed key during the TTL
+	Complete(ctx context.Context, key, response string, ttl time.Duration) error
+	// Release removes the reservation of the key after a failed processing,
+	// the next call with the key is processed. The reservation is only
+	// removed when it still has the token returned by Acquire, the
+	// reservation of another call acquired after the expiration is kept
+	Release(ctx context.Context, key, token string) error
+	// Close releases the resources of the store
+	Close() error
+}
+
+// New returns the store of the given type configured with the specs
+func New(storeType string, specs map[string]interface{}) (Store, error) {
+	switch storeType {
+	case "", StoreMemory:
+		return NewMemoryStore(), nil
+	case StoreRedis:
+		return NewRedisStore(specs)
+	default:
+		return nil, fmt.Errorf("invalid idempotency store %s, must be one of %s or %s", storeType, StoreMemory, StoreRedis)
+	}
+}
+
+// newToken returns a random token identifying a reservation
+func newToken() (string, error) {
+	var token = make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
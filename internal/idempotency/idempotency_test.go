@@ -0,0 +1,145 @@
+package idempotency
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := New("", nil)
+	assert.NoError(err)
+	assert.IsType(&memoryStore{}, store)
+
+	store, err = New(StoreMemory, nil)
+	assert.NoError(err)
+	assert.IsType(&memoryStore{}, store)
+
+	_, err = New("unknown", nil)
+	assert.Error(err)
+
+	_, err = New(StoreRedis, map[string]interface{}{"host": []int{1}})
+	assert.Error(err)
+}
+
+func TestMemoryStore(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	store := NewMemoryStore().(*memoryStore)
+	store.now = func() time.Time { return now }
+
+	state, token, err := store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(Acquired, state)
+	assert.NotEmpty(token)
+
+	state, _, err = store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(InFlight, state)
+
+	// the next call is processed after a release
+	assert.NoError(store.Release(ctx, "key", token))
+	state, token, err = store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(Acquired, state)
+
+	assert.NoError(store.Complete(ctx, "key", "response", time.Hour))
+	assert.NoError(store.Release(ctx, "key", token))
+	state, response, err := store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(Completed, state)
+	assert.Equal("response", response)
+
+	// an expired reservation can be acquired again, the release of the
+	// expired reservation keeps the new one
+	state, expired, err := store.Acquire(ctx, "other", time.Minute)
+	assert.NoError(err)
+	assert.Equal(Acquired, state)
+	now = now.Add(2 * time.Minute)
+	state, token, err = store.Acquire(ctx, "other", time.Minute)
+	assert.NoError(err)
+	assert.Equal(Acquired, state)
+	assert.NotEqual(expired, token)
+	assert.NoError(store.Release(ctx, "other", expired))
+	state, _, err = store.Acquire(ctx, "other", time.Minute)
+	assert.NoError(err)
+	assert.Equal(InFlight, state)
+
+	// the expired keys are removed
+	now = now.Add(2 * time.Hour)
+	state, _, err = store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(Acquired, state)
+	assert.Len(store.records, 1)
+
+	assert.NoError(store.Close())
+	assert.Empty(store.records)
+}
+
+type RedisStoreTestSuite struct {
+	suite.Suite
+	store Store
+}
+
+func (suite *RedisStoreTestSuite) BeforeTest(suiteName, testName string) {
+	store, err := NewRedisStore(map[string]interface{}{
+		"host":   os.Getenv("REDIS_HOST"),
+		"port":   os.Getenv("REDIS_PORT"),
+		"prefix": "webhooked:idempotency:test:" + testName + ":",
+	})
+	require.NoError(suite.T(), err)
+	suite.store = store
+}
+
+func (suite *RedisStoreTestSuite) AfterTest(suiteName, testName string) {
+	suite.store.Close()
+}
+
+func (suite *RedisStoreTestSuite) TestRedisStore() {
+	assert := assert.New(suite.T())
+	ctx := context.Background()
+
+	state, token, err := suite.store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(Acquired, state)
+
+	state, _, err = suite.store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(InFlight, state)
+
+	// the release with another token keeps the reservation
+	assert.NoError(suite.store.Release(ctx, "key", "other"))
+	state, _, err = suite.store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(InFlight, state)
+
+	assert.NoError(suite.store.Release(ctx, "key", token))
+	state, token, err = suite.store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(Acquired, state)
+
+	assert.NoError(suite.store.Complete(ctx, "key", "response", time.Minute))
+	assert.NoError(suite.store.Release(ctx, "key", token))
+	state, response, err := suite.store.Acquire(ctx, "key", time.Minute)
+	assert.NoError(err)
+	assert.Equal(Completed, state)
+	assert.Equal("response", response)
+}
+
+func TestRunRedisStoreSuite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("redis testing is skiped in short version of test")
+		return
+	}
+
+	suite.Run(t, new(RedisStoreTestSuite))
+}
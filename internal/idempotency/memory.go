@@ -0,0 +1,107 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the minimum interval between two removals of the
+// expired keys of the memory store
+const sweepInterval = time.Minute
+
+// memoryStore is a store keeping the keys in memory. The keys are lost on
+// restart and are not shared between the instances
+type memoryStore struct {
+	// now returns the current time, replaced by the tests
+	now func() time.Time
+
+	mu sync.Mutex // protect following fields
+	// records are the known keys
+	records map[string]*record
+	// lastSweep is the time of the last removal of the expired keys
+	lastSweep time.Time
+}
+
+// record is the state of a key of the memory store
+type record struct {
+	completed bool
+	response  string
+	// token identifies the reservation of the key
+	token     string
+	expiresAt time.Time
+}
+
+// NewMemoryStore returns a store keeping the keys in memory
+func NewMemoryStore() Store {
+	return &memoryStore{now: time.Now, records: make(map[string]*record)}
+}
+
+// Acquire reserves the key when it is unknown or expired
+func (m *memoryStore) Acquire(ctx context.Context, key string, lockTTL time.Duration) (State, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	if r, ok := m.records[key]; ok && now.Before(r.expiresAt) {
+		if r.completed {
+			return Completed, r.response, nil
+		}
+		return InFlight, "", nil
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return 0, "", err
+	}
+
+	m.records[key] = &record{token: token, expiresAt: now.Add(lockTTL)}
+	return Acquired, token, nil
+}
+
+// Complete records the response of the key
+func (m *memoryStore) Complete(ctx context.Context, key, response string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.records[key] = &record{completed: true, response: response, expiresAt: m.now().Add(ttl)}
+	return nil
+}
+
+// Release removes the reservation of the key with the token, a completed
+// key is kept
+func (m *memoryStore) Release(ctx context.Context, key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.records[key]; ok && !r.completed && r.token == token {
+		delete(m.records, key)
+	}
+	return nil
+}
+
+// Close removes all the keys
+func (m *memoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.records = make(map[string]*record)
+	return nil
+}
+
+// sweep removes the expired keys, at most once per sweep interval. The
+// caller must hold the mutex
+func (m *memoryStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, r := range m.records {
+		if !now.Before(r.expiresAt) {
+			delete(m.records, key)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"atomys.codes/webhooked/internal/tlsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+)
+
+const (
+	// inFlightPrefix is the prefix of the value of a reserved key,
+	// followed by the token of the reservation
+	inFlightPrefix = "0"
+	// completedPrefix is the prefix of the value of a completed key,
+	// followed by the response
+	completedPrefix = "1"
+)
+
+// releaseScript deletes the key only when it is still reserved with the
+// token, a key completed or reserved again in the meantime is kept
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisStore is a store keeping the keys in redis, shared between the
+// instances
+type redisStore struct {
+	client redis.UniversalClient
+	config *redisConfig
+}
+
+// redisConfig is the configuration of the redis store
+type redisConfig struct {
+	Host     valuable.Valuable `mapstructure:"host" json:"host"`
+	Port     valuable.Valuable `mapstructure:"port" json:"port"`
+	Username valuable.Valuable `mapstructure:"username" json:"username"`
+	Password valuable.Valuable `mapstructure:"password" json:"password"`
+	Database int               `mapstructure:"database" json:"database"`
+	// Addresses is the list of host:port addresses of the cluster nodes.
+	// When empty, the host and port fields are used instead
+	Addresses []string `mapstructure:"addresses" json:"addresses"`
+	// TLS is the TLS configuration used to connect to redis
+	TLS tlsconfig.Config `mapstructure:"tls" json:"tls"`
+	// Prefix is the prefix of the keys (default: webhooked:idempotency:)
+	Prefix string `mapstructure:"prefix" json:"prefix"`
+}
+
+// NewRedisStore returns a store keeping the keys in redis. The connection
+// is checked before returning
+func NewRedisStore(configRaw map[string]interface{}) (Store, error) {
+	store := &redisStore{config: &redisConfig{}}
+	if err := valuable.Decode(configRaw, &store.config); err != nil {
+		return nil, err
+	}
+
+	if store.config.Prefix == "" {
+		store.config.Prefix = "webhooked:idempotency:"
+	}
+
+	tlsConfig, err := store.config.TLS.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := store.config.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{fmt.Sprintf("%s:%s", store.config.Host, store.config.Port)}
+	}
+
+	store.client = redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:     addresses,
+		DB:        store.config.Database,
+		Username:  store.config.Username.First(),
+		Password:  store.config.Password.First(),
+		TLSConfig: tlsConfig,
+	})
+
+	if err := store.client.Ping(context.Background()).Err(); err != nil {
+		store.client.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Acquire reserves the key with SET NX, the value of the key is read when
+// it already exists
+func (r *redisStore) Acquire(ctx context.Context, key string, lockTTL time.Duration) (State, string, error) {
+	key = r.config.Prefix + key
+
+	token, err := newToken()
+	if err != nil {
+		return 0, "", err
+	}
+
+	for {
+		acquired, err := r.client.SetNX(ctx, key, inFlightPrefix+token, lockTTL).Result()
+		if err != nil {
+			return 0, "", err
+		}
+		if acquired {
+			return Acquired, token, nil
+		}
+
+		value, err := r.client.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			// the key expired between the two commands
+			continue
+		} else if err != nil {
+			return 0, "", err
+		}
+
+		if strings.HasPrefix(value, completedPrefix) {
+			return Completed, strings.TrimPrefix(value, completedPrefix), nil
+		}
+		return InFlight, "", nil
+	}
+}
+
+// Complete records the response of the key
+func (r *redisStore) Complete(ctx context.Context, key, response string, ttl time.Duration) error {
+	return r.client.Set(ctx, r.config.Prefix+key, completedPrefix+response, ttl).Err()
+}
+
+// Release removes the reservation of the key with the token, a completed
+// key is kept
+func (r *redisStore) Release(ctx context.Context, key, token string) error {
+	return releaseScript.Run(ctx, r.client, []string{r.config.Prefix + key}, inFlightPrefix+token).Err()
+}
+
+// Close closes the connections to redis
+func (r *redisStore) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"atomys.codes/webhooked/internal/config"
+)
+
+// limiter bounds the number of webhook calls processed concurrently. The
+// calls above the limit wait for a free slot in a bounded queue
+type limiter struct {
+	settings config.ConcurrencySpec
+	labels   prometheus.Labels
+	// slots holds a value for each call in progress
+	slots chan struct{}
+
+	mu sync.Mutex // protect following fields
+	// queued is the number of calls waiting for a free slot
+	queued int
+}
+
+// limiters are the limiters of the server and of each spec, recreated when
+// their settings change after a reload
+type limiters struct {
+	mu     sync.Mutex // protect following fields
+	server *limiter
+	specs  map[string]*limiter
+}
+
+var (
+	// errSaturated is returned when a call cannot get a free slot
+	errSaturated = errors.New("too many webhook calls in progress")
+
+	// concurrencyLimiters are the limiters of the current configuration
+	concurrencyLimiters = &limiters{specs: make(map[string]*limiter)}
+
+	// inFlightRequests is the number of calls in progress for each limit
+	inFlightRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "webhooked",
+		Name:      "concurrency_in_flight_requests",
+		Help:      "Number of webhook calls in progress under the concurrency limit",
+	}, []string{"scope", "spec"})
+	// queuedRequests is the depth of the queue of each limit
+	queuedRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "webhooked",
+		Name:      "concurrency_queued_requests",
+		Help:      "Number of webhook calls waiting for a free slot of the concurrency limit",
+	}, []string{"scope", "spec"})
+	// rejectedRequests is the number of calls rejected by each limit
+	rejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webhooked",
+		Name:      "concurrency_rejected_requests_total",
+		Help:      "Number of webhook calls rejected by the concurrency limit",
+	}, []string{"scope", "spec"})
+)
+
+// concurrencyMiddleware limits the webhook calls processed concurrently by
+// their spec then by the server. The saturated calls are rejected with a
+// `Retry-After` header, 429 for the limit of the spec and 503 for the
+// limit of the server
+func concurrencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := config.Current()
+		pp := getVersionAndEndpoint(r.URL.Path)
+		spec, err := current.GetSpecByEndpoint(pp["endpoint"])
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the slot of the spec is taken first to not hold a slot of the
+		// server while waiting for the spec
+		specLimiter := concurrencyLimiters.spec(spec)
+		if err := specLimiter.acquire(r.Context()); err != nil {
+			reject(w, spec.Name, err, http.StatusTooManyRequests, spec.Concurrency.RetryAfter)
+			return
+		}
+		defer specLimiter.release()
+
+		serverLimiter := concurrencyLimiters.global(current.Concurrency)
+		if err := serverLimiter.acquire(r.Context()); err != nil {
+			reject(w, spec.Name, err, http.StatusServiceUnavailable, current.Concurrency.RetryAfter)
+			return
+		}
+		defer serverLimiter.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reject writes the response of a call rejected by a concurrency limit
+func reject(w http.ResponseWriter, spec string, err error, statusCode int, retryAfter time.Duration) {
+	if errors.Is(err, errSaturated) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		log.Warn().Err(err).Str("spec", spec).Int("statusCode", statusCode).Msg("Webhook call rejected by the concurrency limit")
+	}
+	w.WriteHeader(statusCode)
+}
+
+// spec returns the limiter of the spec, nil when the spec is not limited
+func (l *limiters) spec(spec *config.WebhookSpec) *limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current, ok := l.specs[spec.Name]
+	if !ok || current.settingsChanged(spec.Concurrency) {
+		current = newLimiter(spec.Concurrency, prometheus.Labels{"scope": "spec", "spec": spec.Name})
+		l.specs[spec.Name] = current
+	}
+	return current
+}
+
+// global returns the limiter of the server, nil when the server is not
+// limited
+func (l *limiters) global(settings config.ConcurrencySpec) *limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.server.settingsChanged(settings) {
+		l.server = newLimiter(settings, prometheus.Labels{"scope": "server", "spec": ""})
+	}
+	return l.server
+}
+
+// newLimiter returns the limiter of the settings, nil when the number of
+// calls is unlimited
+func newLimiter(settings config.ConcurrencySpec, labels prometheus.Labels) *limiter {
+	if settings.MaxConcurrent == 0 {
+		return nil
+	}
+
+	return &limiter{
+		settings: settings,
+		labels:   labels,
+		slots:    make(chan struct{}, settings.MaxConcurrent),
+	}
+}
+
+// settingsChanged returns true when the limiter does not apply the
+// settings. A nil limiter applies the unlimited settings
+func (l *limiter) settingsChanged(settings config.ConcurrencySpec) bool {
+	if l == nil {
+		return settings.MaxConcurrent != 0
+	}
+	return l.settings != settings
+}
+
+// acquire takes a free slot, waiting in the queue when there is no free
+// slot. It returns errSaturated when the queue is full or when the max
+// wait is elapsed
+func (l *limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		inFlightRequests.With(l.labels).Inc()
+		return nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.settings.MaxQueued {
+		l.mu.Unlock()
+		rejectedRequests.With(l.labels).Inc()
+		return errSaturated
+	}
+	l.queued++
+	queuedRequests.With(l.labels).Set(float64(l.queued))
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		queuedRequests.With(l.labels).Set(float64(l.queued))
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.settings.MaxWait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		inFlightRequests.With(l.labels).Inc()
+		return nil
+	case <-timer.C:
+		rejectedRequests.With(l.labels).Inc()
+		return errSaturated
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by acquire
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+
+	<-l.slots
+	inFlightRequests.With(l.labels).Dec()
+}
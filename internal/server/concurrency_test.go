@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/internal/config"
+)
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	var unlimited *limiter
+	assert.NoError(unlimited.acquire(context.Background()))
+	unlimited.release()
+	assert.Nil(newLimiter(config.ConcurrencySpec{}, nil))
+
+	labels := prometheus.Labels{"scope": "spec", "spec": "limiterTest"}
+	l := newLimiter(config.ConcurrencySpec{MaxConcurrent: 1, MaxQueued: 1, MaxWait: 50 * time.Millisecond}, labels)
+	rejected := testutil.ToFloat64(rejectedRequests.With(labels))
+	assert.NoError(l.acquire(context.Background()))
+	assert.Equal(1.0, testutil.ToFloat64(inFlightRequests.With(labels)))
+
+	// the call waits in the queue until the slot is released
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.release()
+	}()
+	assert.NoError(l.acquire(context.Background()))
+
+	// the call is rejected after the max wait
+	assert.ErrorIs(l.acquire(context.Background()), errSaturated)
+
+	// the call is rejected immediately when the queue is full
+	var waiting = make(chan error)
+	go func() { waiting <- l.acquire(context.Background()) }()
+	assert.Eventually(func() bool { return testutil.ToFloat64(queuedRequests.With(labels)) == 1 }, time.Second, time.Millisecond)
+	start := time.Now()
+	assert.ErrorIs(l.acquire(context.Background()), errSaturated)
+	assert.Less(time.Since(start), 50*time.Millisecond)
+	assert.ErrorIs(<-waiting, errSaturated)
+	assert.Equal(rejected+3, testutil.ToFloat64(rejectedRequests.With(labels)))
+	assert.Equal(0.0, testutil.ToFloat64(queuedRequests.With(labels)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(l.acquire(ctx), context.Canceled)
+
+	l.release()
+	assert.Equal(0.0, testutil.ToFloat64(inFlightRequests.With(labels)))
+}
+
+func TestLimiters(t *testing.T) {
+	assert := assert.New(t)
+
+	l := &limiters{specs: make(map[string]*limiter)}
+	spec := &config.WebhookSpec{Name: "test", Concurrency: config.ConcurrencySpec{MaxConcurrent: 1}}
+
+	first := l.spec(spec)
+	assert.NotNil(first)
+	assert.Same(first, l.spec(spec))
+
+	spec.Concurrency.MaxConcurrent = 2
+	assert.NotSame(first, l.spec(spec))
+
+	spec.Concurrency.MaxConcurrent = 0
+	assert.Nil(l.spec(spec))
+
+	assert.Nil(l.global(config.ConcurrencySpec{}))
+	server := l.global(config.ConcurrencySpec{MaxConcurrent: 1})
+	assert.NotNil(server)
+	assert.Same(server, l.global(config.ConcurrencySpec{MaxConcurrent: 1}))
+}
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	spec, err := config.Current().GetSpecByEndpoint("/webhooks/example")
+	assert.NoError(err)
+	defer func(previous config.ConcurrencySpec) { spec.Concurrency = previous }(spec.Concurrency)
+	spec.Concurrency = config.ConcurrencySpec{MaxConcurrent: 1, MaxWait: time.Millisecond, RetryAfter: 1500 * time.Millisecond}
+
+	var entered, unblock = make(chan struct{}), make(chan struct{})
+	handler := concurrencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w
+	}
+
+	var done = make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve("/v1alpha1/webhooks/example") }()
+	<-entered
+
+	w := serve("/v1alpha1/webhooks/example")
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Equal("2", w.Header().Get("Retry-After"))
+
+	// the unknown endpoints are not limited
+	go func() { done <- serve("/v1alpha1/unknown") }()
+	<-entered
+	unblock <- struct{}{}
+	assert.Equal(http.StatusOK, (<-done).Code)
+
+	unblock <- struct{}{}
+	assert.Equal(http.StatusOK, (<-done).Code)
+
+	// the limit of the server applies to all the specs
+	spec.Concurrency = config.ConcurrencySpec{}
+	defer func(previous config.ConcurrencySpec) { config.Current().Concurrency = previous }(config.Current().Concurrency)
+	config.Current().Concurrency = config.ConcurrencySpec{MaxConcurrent: 1, MaxWait: time.Millisecond, RetryAfter: time.Second}
+
+	go func() { done <- serve("/v1alpha1/webhooks/example") }()
+	<-entered
+
+	w = serve("/v1alpha1/webhooks/example")
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal("1", w.Header().Get("Retry-After"))
+
+	unblock <- struct{}{}
+	assert.Equal(http.StatusOK, (<-done).Code)
+}
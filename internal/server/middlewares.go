@@ -98,3 +98,14 @@ func getVersionAndEndpoint(path string) map[string]string {
 
 	return result
 }
+
+// configMiddleware holds the current configuration during the request, the
+// configuration reloads wait for the requests in progress
+func configMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release := config.Acquire()
+		defer release()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,8 +1,12 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -10,6 +14,8 @@ import (
 
 	"atomys.codes/webhooked/internal/config"
 	v1alpha1 "atomys.codes/webhooked/internal/server/v1alpha1"
+	"atomys.codes/webhooked/pkg/storage"
+	"atomys.codes/webhooked/pkg/storage/capability"
 )
 
 // APIVersion is the interface for all supported API versions
@@ -19,6 +25,13 @@ type APIVersion interface {
 	WebhookHandler() http.HandlerFunc
 }
 
+// asyncDeliverer is implemented by the API versions delivering the
+// webhooks in background
+type asyncDeliverer interface {
+	StartAsync() error
+	StopAsync(ctx context.Context) error
+}
+
 type Server struct {
 	*http.Server
 }
@@ -28,8 +41,21 @@ var (
 	apiVersions = []APIVersion{
 		v1alpha1.NewServer(),
 	}
+	// readinessTimeout is the maximum duration of the storages health checks
+	readinessTimeout = 5 * time.Second
+	// stopping is set to 1 when the server is shutting down, the readiness
+	// endpoint reports the server as not ready from this moment
+	stopping int32
 )
 
+// storageStatus is the state of a storage reported by the verbose mode of
+// the readiness endpoint
+type storageStatus struct {
+	Healthy      bool                    `json:"healthy"`
+	Error        string                  `json:"error,omitempty"`
+	Capabilities []capability.Capability `json:"capabilities,omitempty"`
+}
+
 // NewServer create a new server instance with the given port
 func NewServer(port int) (*Server, error) {
 	if !validPort(port) {
@@ -54,19 +80,73 @@ func (s *Server) Serve() error {
 		router.Handle("/metrics", promhttp.Handler()).Name("metrics")
 	}
 
+	if err := startAsync(); err != nil {
+		return err
+	}
+
 	s.Handler = router
 	log.Info().Msgf("Listening on %s", s.Addr)
 	return s.ListenAndServe()
 }
 
+// Stop gracefully shuts down the server then closes the storages
+// implementing storage.Closer, letting them flush their pending data
+// before the given context is done
+func (s *Server) Stop(ctx context.Context) error {
+	atomic.StoreInt32(&stopping, 1)
+	err := s.Shutdown(ctx)
+
+	for _, version := range apiVersions {
+		if deliverer, ok := version.(asyncDeliverer); ok {
+			if stopErr := deliverer.StopAsync(ctx); stopErr != nil {
+				log.Error().Err(stopErr).Msgf("Error during async delivery stop of %s", version.Version())
+			}
+		}
+	}
+
+	config.Current().CloseStorages(ctx)
+	return err
+}
+
+// Reload loads the configuration file and replaces the current
+// configuration without interrupting the server. The storages of the
+// previous configuration are closed once the requests using them are done
+func (s *Server) Reload(ctx context.Context, cfgFile string) error {
+	previousConfig, err := config.Reload(ctx, cfgFile)
+	if err != nil {
+		return err
+	}
+
+	previousConfig.CloseStorages(ctx)
+	log.Info().Msg("Configuration reloaded")
+	return startAsync()
+}
+
+// startAsync starts the asynchronous delivery of the API versions
+// supporting it, for the specs of the current configuration
+func startAsync() error {
+	for _, version := range apiVersions {
+		if deliverer, ok := version.(asyncDeliverer); ok {
+			if err := deliverer.StartAsync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // newRouter returns a new router with all the routes
 // for all supported API versions
 func newRouter() *mux.Router {
 	var api = mux.NewRouter()
 	for _, version := range apiVersions {
-		api.Methods("POST").PathPrefix("/" + version.Version()).Handler(version.WebhookHandler()).Name(version.Version())
+		api.Methods("POST").PathPrefix("/" + version.Version()).Handler(concurrencyMiddleware(version.WebhookHandler())).Name(version.Version())
 	}
 
+	api.Methods("GET").Path("/readyz").HandlerFunc(readinessHandler).Name("readiness")
+	api.Methods("GET").Path("/healthz").HandlerFunc(livenessHandler).Name("liveness")
+	api.Use(configMiddleware)
+
 	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 	})
@@ -79,3 +159,69 @@ func newRouter() *mux.Router {
 func validPort(port int) bool {
 	return port > 0 && port < 65535
 }
+
+// livenessHandler reports that the server is running. Unlike the readiness,
+// the state of the storages is not checked
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// readinessHandler reports if the server is ready to receive webhooks. The
+// server is ready when all storages implementing storage.HealthChecker are
+// healthy and the server is not shutting down, otherwise a 503 is returned
+// with the failing storages. With the `verbose` query parameter, the state
+// and the capabilities of all storages are returned
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&stopping) == 1 {
+		writeReadiness(w, http.StatusServiceUnavailable, map[string]string{"server": "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	var failures = make(map[string]string)
+	var statuses = make(map[string]storageStatus)
+	for _, spec := range config.Current().Specs {
+		var storages = spec.Storage
+		if spec.HasDeadLetter() {
+			storages = append(storages[:len(storages):len(storages)], spec.DeadLetter)
+		}
+
+		for _, s := range storages {
+			// the storage names are unique in the spec, the dead letter
+			// storage included
+			name := fmt.Sprintf("%s/%s", spec.Name, s.Name)
+			status := storageStatus{Healthy: true, Capabilities: storage.Capabilities(s.Client)}
+
+			if err := storage.Ping(ctx, s.Client); err != nil {
+				failures[name] = err.Error()
+				status.Healthy, status.Error = false, err.Error()
+			}
+			statuses[name] = status
+		}
+	}
+
+	var code = http.StatusOK
+	if len(failures) > 0 {
+		log.Warn().Interface("failures", failures).Msg("Server is not ready")
+		code = http.StatusServiceUnavailable
+	}
+
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		writeReadiness(w, code, statuses)
+	} else if len(failures) > 0 {
+		writeReadiness(w, code, failures)
+	} else {
+		w.WriteHeader(code)
+	}
+}
+
+// writeReadiness writes the JSON report of the readiness endpoint
+func writeReadiness(w http.ResponseWriter, code int, report interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Error().Err(err).Msg("Error during readiness response writing")
+	}
+}
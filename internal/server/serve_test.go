@@ -2,10 +2,17 @@ package server
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/internal/config"
+	"atomys.codes/webhooked/pkg/storage/capability"
 )
 
 func Test_NewServer(t *testing.T) {
@@ -41,6 +48,83 @@ func Test_Serve(t *testing.T) {
 	assert.ErrorIs(t, <-chanError, http.ErrServerClosed)
 }
 
+type testCloserStorage struct {
+	closed *bool
+}
+
+func (s testCloserStorage) Name() string                             { return "test" }
+func (s testCloserStorage) Push(ctx context.Context, v []byte) error { return nil }
+func (s testCloserStorage) Close(ctx context.Context) error {
+	*s.closed = true
+	return errors.New("already closed")
+}
+
+func Test_Stop(t *testing.T) {
+	assert := assert.New(t)
+
+	previousSpecs := config.Current().Specs
+	defer func() { config.Current().Specs = previousSpecs }()
+	defer atomic.StoreInt32(&stopping, 0)
+
+	var closed bool
+	config.Current().Specs = []*config.WebhookSpec{{
+		Name: "stop",
+		Storage: []*config.StorageSpec{
+			{Type: "test", Client: testCloserStorage{closed: &closed}},
+			{Type: "test", Client: testHealthCheckerStorage{}},
+		},
+	}}
+
+	srv, err := NewServer(38082)
+	assert.NoError(err)
+
+	var chanError = make(chan error)
+	go func() {
+		chanError <- srv.Serve()
+	}()
+
+	assert.Eventually(func() bool {
+		resp, err := http.Get("http://127.0.0.1:38082/readyz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(srv.Stop(context.Background()))
+	assert.ErrorIs(<-chanError, http.ErrServerClosed)
+	assert.True(closed)
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(`{"server":"shutting down"}`, w.Body.String())
+}
+
+func Test_Reload(t *testing.T) {
+	assert := assert.New(t)
+
+	previousConfig := *config.Current()
+	defer func() { *config.Current() = previousConfig }()
+
+	var closed bool
+	config.Current().Specs = []*config.WebhookSpec{{
+		Name:    "reload",
+		Storage: []*config.StorageSpec{{Type: "test", Client: testCloserStorage{closed: &closed}}},
+	}}
+
+	srv, err := NewServer(38083)
+	assert.NoError(err)
+
+	assert.Error(srv.Reload(context.Background(), "../../tests/unknown.yaml"))
+	assert.False(closed)
+	assert.Equal("reload", config.Current().Specs[0].Name)
+
+	assert.NoError(srv.Reload(context.Background(), "../../tests/webhooks.tests.yaml"))
+	assert.True(closed)
+	assert.Equal("exampleHook", config.Current().Specs[0].Name)
+}
+
 func Test_validPort(t *testing.T) {
 	assert := assert.New(t)
 
@@ -66,3 +150,75 @@ func Test_newRouter(t *testing.T) {
 	router := newRouter()
 	assert.NotNil(t, router.NotFoundHandler)
 }
+
+type testHealthCheckerStorage struct {
+	err error
+}
+
+func (s testHealthCheckerStorage) Name() string                             { return "test" }
+func (s testHealthCheckerStorage) Push(ctx context.Context, v []byte) error { return nil }
+func (s testHealthCheckerStorage) Ping(ctx context.Context) error           { return s.err }
+func (s testHealthCheckerStorage) Capabilities() []capability.Capability {
+	return []capability.Capability{capability.Batch}
+}
+
+func Test_readinessHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	previousSpecs := config.Current().Specs
+	defer func() { config.Current().Specs = previousSpecs }()
+
+	spec := &config.WebhookSpec{
+		Name: "readiness",
+		Storage: []*config.StorageSpec{
+			{Type: "test", Name: "test", Client: testHealthCheckerStorage{}},
+		},
+	}
+	config.Current().Specs = []*config.WebhookSpec{spec}
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(http.StatusOK, w.Code)
+
+	spec.Storage[0].Client = testHealthCheckerStorage{err: errors.New("connection lost")}
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(`{"readiness/test":"connection lost"}`, w.Body.String())
+
+	// the storages of the same type are identified by their name
+	spec.Storage = append(spec.Storage, &config.StorageSpec{Type: "test", Name: "pusher", Client: testCloserStorage{}})
+	spec.DeadLetter = &config.StorageSpec{Type: "test", Name: "deadLetter", Client: testCloserStorage{}}
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz?verbose", nil))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(`{
+		"readiness/test":{"healthy":false,"error":"connection lost","capabilities":["batch"]},
+		"readiness/pusher":{"healthy":true},
+		"readiness/deadLetter":{"healthy":true}
+	}`, w.Body.String())
+
+	spec.Storage[0].Client = testHealthCheckerStorage{}
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz?verbose", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{
+		"readiness/test":{"healthy":true,"capabilities":["batch"]},
+		"readiness/pusher":{"healthy":true},
+		"readiness/deadLetter":{"healthy":true}
+	}`, w.Body.String())
+}
+
+func Test_livenessHandler(t *testing.T) {
+	previousSpecs := config.Current().Specs
+	defer func() { config.Current().Specs = previousSpecs }()
+
+	config.Current().Specs = []*config.WebhookSpec{{
+		Name:    "liveness",
+		Storage: []*config.StorageSpec{{Type: "test", Client: testHealthCheckerStorage{err: errors.New("connection lost")}}},
+	}}
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"atomys.codes/webhooked/internal/config"
+	"atomys.codes/webhooked/internal/wal"
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+// asyncRequest is the webhook request written in the write-ahead log, with
+// everything needed to format the payload during the delivery
+type asyncRequest struct {
+	Spec       string      `json:"spec"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host"`
+	Header     http.Header `json:"header"`
+	RemoteAddr string      `json:"remoteAddr"`
+	Body       []byte      `json:"body"`
+}
+
+// asyncQueue is the write-ahead log of a spec with the workers delivering
+// its entries
+type asyncQueue struct {
+	spec      string
+	directory string
+	log       *wal.Log
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+
+	mu sync.Mutex // protect following fields
+	// attempts are the states of the entries being retried
+	attempts map[uint64]*asyncAttempt
+}
+
+// asyncAttempt is the state of the delivery of an entry being retried
+type asyncAttempt struct {
+	// count is the number of failed attempts
+	count int
+	// delivered are the keys of the storages already delivered, they do
+	// not receive the payload again. See storageKey
+	delivered map[string]bool
+}
+
+var (
+	// errAsyncNotStarted is returned when the asynchronous delivery of the
+	// spec is enabled but not started
+	errAsyncNotStarted = errors.New("async delivery is not started")
+
+	// asyncPendingEntries is the number of payloads waiting for their
+	// delivery for each spec
+	asyncPendingEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "webhooked",
+		Name:      "async_pending_entries",
+		Help:      "Number of payloads waiting for their asynchronous delivery",
+	}, []string{"spec"})
+)
+
+// StartAsync opens the write-ahead log of the specs with the asynchronous
+// delivery enabled and starts their workers. The entries not delivered
+// before the last stop are replayed. It is called again after a reload of
+// the configuration to start the new specs and stop the removed ones
+func (s *Server) StartAsync() error {
+	release := config.Acquire()
+	defer release()
+
+	s.asyncMu.Lock()
+	defer s.asyncMu.Unlock()
+
+	var enabled = make(map[string]bool)
+	for _, spec := range s.config.Specs {
+		if !spec.Async.Enabled {
+			continue
+		}
+		enabled[spec.Name] = true
+
+		if q, ok := s.queues[spec.Name]; ok {
+			if q.directory == spec.Async.Directory {
+				continue
+			}
+			q.stop(context.Background())
+			delete(s.queues, spec.Name)
+		}
+
+		q, err := s.startQueue(spec)
+		if err != nil {
+			return fmt.Errorf("async delivery of %s cannot be started: %s", spec.Name, err.Error())
+		}
+
+		if s.queues == nil {
+			s.queues = make(map[string]*asyncQueue)
+		}
+		s.queues[spec.Name] = q
+	}
+
+	for name, q := range s.queues {
+		if !enabled[name] {
+			q.stop(context.Background())
+			delete(s.queues, name)
+		}
+	}
+
+	return nil
+}
+
+// StopAsync stops the workers and closes the write-ahead logs. The
+// deliveries in progress are waited until the context is done, the entries
+// not delivered are kept in the write-ahead logs
+func (s *Server) StopAsync(ctx context.Context) error {
+	s.asyncMu.Lock()
+	defer s.asyncMu.Unlock()
+
+	var err error
+	for name, q := range s.queues {
+		if stopErr := q.stop(ctx); stopErr != nil && err == nil {
+			err = stopErr
+		}
+		delete(s.queues, name)
+	}
+
+	return err
+}
+
+// startQueue opens the write-ahead log of the spec and starts its workers
+func (s *Server) startQueue(spec *config.WebhookSpec) (*asyncQueue, error) {
+	walLog, err := wal.Open(spec.Async.Directory, wal.Options{
+		SegmentSize: spec.Async.SegmentSize,
+		MaxPending:  spec.Async.MaxPending,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &asyncQueue{
+		spec:      spec.Name,
+		directory: spec.Async.Directory,
+		log:       walLog,
+		cancel:    cancel,
+		attempts:  make(map[uint64]*asyncAttempt),
+	}
+	asyncPendingEntries.WithLabelValues(spec.Name).Set(float64(walLog.Len()))
+
+	for i := 0; i < spec.Async.Workers; i++ {
+		q.wg.Add(1)
+		go q.run(ctx, s)
+	}
+
+	log.Info().Str("spec", spec.Name).Msgf("async delivery started with %d workers", spec.Async.Workers)
+	return q, nil
+}
+
+// enqueue writes the request in the write-ahead log of the spec, the
+// payload is delivered by the workers
+func (s *Server) enqueue(spec *config.WebhookSpec, r *http.Request, data []byte) error {
+	s.asyncMu.Lock()
+	q, ok := s.queues[spec.Name]
+	s.asyncMu.Unlock()
+	if !ok {
+		return errAsyncNotStarted
+	}
+
+	entry, err := json.Marshal(asyncRequest{
+		Spec:       spec.Name,
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Host:       r.Host,
+		Header:     r.Header,
+		RemoteAddr: r.RemoteAddr,
+		Body:       data,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := q.log.Append(entry); err != nil {
+		return err
+	}
+
+	asyncPendingEntries.WithLabelValues(spec.Name).Set(float64(q.log.Len()))
+	return nil
+}
+
+// stop stops the workers, waiting for the deliveries in progress until the
+// context is done, then closes the write-ahead log
+func (q *asyncQueue) stop(ctx context.Context) error {
+	q.cancel()
+
+	var done = make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn().Str("spec", q.spec).Msg("async deliveries in progress interrupted, they will be replayed")
+	}
+
+	return q.log.Close()
+}
+
+// run delivers the entries of the write-ahead log until the queue is
+// stopped
+func (q *asyncQueue) run(ctx context.Context, s *Server) {
+	defer q.wg.Done()
+
+	for {
+		entry, err := q.log.Next(ctx)
+		if err != nil {
+			return
+		}
+		q.process(s, entry)
+	}
+}
+
+// process delivers the entry to the storages of the spec. The entry is
+// acknowledged when the delivery policy is satisfied, otherwise it is
+// queued again after a backoff until the max attempts are reached
+func (q *asyncQueue) process(s *Server, entry *wal.Entry) {
+	var request asyncRequest
+	if err := json.Unmarshal(entry.Data, &request); err != nil {
+		log.Error().Err(err).Str("spec", q.spec).Msg("invalid async entry dropped")
+		q.ack(entry)
+		return
+	}
+
+	// the configuration is only held to get the spec, a reload does not
+	// wait for the delivery. A push interrupted by the close of the
+	// previous storages is retried with the storages of the new spec
+	release := config.Acquire()
+	current := *s.config
+	release()
+
+	spec, err := current.GetSpec(request.Spec)
+	if err == nil {
+		err = q.deliver(&current, spec, entry, &request)
+	}
+
+	if err == nil {
+		q.ack(entry)
+		return
+	}
+
+	if errors.As(err, new(*routingError)) {
+		log.Error().Err(err).Str("spec", q.spec).Msg("async entry cannot be routed, payload dropped")
+		q.ack(entry)
+		return
+	}
+
+	q.mu.Lock()
+	attempt := q.attempt(entry.ID)
+	attempt.count++
+	count := attempt.count
+	q.mu.Unlock()
+
+	if spec != nil && spec.Async.MaxAttempts > 0 && count >= spec.Async.MaxAttempts {
+		log.Error().Err(err).Str("spec", q.spec).Int("attempts", count).Msg("async delivery failed, payload dropped")
+		q.ack(entry)
+		return
+	}
+
+	delay := asyncBackoff(spec, count)
+	log.Warn().Err(err).Str("spec", q.spec).Int("attempts", count).Msgf("async delivery failed, retrying in %s", delay)
+	time.AfterFunc(delay, func() { q.log.Requeue(entry) })
+}
+
+// deliver pushes the payload to the storages not already delivered. The
+// dead letter storage is only used by the last attempt
+func (q *asyncQueue) deliver(current *config.Configuration, spec *config.WebhookSpec, entry *wal.Entry, request *asyncRequest) error {
+	r, err := http.NewRequest(request.Method, request.URL, bytes.NewReader(request.Body))
+	if err != nil {
+		return err
+	}
+	r.Header, r.Host, r.RemoteAddr = request.Header, request.Host, request.RemoteAddr
+
+	payloadFormatter := formatting.New().
+		WithRequest(r).
+		WithPayload(request.Body).
+		WithData("Spec", spec).
+		WithData("Config", current)
+
+	storages, err := route(spec, payloadFormatter)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	attempt := q.attempt(entry.ID)
+	var remaining []*config.StorageSpec
+	for _, storage := range storages {
+		if !attempt.delivered[storageKey(storage)] {
+			remaining = append(remaining, storage)
+		}
+	}
+	var deliverySpec = *spec
+	if spec.Async.MaxAttempts == 0 || attempt.count+1 < spec.Async.MaxAttempts {
+		deliverySpec.DeadLetter = nil
+	}
+	q.mu.Unlock()
+
+	results := deliver(context.Background(), &deliverySpec, remaining, payloadFormatter, request.Body)
+
+	q.mu.Lock()
+	for _, result := range results {
+		if result.err == nil {
+			attempt.delivered[storageKey(result.storage)] = true
+		}
+	}
+	for _, storage := range storages {
+		if attempt.delivered[storageKey(storage)] && !containsStorage(remaining, storage) {
+			results = append(results, deliveryResult{storage: storage})
+		}
+	}
+	q.mu.Unlock()
+
+	return checkDelivery(spec, results)
+}
+
+// attempt returns the state of the delivery of the entry. The caller must
+// hold the mutex
+func (q *asyncQueue) attempt(id uint64) *asyncAttempt {
+	attempt, ok := q.attempts[id]
+	if !ok {
+		attempt = &asyncAttempt{delivered: make(map[string]bool)}
+		q.attempts[id] = attempt
+	}
+	return attempt
+}
+
+// ack acknowledges the entry in the write-ahead log, it is not delivered
+// anymore
+func (q *asyncQueue) ack(entry *wal.Entry) {
+	q.mu.Lock()
+	delete(q.attempts, entry.ID)
+	q.mu.Unlock()
+
+	if err := q.log.Ack(entry.ID); err != nil {
+		log.Error().Err(err).Str("spec", q.spec).Msg("async entry cannot be acknowledged, it will be replayed")
+	}
+	asyncPendingEntries.WithLabelValues(q.spec).Set(float64(q.log.Len()))
+}
+
+// asyncBackoff returns the delay before the next attempt of a failed
+// delivery, doubled after each attempt up to the max retry interval
+func asyncBackoff(spec *config.WebhookSpec, attempts int) time.Duration {
+	if spec == nil {
+		return time.Second
+	}
+
+	delay := spec.Async.RetryInterval
+	for i := 1; i < attempts && delay < spec.Async.MaxRetryInterval; i++ {
+		delay *= 2
+	}
+
+	if delay > spec.Async.MaxRetryInterval {
+		delay = spec.Async.MaxRetryInterval
+	}
+	return delay
+}
+
+// storageKey identifies the storage in the delivered storages of an entry.
+// The key is stable across the reloads of the configuration, the names are
+// unique in a spec and a storage replaced by another type receives the
+// payload
+func storageKey(storage *config.StorageSpec) string {
+	return storage.Type + "/" + storage.Name
+}
+
+// containsStorage returns true when the storage is in the list
+func containsStorage(storages []*config.StorageSpec, storage *config.StorageSpec) bool {
+	for _, s := range storages {
+		if s == storage {
+			return true
+		}
+	}
+	return false
+}
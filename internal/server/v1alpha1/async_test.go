@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"atomys.codes/webhooked/internal/config"
+)
+
+// flakyStorage fails the first pushes then records the pushed values
+type flakyStorage struct {
+	failures int32
+	pushes   *int32
+	values   chan string
+}
+
+func (s flakyStorage) Name() string { return "flaky" }
+func (s flakyStorage) Push(ctx context.Context, value []byte) error {
+	if atomic.AddInt32(s.pushes, 1) <= s.failures {
+		return errors.New("connection refused")
+	}
+	s.values <- string(value)
+	return nil
+}
+
+func newFlakyStorage(failures int32) flakyStorage {
+	return flakyStorage{failures: failures, pushes: new(int32), values: make(chan string, 10)}
+}
+
+func newAsyncServer(t *testing.T, async config.AsyncSpec, storages ...*config.StorageSpec) *Server {
+	server := &Server{
+		config: &config.Configuration{
+			APIVersion: "v1alpha1",
+			Specs: []*config.WebhookSpec{{
+				Name:          "test",
+				EntrypointURL: "/test",
+				Storage:       storages,
+				Delivery:      config.DeliverySpec{Policy: "all"},
+				Async:         async,
+			}},
+		},
+		webhookService: webhookService,
+		logger:         log.Logger,
+	}
+	require.NoError(t, server.StartAsync())
+	return server
+}
+
+func flakyStorageSpec(name string, client flakyStorage) *config.StorageSpec {
+	return &config.StorageSpec{
+		Type:       "flaky",
+		Name:       name,
+		Client:     client,
+		Formatting: &config.FormattingSpec{Template: "{{ .Payload }}|{{ .Request.Header | getHeader \"X-Event\" }}"},
+	}
+}
+
+func postWebhook(server *Server) int {
+	req, _ := http.NewRequest("POST", "/v1alpha1/test", strings.NewReader("{}"))
+	req.Header.Set("X-Event", "push")
+	rr := httptest.NewRecorder()
+	server.WebhookHandler().ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestServer_Async(t *testing.T) {
+	assert := assert.New(t)
+
+	flaky, stable := newFlakyStorage(2), newFlakyStorage(0)
+	server := newAsyncServer(t,
+		config.AsyncSpec{Enabled: true, Directory: t.TempDir(), Workers: 2, RetryInterval: time.Millisecond, MaxRetryInterval: time.Millisecond},
+		flakyStorageSpec("flaky", flaky),
+		flakyStorageSpec("stable", stable),
+	)
+
+	assert.Equal(http.StatusOK, postWebhook(server))
+
+	select {
+	case value := <-flaky.values:
+		assert.Equal("{}|push", value)
+	case <-time.After(time.Second):
+		t.Fatal("the payload is not delivered")
+	}
+	assert.Equal("{}|push", <-stable.values)
+
+	assert.NoError(server.StopAsync(context.Background()))
+	assert.Equal(int32(3), atomic.LoadInt32(flaky.pushes))
+	assert.Equal(int32(1), atomic.LoadInt32(stable.pushes))
+}
+
+func TestServer_AsyncReplay(t *testing.T) {
+	assert := assert.New(t)
+	directory := t.TempDir()
+
+	failing := newFlakyStorage(1000)
+	server := newAsyncServer(t,
+		config.AsyncSpec{Enabled: true, Directory: directory, Workers: 1, RetryInterval: time.Hour, MaxRetryInterval: time.Hour},
+		flakyStorageSpec("storage", failing),
+	)
+	assert.Equal(http.StatusOK, postWebhook(server))
+	assert.Eventually(func() bool { return atomic.LoadInt32(failing.pushes) == 1 }, time.Second, time.Millisecond)
+	assert.NoError(server.StopAsync(context.Background()))
+
+	// the entry is replayed by the next start
+	working := newFlakyStorage(0)
+	server = newAsyncServer(t,
+		config.AsyncSpec{Enabled: true, Directory: directory, Workers: 1, RetryInterval: time.Hour, MaxRetryInterval: time.Hour},
+		flakyStorageSpec("storage", working),
+	)
+	defer server.StopAsync(context.Background())
+
+	select {
+	case value := <-working.values:
+		assert.Equal("{}|push", value)
+	case <-time.After(time.Second):
+		t.Fatal("the payload is not replayed")
+	}
+}
+
+func TestServer_AsyncLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	failing := newFlakyStorage(1000)
+	server := newAsyncServer(t,
+		config.AsyncSpec{Enabled: true, Directory: t.TempDir(), Workers: 1, MaxPending: 1, MaxAttempts: 2, RetryInterval: time.Millisecond, MaxRetryInterval: time.Millisecond},
+		flakyStorageSpec("storage", failing),
+	)
+	defer server.StopAsync(context.Background())
+
+	deadLetter := newFlakyStorage(0)
+	server.config.Specs[0].DeadLetter = flakyStorageSpec("deadLetter", deadLetter)
+
+	assert.Equal(http.StatusOK, postWebhook(server))
+	assert.Equal(http.StatusServiceUnavailable, postWebhook(server))
+
+	// the last attempt sends the payload to the dead letter storage
+	select {
+	case value := <-deadLetter.values:
+		assert.Equal("{}|push|push", value)
+	case <-time.After(time.Second):
+		t.Fatal("the payload is not sent to the dead letter storage")
+	}
+	assert.Equal(int32(2), atomic.LoadInt32(failing.pushes))
+	assert.Eventually(func() bool { return postWebhook(server) == http.StatusOK }, time.Second, time.Millisecond)
+
+	assert.NoError(server.StopAsync(context.Background()))
+	assert.Equal(http.StatusInternalServerError, postWebhook(server))
+
+	// the queue of a spec not async anymore is not started
+	server.config.Specs[0].Async.Enabled = false
+	assert.NoError(server.StartAsync())
+	assert.Empty(server.queues)
+}
+
+func TestAsyncBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &config.WebhookSpec{Async: config.AsyncSpec{RetryInterval: time.Second, MaxRetryInterval: 5 * time.Second}}
+	assert.Equal(time.Second, asyncBackoff(spec, 1))
+	assert.Equal(2*time.Second, asyncBackoff(spec, 2))
+	assert.Equal(5*time.Second, asyncBackoff(spec, 10))
+	assert.Equal(time.Second, asyncBackoff(nil, 3))
+}
+
+func TestPushTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &config.WebhookSpec{}
+	assert.Equal(time.Duration(0), pushTimeout(spec, &config.StorageSpec{}))
+	assert.Equal(time.Second, pushTimeout(spec, &config.StorageSpec{Timeout: time.Second}))
+
+	// the asynchronous pushes are always bounded
+	spec.Async = config.AsyncSpec{Enabled: true, Timeout: time.Minute}
+	assert.Equal(time.Minute, pushTimeout(spec, &config.StorageSpec{}))
+	assert.Equal(time.Second, pushTimeout(spec, &config.StorageSpec{Timeout: time.Second}))
+}
+
+func TestStorageKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key := storageKey(&config.StorageSpec{Type: "redis", Name: "cache"})
+	assert.Equal(key, storageKey(&config.StorageSpec{Type: "redis", Name: "cache"}))
+	assert.NotEqual(key, storageKey(&config.StorageSpec{Type: "redis", Name: "events"}))
+	assert.NotEqual(key, storageKey(&config.StorageSpec{Type: "postgres", Name: "cache"}))
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"atomys.codes/webhooked/internal/config"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// deliveryResult is the result of the push of the payload to a storage
+type deliveryResult struct {
+	storage *config.StorageSpec
+	err     error
+}
+
+// deliveryError is returned when the delivery policy of the spec is not
+// satisfied, it contains the error of each failed storage
+type deliveryError struct {
+	policy   string
+	failures map[string]error
+}
+
+// Error returns the failed storages with their error
+func (e *deliveryError) Error() string {
+	var failures = make([]string, 0, len(e.failures))
+	for name, err := range e.failures {
+		failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+	}
+	sort.Strings(failures)
+
+	return fmt.Sprintf("delivery policy %s not satisfied (%s)", e.policy, strings.Join(failures, ", "))
+}
+
+// timedOut returns true when all the storages failed by timeout
+func (e *deliveryError) timedOut() bool {
+	for _, err := range e.failures {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+	}
+	return len(e.failures) > 0
+}
+
+// deliver pushes the payload to the selected storages of the spec
+// concurrently and waits for the result of each storage. Each storage has
+// its own formatter and its own timeout
+func deliver(ctx context.Context, spec *config.WebhookSpec, storages []*config.StorageSpec, payloadFormatter *formatting.Formatter, data []byte) []deliveryResult {
+	var results = make([]deliveryResult, len(storages))
+	var wg sync.WaitGroup
+
+	for i, storage := range storages {
+		wg.Add(1)
+		go func(i int, storage *config.StorageSpec) {
+			defer wg.Done()
+			payload, err := push(ctx, storage, pushTimeout(spec, storage), payloadFormatter.Clone(), data)
+			if err != nil && spec.HasDeadLetter() {
+				err = deadLetter(spec, storage, payloadFormatter.Clone(), payload, err)
+			}
+			results[i] = deliveryResult{storage: storage, err: err}
+		}(i, storage)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// pushTimeout returns the maximum duration of the push to the storage, 0
+// when unbounded. The asynchronous pushes are not bound to a request, the
+// storages without timeout use the timeout of the async delivery
+func pushTimeout(spec *config.WebhookSpec, storage *config.StorageSpec) time.Duration {
+	if storage.Timeout == 0 && spec.Async.Enabled {
+		return spec.Async.Timeout
+	}
+	return storage.Timeout
+}
+
+// push renders the payload of the storage and pushes it, within the timeout
+// when defined. The rendered payload is returned to be sent to the dead
+// letter storage when the push failed
+func push(ctx context.Context, storage *config.StorageSpec, timeout time.Duration, storageFormatter *formatting.Formatter, data []byte) (string, error) {
+	storagePayload, err := storageFormatter.
+		WithData("Storage", storage).
+		WithTemplate(storage.Formatting.Template).
+		Render()
+	if err != nil {
+		return string(data), err
+	}
+
+	// update the formatter with the rendered payload of storage formatting
+	// this will allow to chain formatting
+	storageFormatter.WithData("PreviousPayload", data)
+	ctx = formatting.ToContext(ctx, storageFormatter)
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	log.Debug().Msgf("store following data: %s", storagePayload)
+	if err := storage.Client.Push(ctx, []byte(storagePayload)); err != nil {
+		return storagePayload, err
+	}
+
+	log.Debug().Str("storage", storage.Name).Msgf("stored successfully")
+	return storagePayload, nil
+}
+
+// deadLetterData is the failure metadata available in the formatting of
+// the dead letter storage as `.DeadLetter`
+type deadLetterData struct {
+	// Storage is the name of the failed storage
+	Storage string
+	// Error is the error of the last attempt
+	Error string
+	// Attempts is the number of attempts made before the failure
+	Attempts int
+	// Timestamp is the time of the failure
+	Timestamp time.Time
+}
+
+// deadLetter pushes the payload that the storage failed to store to the
+// dead letter storage of the spec. The push is not bound to the request
+// context, so the payload is kept when the caller disconnects. It returns
+// nil when the payload is stored in the dead letter storage, otherwise the
+// push error with the dead letter error
+func deadLetter(spec *config.WebhookSpec, storage *config.StorageSpec, deadLetterFormatter *formatting.Formatter, payload string, pushErr error) error {
+	letter := deadLetterData{
+		Storage:   storage.Name,
+		Error:     pushErr.Error(),
+		Attempts:  retry.Attempts(pushErr),
+		Timestamp: time.Now().UTC(),
+	}
+
+	deadLetterFormatter.
+		WithPayload([]byte(payload)).
+		WithData("DeadLetter", letter)
+
+	if _, err := push(context.Background(), spec.DeadLetter, pushTimeout(spec, spec.DeadLetter), deadLetterFormatter, []byte(payload)); err != nil {
+		log.Error().Err(err).Str("spec", spec.Name).Str("storage", storage.Name).Msg("Error during dead letter push")
+		return fmt.Errorf("%w (dead letter failed: %s)", pushErr, err.Error())
+	}
+
+	log.Warn().Err(pushErr).Str("spec", spec.Name).Str("storage", storage.Name).Int("attempts", letter.Attempts).Msg("Payload sent to the dead letter storage")
+	return nil
+}
+
+// checkDelivery returns a deliveryError when the results do not satisfy the
+// delivery policy of the spec. The failures are logged even when the policy
+// is satisfied
+func checkDelivery(spec *config.WebhookSpec, results []deliveryResult) error {
+	var failures = make(map[string]error)
+	var failed = make(map[*config.StorageSpec]bool)
+	for _, result := range results {
+		if result.err == nil {
+			continue
+		}
+
+		log.Error().Err(result.err).Str("spec", spec.Name).Str("storage", result.storage.Name).Msg("Error during storage push")
+		failures[result.storage.Name] = result.err
+		failed[result.storage] = true
+	}
+
+	var policy = spec.Delivery.Policy
+	if policy == "" {
+		policy = config.DeliveryPolicyAll
+	}
+
+	var succeeded = len(results) - len(failed)
+	var satisfied bool
+	switch policy {
+	case config.DeliveryPolicyAny:
+		satisfied = len(results) == 0 || succeeded > 0
+	case config.DeliveryPolicyQuorum:
+		satisfied = succeeded*2 > len(results) || len(results) == 0
+	case config.DeliveryPolicyRequired:
+		satisfied = true
+		for _, result := range results {
+			for _, name := range spec.Delivery.Required {
+				if result.storage.Name == name && failed[result.storage] {
+					satisfied = false
+				}
+			}
+		}
+	default:
+		satisfied = len(failed) == 0
+	}
+
+	if satisfied {
+		return nil
+	}
+
+	return &deliveryError{policy: policy, failures: failures}
+}
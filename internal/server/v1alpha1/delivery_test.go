@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/internal/config"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/batch"
+)
+
+// testStorage is a storage waiting for the delay before returning the
+// error, the delay is interrupted by the context
+type testStorage struct {
+	delay  time.Duration
+	err    error
+	pushed *int32
+}
+
+func (s testStorage) Name() string { return "test" }
+func (s testStorage) Push(ctx context.Context, value []byte) error {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if s.err != nil {
+		return s.err
+	}
+
+	formatter, err := formatting.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := formatter.WithTemplate("{{ .Storage.Name }}").Render(); err != nil {
+		return err
+	}
+
+	if s.pushed != nil {
+		atomic.AddInt32(s.pushed, 1)
+	}
+	return nil
+}
+
+func testStorageSpec(name string, client testStorage) *config.StorageSpec {
+	return &config.StorageSpec{
+		Type:       "test",
+		Name:       name,
+		Client:     client,
+		Formatting: &config.FormattingSpec{Template: "{{ .Payload }}"},
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	var pushed int32
+	spec := &config.WebhookSpec{
+		Name: "test",
+		Storage: []*config.StorageSpec{
+			testStorageSpec("slow", testStorage{delay: 100 * time.Millisecond, pushed: &pushed}),
+			testStorageSpec("fast", testStorage{pushed: &pushed}),
+			testStorageSpec("failing", testStorage{err: errors.New("connection refused")}),
+		},
+	}
+	spec.Storage[0].Timeout = 20 * time.Millisecond
+
+	start := time.Now()
+	results := deliver(context.Background(), spec, spec.Storage, formatting.New().WithPayload([]byte("{}")), []byte("{}"))
+	assert.Less(time.Since(start), 100*time.Millisecond)
+	assert.Len(results, 3)
+	assert.ErrorIs(results[0].err, context.DeadlineExceeded)
+	assert.NoError(results[1].err)
+	assert.EqualError(results[2].err, "connection refused")
+	assert.Equal(int32(1), pushed)
+}
+
+// recorderStorage records the pushed values
+type recorderStorage struct {
+	values chan string
+}
+
+func (s recorderStorage) Name() string { return "recorder" }
+func (s recorderStorage) Push(ctx context.Context, value []byte) error {
+	s.values <- string(value)
+	return nil
+}
+
+func TestDeliverDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := recorderStorage{values: make(chan string, 2)}
+	spec := &config.WebhookSpec{
+		Name: "test",
+		Storage: []*config.StorageSpec{
+			testStorageSpec("fast", testStorage{}),
+			testStorageSpec("failing", testStorage{err: errors.New("connection refused")}),
+		},
+		DeadLetter: &config.StorageSpec{
+			Type:       "recorder",
+			Name:       "deadLetter",
+			Client:     recorder,
+			Formatting: &config.FormattingSpec{Template: "{{ .DeadLetter.Storage }}|{{ .DeadLetter.Error }}|{{ .DeadLetter.Attempts }}|{{ .Payload }}"},
+		},
+	}
+	spec.Storage[1].Formatting.Template = `{"wrapped":{{ .Payload }}}`
+
+	results := deliver(context.Background(), spec, spec.Storage, formatting.New().WithPayload([]byte("{}")), []byte("{}"))
+	assert.NoError(results[0].err)
+	assert.NoError(results[1].err)
+	assert.Equal(`failing|connection refused|1|{"wrapped":{}}`, <-recorder.values)
+	assert.Empty(recorder.values)
+
+	// the push error is kept when the dead letter fails
+	spec.DeadLetter.Client = testStorage{err: errors.New("disk full")}
+	results = deliver(context.Background(), spec, spec.Storage, formatting.New().WithPayload([]byte("{}")), []byte("{}"))
+	assert.EqualError(results[1].err, "connection refused (dead letter failed: disk full)")
+}
+
+func TestDeliverBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := recorderStorage{values: make(chan string, 1)}
+	storage := &config.StorageSpec{Type: "recorder", Name: "batched", Formatting: &config.FormattingSpec{Template: "{{ .Payload }}"}}
+	storage.Client = batch.Wrap(recorder, batch.Options{
+		Size:      2,
+		Interval:  time.Hour,
+		Template:  "{{ .Storage.Name }}:{{ len .Events }}",
+		Data:      map[string]interface{}{"Storage": storage},
+		WaitFlush: true,
+	}, "test", "batched")
+	spec := &config.WebhookSpec{Name: "test", Storage: []*config.StorageSpec{storage}}
+
+	// the requests wait for the push of their batch
+	var wg sync.WaitGroup
+	for _, payload := range []string{`{"id":1}`, `{"id":2}`} {
+		wg.Add(1)
+		go func(payload string) {
+			defer wg.Done()
+			results := deliver(context.Background(), spec, spec.Storage, formatting.New().WithPayload([]byte(payload)), []byte(payload))
+			assert.NoError(checkDelivery(spec, results))
+		}(payload)
+	}
+	wg.Wait()
+	assert.Equal("batched:2", <-recorder.values)
+}
+
+func TestCheckDelivery(t *testing.T) {
+	assert := assert.New(t)
+	timeout := context.DeadlineExceeded
+	refused := errors.New("connection refused")
+
+	newResults := func(errs ...error) []deliveryResult {
+		var results []deliveryResult
+		for i, err := range errs {
+			results = append(results, deliveryResult{
+				storage: &config.StorageSpec{Name: []string{"redis", "postgres", "rabbitmq"}[i]},
+				err:     err,
+			})
+		}
+		return results
+	}
+
+	var tests = []struct {
+		delivery config.DeliverySpec
+		results  []deliveryResult
+		wantErr  bool
+	}{
+		{config.DeliverySpec{}, newResults(), false},
+		{config.DeliverySpec{}, newResults(nil, nil), false},
+		{config.DeliverySpec{Policy: "all"}, newResults(nil, refused), true},
+		{config.DeliverySpec{Policy: "any"}, newResults(), false},
+		{config.DeliverySpec{Policy: "any"}, newResults(refused, nil), false},
+		{config.DeliverySpec{Policy: "any"}, newResults(refused, timeout), true},
+		{config.DeliverySpec{Policy: "quorum"}, newResults(nil, nil, refused), false},
+		{config.DeliverySpec{Policy: "quorum"}, newResults(nil, refused), true},
+		{config.DeliverySpec{Policy: "required", Required: []string{"postgres"}}, newResults(refused, nil, refused), false},
+		{config.DeliverySpec{Policy: "required", Required: []string{"postgres"}}, newResults(nil, refused, nil), true},
+	}
+
+	for i, test := range tests {
+		err := checkDelivery(&config.WebhookSpec{Name: "test", Delivery: test.delivery}, test.results)
+		if test.wantErr {
+			assert.Error(err, "test %d", i)
+		} else {
+			assert.NoError(err, "test %d", i)
+		}
+	}
+
+	err := checkDelivery(&config.WebhookSpec{Name: "test"}, newResults(timeout, refused))
+	var deliveryErr *deliveryError
+	assert.ErrorAs(err, &deliveryErr)
+	assert.False(deliveryErr.timedOut())
+	assert.Equal("delivery policy all not satisfied (postgres: connection refused, redis: context deadline exceeded)", err.Error())
+
+	err = checkDelivery(&config.WebhookSpec{Name: "test"}, newResults(timeout))
+	assert.ErrorAs(err, &deliveryErr)
+	assert.True(deliveryErr.timedOut())
+}
+
+func TestServer_WebhookHandlerDelivery(t *testing.T) {
+	newServer := func(storages ...*config.StorageSpec) *Server {
+		return &Server{
+			config: &config.Configuration{
+				APIVersion: "v1alpha1",
+				Specs: []*config.WebhookSpec{{
+					Name:          "test",
+					EntrypointURL: "/test",
+					Storage:       storages,
+					Delivery:      config.DeliverySpec{Policy: "all"},
+				}},
+			},
+			webhookService: webhookService,
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, testServerWebhookHandlerHelper(t, newServer(
+		testStorageSpec("fast", testStorage{}),
+	)).Code)
+
+	assert.Equal(t, http.StatusBadGateway, testServerWebhookHandlerHelper(t, newServer(
+		testStorageSpec("fast", testStorage{}),
+		testStorageSpec("failing", testStorage{err: errors.New("connection refused")}),
+	)).Code)
+
+	slow := testStorageSpec("slow", testStorage{delay: time.Second})
+	slow.Timeout = 10 * time.Millisecond
+	assert.Equal(t, http.StatusGatewayTimeout, testServerWebhookHandlerHelper(t, newServer(slow)).Code)
+}
@@ -1,16 +1,19 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"atomys.codes/webhooked/internal/config"
+	"atomys.codes/webhooked/internal/wal"
 	"atomys.codes/webhooked/pkg/formatting"
 )
 
@@ -24,6 +27,11 @@ type Server struct {
 	webhookService func(s *Server, spec *config.WebhookSpec, r *http.Request) (string, error)
 	// logger is the logger used by the server
 	logger zerolog.Logger
+
+	asyncMu sync.Mutex // protect following fields
+	// queues are the write-ahead logs of the specs with the asynchronous
+	// delivery, by spec name
+	queues map[string]*asyncQueue
 }
 
 // errSecurityFailed is returned when security check failed for a webhook call
@@ -70,10 +78,27 @@ func (s *Server) WebhookHandler() http.HandlerFunc {
 
 		responseBody, err := s.webhookService(s, spec, r)
 		if err != nil {
-			switch err {
-			case errSecurityFailed:
+			var deliveryErr *deliveryError
+			switch {
+			case errors.Is(err, errSecurityFailed):
 				w.WriteHeader(http.StatusForbidden)
 				return
+			case errors.As(err, new(*routingError)):
+				s.logger.Error().Err(err).Str("spec", spec.Name).Msg("Error during webhook routing")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			case errors.Is(err, wal.ErrFull):
+				s.logger.Error().Err(err).Msg("Error during webhook enqueuing")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			case errors.As(err, &deliveryErr):
+				s.logger.Error().Err(err).Msg("Error during webhook delivery")
+				if deliveryErr.timedOut() {
+					w.WriteHeader(http.StatusGatewayTimeout)
+				} else {
+					w.WriteHeader(http.StatusBadGateway)
+				}
+				return
 			default:
 				s.logger.Error().Err(err).Msg("Error during webhook processing")
 				w.WriteHeader(http.StatusInternalServerError)
@@ -126,38 +151,45 @@ func webhookService(s *Server, spec *config.WebhookSpec, r *http.Request) (respo
 		}
 	}
 
-	previousPayload := data
 	payloadFormatter := formatting.New().
 		WithRequest(r).
 		WithPayload(data).
 		WithData("Spec", spec).
 		WithData("Config", config.Current())
 
-	for _, storage := range spec.Storage {
-		storageFormatter := *payloadFormatter.WithData("Storage", storage)
+	if spec.HasIdempotency() {
+		return idempotent(ctx, spec, payloadFormatter, func() (string, error) {
+			return s.process(ctx, spec, r, payloadFormatter, data)
+		})
+	}
 
-		storagePayload, err := storageFormatter.WithTemplate(storage.Formatting.Template).Render()
-		if err != nil {
-			return "", err
-		}
+	return s.process(ctx, spec, r, payloadFormatter, data)
+}
 
-		// update the formatter with the rendered payload of storage formatting
-		// this will allow to chain formatting
-		storageFormatter.WithData("PreviousPayload", previousPayload)
-		ctx = formatting.ToContext(ctx, &storageFormatter)
+// process delivers the payload to the storages selected for the webhook
+// call, or enqueues it with the asynchronous delivery, and renders the
+// response sent to the caller
+func (s *Server) process(ctx context.Context, spec *config.WebhookSpec, r *http.Request, payloadFormatter *formatting.Formatter, data []byte) (string, error) {
+	// the storages are selected again by the async delivery, the routing
+	// errors are reported to the caller before the enqueuing
+	storages, err := route(spec, payloadFormatter)
+	if err != nil {
+		return "", err
+	}
 
-		log.Debug().Msgf("store following data: %s", storagePayload)
-		if err := storage.Client.Push(ctx, []byte(storagePayload)); err != nil {
+	if spec.Async.Enabled {
+		if err := s.enqueue(spec, r, data); err != nil {
 			return "", err
 		}
-		log.Debug().Str("storage", storage.Client.Name()).Msgf("stored successfully")
+	} else if err := checkDelivery(spec, deliver(ctx, spec, storages, payloadFormatter, data)); err != nil {
+		return "", err
 	}
 
 	if spec.Response.Formatting != nil && spec.Response.Formatting.Template != "" {
 		return payloadFormatter.WithTemplate(spec.Response.Formatting.Template).Render()
 	}
 
-	return "", err
+	return "", nil
 }
 
 // runSecurity will run the security pipeline for the current webhook call
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"atomys.codes/webhooked/internal/config"
+	"atomys.codes/webhooked/internal/idempotency"
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+// idempotencyPollInterval is the interval between two checks of a key
+// reserved by a call in progress
+const idempotencyPollInterval = 50 * time.Millisecond
+
+var (
+	// idempotencyReplays is the number of calls answered with the response
+	// of a previous call with the same idempotency key
+	idempotencyReplays = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webhooked",
+		Name:      "idempotency_replays_total",
+		Help:      "Number of webhook calls answered with the response of a previous call with the same idempotency key",
+	}, []string{"spec"})
+)
+
+// idempotent runs the processing of the call once per idempotency key. The
+// next calls with the key receive the response of the processed call, a
+// failed processing releases the key for the retries of the caller
+func idempotent(ctx context.Context, spec *config.WebhookSpec, payloadFormatter *formatting.Formatter, process func() (string, error)) (string, error) {
+	key, err := payloadFormatter.Clone().WithTemplate(spec.Idempotency.Key).Render()
+	if err != nil {
+		return "", fmt.Errorf("idempotency key cannot be rendered: %w", err)
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		log.Debug().Str("spec", spec.Name).Msg("empty idempotency key, the call is not deduplicated")
+		return process()
+	}
+	key = spec.Name + ":" + key
+
+	state, value, err := acquireIdempotencyKey(ctx, spec.Idempotency, key)
+	if err != nil {
+		return "", err
+	}
+
+	if state == idempotency.Completed {
+		log.Info().Str("spec", spec.Name).Str("key", key).Msg("call already processed, previous response replayed")
+		idempotencyReplays.WithLabelValues(spec.Name).Inc()
+		return value, nil
+	}
+
+	// the key is released or completed even when the caller is gone
+	response, err := process()
+	if err != nil {
+		if releaseErr := spec.Idempotency.Client.Release(context.Background(), key, value); releaseErr != nil {
+			log.Error().Err(releaseErr).Str("spec", spec.Name).Str("key", key).Msg("idempotency key cannot be released")
+		}
+		return "", err
+	}
+
+	if err := spec.Idempotency.Client.Complete(context.Background(), key, response, spec.Idempotency.TTL); err != nil {
+		log.Error().Err(err).Str("spec", spec.Name).Str("key", key).Msg("idempotency key cannot be completed, the retries will be processed")
+	}
+	return response, nil
+}
+
+// acquireIdempotencyKey reserves the key, waiting while it is reserved by a
+// call in progress. The reservation of a call taking longer than the lock
+// timeout expires and the key is reserved for the waiting call. It returns
+// the token of the reservation when the key is acquired, or the response of
+// the key when it is already processed
+func acquireIdempotencyKey(ctx context.Context, settings *config.IdempotencySpec, key string) (idempotency.State, string, error) {
+	ticker := time.NewTicker(idempotencyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		state, value, err := settings.Client.Acquire(ctx, key, settings.LockTimeout)
+		if err != nil || state != idempotency.InFlight {
+			return state, value, err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return 0, "", ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/internal/config"
+	"atomys.codes/webhooked/internal/idempotency"
+)
+
+func newIdempotentServer(lockTimeout time.Duration, storages ...*config.StorageSpec) *Server {
+	return &Server{
+		config: &config.Configuration{
+			APIVersion: "v1alpha1",
+			Specs: []*config.WebhookSpec{{
+				Name:          "test",
+				EntrypointURL: "/test",
+				Storage:       storages,
+				Delivery:      config.DeliverySpec{Policy: "all"},
+				Response:      config.ResponseSpec{Formatting: &config.FormattingSpec{Template: "{{ .Payload }}"}},
+				Idempotency: &config.IdempotencySpec{
+					Key:         `{{ .Request.Header | getHeader "X-Delivery" }}`,
+					TTL:         time.Hour,
+					LockTimeout: lockTimeout,
+					Client:      idempotency.NewMemoryStore(),
+				},
+			}},
+		},
+		webhookService: webhookService,
+		logger:         log.Logger,
+	}
+}
+
+func postIdempotentWebhook(server *Server, delivery, payload string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/v1alpha1/test", strings.NewReader(payload))
+	req.Header.Set("X-Delivery", delivery)
+	rr := httptest.NewRecorder()
+	server.WebhookHandler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestServer_WebhookHandlerIdempotency(t *testing.T) {
+	assert := assert.New(t)
+
+	var pushed int32
+	server := newIdempotentServer(time.Minute, testStorageSpec("storage", testStorage{pushed: &pushed}))
+
+	rr := postIdempotentWebhook(server, "1", `{"first":true}`)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(`{"first":true}`, rr.Body.String())
+
+	// the retry receives the original response without being pushed
+	rr = postIdempotentWebhook(server, "1", `{"retry":true}`)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(`{"first":true}`, rr.Body.String())
+	assert.Equal(int32(1), atomic.LoadInt32(&pushed))
+
+	assert.Equal(http.StatusOK, postIdempotentWebhook(server, "2", "{}").Code)
+	assert.Equal(int32(2), atomic.LoadInt32(&pushed))
+
+	// the calls without key are not deduplicated
+	assert.Equal(http.StatusOK, postIdempotentWebhook(server, "", "{}").Code)
+	assert.Equal(http.StatusOK, postIdempotentWebhook(server, "", "{}").Code)
+	assert.Equal(int32(4), atomic.LoadInt32(&pushed))
+}
+
+func TestServer_WebhookHandlerIdempotencyFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	failing := testStorageSpec("storage", testStorage{err: errors.New("connection refused")})
+	server := newIdempotentServer(time.Minute, failing)
+	assert.Equal(http.StatusBadGateway, postIdempotentWebhook(server, "1", "{}").Code)
+
+	// the key is released, the retry is processed
+	var pushed int32
+	server.config.Specs[0].Storage[0] = testStorageSpec("storage", testStorage{pushed: &pushed})
+	assert.Equal(http.StatusOK, postIdempotentWebhook(server, "1", "{}").Code)
+	assert.Equal(int32(1), atomic.LoadInt32(&pushed))
+}
+
+func TestServer_WebhookHandlerIdempotencyInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	var pushed int32
+	server := newIdempotentServer(time.Minute, testStorageSpec("slow", testStorage{delay: 100 * time.Millisecond, pushed: &pushed}))
+
+	var wg sync.WaitGroup
+	var responses = make([]*httptest.ResponseRecorder, 3)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = postIdempotentWebhook(server, "1", "{}")
+		}(i)
+	}
+	wg.Wait()
+
+	for _, rr := range responses {
+		assert.Equal(http.StatusOK, rr.Code)
+		assert.Equal("{}", rr.Body.String())
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&pushed))
+
+	// the reservation of a call longer than the lock timeout expires
+	pushed = 0
+	server = newIdempotentServer(20*time.Millisecond, testStorageSpec("slow", testStorage{delay: 100 * time.Millisecond, pushed: &pushed}))
+	go postIdempotentWebhook(server, "1", "{}")
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(http.StatusOK, postIdempotentWebhook(server, "1", "{}").Code)
+	assert.Equal(int32(2), atomic.LoadInt32(&pushed))
+}
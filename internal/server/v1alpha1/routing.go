@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"atomys.codes/webhooked/internal/config"
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+// routingError is returned when the condition of a route or a storage
+// cannot be evaluated for the request
+type routingError struct {
+	// target is the route or the storage of the condition
+	target string
+	err    error
+}
+
+// Error returns the target of the condition with the evaluation error
+func (e *routingError) Error() string {
+	return fmt.Sprintf("condition of %s cannot be evaluated: %s", e.target, e.err.Error())
+}
+
+// Unwrap returns the evaluation error
+func (e *routingError) Unwrap() error {
+	return e.err
+}
+
+// route returns the storages selected for the request. The first matching
+// route of the spec selects the candidate storages, all the storages are
+// candidates when the spec has no routes. Then the candidates with a false
+// condition are removed
+func route(spec *config.WebhookSpec, payloadFormatter *formatting.Formatter) ([]*config.StorageSpec, error) {
+	var candidates = spec.Storage
+	if spec.HasRoutes() {
+		candidates = nil
+		for _, r := range spec.Routes {
+			matched, err := evaluate(payloadFormatter, r.When)
+			if err != nil {
+				return nil, &routingError{target: "route " + r.Name, err: err}
+			}
+
+			if matched {
+				log.Debug().Str("spec", spec.Name).Str("route", r.Name).Msg("route matched")
+				candidates = storagesByName(spec, r.Storage)
+				break
+			}
+		}
+	}
+
+	var selected []*config.StorageSpec
+	for _, storage := range candidates {
+		matched, err := evaluate(payloadFormatter, storage.When)
+		if err != nil {
+			return nil, &routingError{target: "storage " + storage.Name, err: err}
+		}
+
+		if matched {
+			selected = append(selected, storage)
+		}
+	}
+
+	if len(selected) == 0 {
+		log.Debug().Str("spec", spec.Name).Msg("no storage selected for the request")
+	}
+	return selected, nil
+}
+
+// evaluate renders the condition and returns its boolean value, an empty
+// condition is true
+func evaluate(payloadFormatter *formatting.Formatter, when string) (bool, error) {
+	if when == "" {
+		return true, nil
+	}
+
+	result, err := payloadFormatter.Clone().WithTemplate(when).Render()
+	if err != nil {
+		return false, err
+	}
+
+	value, err := strconv.ParseBool(strings.TrimSpace(result))
+	if err != nil {
+		return false, fmt.Errorf("the condition must render true or false, got %q", result)
+	}
+	return value, nil
+}
+
+// storagesByName returns the storages of the spec with the given names, in
+// the order of the spec
+func storagesByName(spec *config.WebhookSpec, names []string) []*config.StorageSpec {
+	var storages []*config.StorageSpec
+	for _, storage := range spec.Storage {
+		for _, name := range names {
+			if storage.Name == name {
+				storages = append(storages, storage)
+				break
+			}
+		}
+	}
+	return storages
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/internal/config"
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+func routingFormatter(event string) *formatting.Formatter {
+	req, _ := http.NewRequest("POST", "/v1alpha1/test", nil)
+	req.Header.Set("X-GitHub-Event", event)
+	return formatting.New().WithRequest(req).WithPayload([]byte(`{"action":"opened"}`))
+}
+
+func storageNames(storages []*config.StorageSpec) []string {
+	var names []string
+	for _, storage := range storages {
+		names = append(names, storage.Name)
+	}
+	return names
+}
+
+func TestRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &config.WebhookSpec{
+		Name: "test",
+		Storage: []*config.StorageSpec{
+			{Name: "push", When: `{{ eq (.Request.Header | getHeader "X-GitHub-Event") "push" }}`},
+			{Name: "pull", When: `{{ eq (.Request.Header | getHeader "X-GitHub-Event") "pull_request" }}`},
+			{Name: "audit"},
+		},
+	}
+
+	storages, err := route(spec, routingFormatter("push"))
+	assert.NoError(err)
+	assert.Equal([]string{"push", "audit"}, storageNames(storages))
+
+	storages, err = route(spec, routingFormatter("pull_request"))
+	assert.NoError(err)
+	assert.Equal([]string{"pull", "audit"}, storageNames(storages))
+
+	// the first matching route selects the candidates
+	spec.Routes = []*config.RouteSpec{
+		{Name: "pull", When: `{{ eq (.Request.Header | getHeader "X-GitHub-Event") "pull_request" }}`, Storage: []string{"audit", "pull"}},
+		{Name: "all", Storage: []string{"push", "pull"}},
+	}
+	storages, err = route(spec, routingFormatter("pull_request"))
+	assert.NoError(err)
+	assert.Equal([]string{"pull", "audit"}, storageNames(storages))
+
+	storages, err = route(spec, routingFormatter("push"))
+	assert.NoError(err)
+	assert.Equal([]string{"push"}, storageNames(storages))
+
+	storages, err = route(spec, routingFormatter("issues"))
+	assert.NoError(err)
+	assert.Empty(storages)
+
+	// no storage is selected when no route matches
+	spec.Routes = spec.Routes[:1]
+	storages, err = route(spec, routingFormatter("push"))
+	assert.NoError(err)
+	assert.Empty(storages)
+
+	spec.Routes[0].When = "{{ .Unknown.Field }}"
+	_, err = route(spec, routingFormatter("push"))
+	assert.ErrorAs(err, new(*routingError))
+	assert.ErrorContains(err, "condition of route pull cannot be evaluated")
+}
+
+func TestEvaluate(t *testing.T) {
+	assert := assert.New(t)
+
+	for when, expected := range map[string]bool{
+		"":              true,
+		"{{ true }}":    true,
+		" {{ false }} ": false,
+		`{{ eq .Payload "{\"action\":\"opened\"}" }}`: true,
+	} {
+		matched, err := evaluate(routingFormatter("push"), when)
+		assert.NoError(err, when)
+		assert.Equal(expected, matched, when)
+	}
+
+	_, err := evaluate(routingFormatter("push"), "{{ .Payload }}")
+	assert.EqualError(err, `the condition must render true or false, got "{\"action\":\"opened\"}"`)
+
+	_, err = evaluate(routingFormatter("push"), "{{ .Unknown.Field }}")
+	assert.Error(err)
+}
+
+func TestServer_WebhookHandlerRouting(t *testing.T) {
+	var pushed int32
+	newServer := func(when string) *Server {
+		storage := testStorageSpec("routed", testStorage{pushed: &pushed})
+		storage.When = when
+		return &Server{
+			config: &config.Configuration{
+				APIVersion: "v1alpha1",
+				Specs: []*config.WebhookSpec{{
+					Name:          "test",
+					EntrypointURL: "/test",
+					Storage:       []*config.StorageSpec{storage},
+					Delivery:      config.DeliverySpec{Policy: "all"},
+				}},
+			},
+			webhookService: webhookService,
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, testServerWebhookHandlerHelper(t, newServer("{{ false }}")).Code)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&pushed))
+
+	assert.Equal(t, http.StatusOK, testServerWebhookHandlerHelper(t, newServer("{{ true }}")).Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pushed))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, testServerWebhookHandlerHelper(t, newServer("{{ .Payload }}")).Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pushed))
+}
@@ -0,0 +1,109 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"atomys.codes/webhooked/internal/valuable"
+)
+
+// Config is the struct contains the TLS configuration shared by storages
+// that need to open a secured connection. Each certificate field can
+// contain the PEM encoded content directly or a path to a PEM file
+type Config struct {
+	// Enabled forces the usage of TLS even if no certificate is defined
+	// (the system root CAs are used in this case)
+	Enabled bool `mapstructure:"enabled" json:"enabled"`
+	// CA is the certificate authority used to verify the server certificate
+	CA valuable.Valuable `mapstructure:"ca" json:"-"`
+	// Cert is the client certificate used for mutual TLS authentication
+	Cert valuable.Valuable `mapstructure:"cert" json:"-"`
+	// Key is the private key of the client certificate
+	Key valuable.Valuable `mapstructure:"key" json:"-"`
+	// ServerName overrides the name used to verify the server certificate
+	ServerName string `mapstructure:"serverName" json:"serverName"`
+	// InsecureSkipVerify disables the verification of the server certificate
+	// ! Do not use it in production
+	InsecureSkipVerify bool `mapstructure:"insecureSkipVerify" json:"insecureSkipVerify"`
+}
+
+// pemHeader is the prefix of every PEM encoded block, used to distinguish
+// a PEM content from a file path
+const pemHeader = "-----BEGIN"
+
+// IsEnabled returns true if the TLS configuration must be used, either
+// because it is explicitly enabled or because a certificate is defined
+func (c *Config) IsEnabled() bool {
+	return c != nil && (c.Enabled || c.CA.First() != "" || c.Cert.First() != "" || c.Key.First() != "")
+}
+
+// Load builds the *tls.Config described by the configuration. When the TLS
+// is not enabled, a nil config is returned without error
+func (c *Config) Load() (*tls.Config, error) {
+	if !c.IsEnabled() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify, // #nosec G402 -- explicitly requested by the user
+	}
+
+	if c.CA.First() != "" {
+		ca, err := readPEM(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the CA certificate: %s", err.Error())
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("the CA certificate does not contain any valid certificate")
+		}
+	}
+
+	if c.Cert.First() != "" || c.Key.First() != "" {
+		if c.Cert.First() == "" || c.Key.First() == "" {
+			return nil, errors.New("both cert and key must be defined to use a client certificate")
+		}
+
+		cert, err := readPEM(c.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the client certificate: %s", err.Error())
+		}
+
+		key, err := readPEM(c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the client key: %s", err.Error())
+		}
+
+		keyPair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+
+	return tlsConfig, nil
+}
+
+// IsPEM returns true if the value is a PEM content and not a path to a
+// PEM file
+func IsPEM(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), pemHeader)
+}
+
+// readPEM returns the PEM content of the given valuable. When the value
+// is not a PEM content, it is used as a path to the file to read
+func readPEM(v valuable.Valuable) ([]byte, error) {
+	value := v.First()
+	if IsPEM(value) {
+		return []byte(value), nil
+	}
+
+	return os.ReadFile(value)
+}
@@ -8,7 +8,7 @@ import (
 
 // Decode decodes the given data into the given result.
 // In case of the target Type if a Valuable, we serialize it with
-// `SerializeValuable` func.
+// `SerializeValuable` func. Durations can be given as string (eg: "5s")
 // @param input is the data to decode
 // @param output is the result of the decoding
 // @return an error if the decoding failed
@@ -16,8 +16,11 @@ func Decode(input, output interface{}) (err error) {
 	var decoder *mapstructure.Decoder
 
 	decoder, err = mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		Result:     output,
-		DecodeHook: valuableDecodeHook,
+		Result: output,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			valuableDecodeHook,
+		),
 	})
 	if err != nil {
 		return err
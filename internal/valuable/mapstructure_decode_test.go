@@ -3,6 +3,7 @@ package valuable
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -106,6 +107,19 @@ func (suite *TestSuiteValuableDecode) TestDecodeValuableStaticValuesWithComma()
 	assert.Equal(strings.Split(suite.testValueCommaSeparated, ","), output.Value.Get())
 }
 
+func (suite *TestSuiteValuableDecode) TestDecodeDuration() {
+	assert := assert.New(suite.T())
+
+	type strukt struct {
+		Timeout time.Duration `mapstructure:"timeout"`
+	}
+
+	output := strukt{}
+	err := Decode(map[string]interface{}{"timeout": "5s"}, &output)
+	assert.NoError(err)
+	assert.Equal(5*time.Second, output.Timeout)
+}
+
 func TestRunSuiteValuableDecode(t *testing.T) {
 	suite.Run(t, new(TestSuiteValuableDecode))
 }
@@ -0,0 +1,505 @@
+// Package wal implements a durable write-ahead log of entries stored on the
+// local disk. The entries are appended to segment files and synced before
+// Append returns, then consumed with Next and removed with Ack. The
+// entries not acknowledged are replayed when the log is opened again, so a
+// consumed entry is delivered at least once.
+//
+// Each record of a segment is made of a header (payload length, CRC32 of
+// the record, kind and entry id) followed by the payload. The acks are
+// records too, the segments are deleted from the oldest one as soon as all
+// their entries are acknowledged.
+package wal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// Options is the configuration of the log
+type Options struct {
+	// SegmentSize is the size of a segment file triggering the creation of
+	// the next segment (default: 64MiB)
+	SegmentSize int64
+	// MaxPending is the maximum number of entries not acknowledged, Append
+	// returns ErrFull when it is reached (default: 10000)
+	MaxPending int
+}
+
+// Entry is an entry of the log
+type Entry struct {
+	// ID is the identifier of the entry, increasing in the append order
+	ID uint64
+	// Data is the payload of the entry
+	Data []byte
+}
+
+// Log is a write-ahead log stored in a directory. A directory must be
+// opened by one Log at a time
+type Log struct {
+	dir     string
+	options Options
+
+	mu sync.Mutex // protect following fields
+	// active is the segment receiving the new records
+	active *os.File
+	// activeSize is the size of the active segment
+	activeSize int64
+	// segments are the segments on disk, the active one is the last
+	segments []*segment
+	// pending are the segments of the entries not acknowledged
+	pending map[uint64]*segment
+	// queue are the entries waiting to be consumed
+	queue []*Entry
+	// nextID is the identifier of the next appended entry
+	nextID uint64
+	// ready is signaled when an entry is queued
+	ready chan struct{}
+	// done is closed when the log is closed
+	done chan struct{}
+}
+
+// segment is a file of the log
+type segment struct {
+	id   uint64
+	path string
+	// live is the number of entries of the segment not acknowledged
+	live int
+}
+
+// record kinds
+const (
+	kindAppend byte = 1
+	kindAck    byte = 2
+)
+
+// headerSize is the size of the record header: payload length (4), CRC32
+// (4), kind (1) and entry id (8)
+const headerSize = 17
+
+// maxRecordSize is the maximum size of a record payload, a greater size
+// comes from a corrupted header
+const maxRecordSize = 1 << 30
+
+// segmentExt is the extension of the segment files
+const segmentExt = ".wal"
+
+var (
+	// ErrFull is returned by Append when the maximum number of pending
+	// entries is reached
+	ErrFull = errors.New("write-ahead log is full")
+	// ErrClosed is returned when the log is closed
+	ErrClosed = errors.New("write-ahead log is closed")
+	// errCorrupted is returned when a record cannot be read
+	errCorrupted = errors.New("corrupted record")
+
+	// corruptedSegmentsTotal is the number of segments with a corrupted
+	// record found on replay, the records after it are lost
+	corruptedSegmentsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webhooked",
+		Name:      "wal_corrupted_segments_total",
+		Help:      "Number of write-ahead log segments with a corrupted record, the records after it are lost",
+	}, []string{"directory"})
+)
+
+// Open opens the log stored in the directory, the directory is created when
+// it does not exist. The entries not acknowledged are queued to be
+// consumed again, in their append order
+func Open(dir string, options Options) (*Log, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = 64 << 20
+	}
+
+	if options.MaxPending <= 0 {
+		options.MaxPending = 10000
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:     dir,
+		options: options,
+		pending: make(map[uint64]*segment),
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		nextID:  1,
+	}
+
+	if err := l.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := l.rotate(); err != nil {
+		return nil, err
+	}
+
+	if len(l.queue) > 0 {
+		log.Info().Str("directory", dir).Msgf("%d entries replayed from the write-ahead log", len(l.queue))
+		l.signal()
+	}
+
+	return l, nil
+}
+
+// replay reads the segments of the directory and queues the entries not
+// acknowledged. A truncated record at the end of the last segment comes
+// from an interrupted write, the segment is truncated after the last valid
+// record. A corrupted record in another segment loses the records after
+// it, it is logged as an error and counted
+func (l *Log) replay() error {
+	files, err := filepath.Glob(filepath.Join(l.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{id: id, path: path})
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].id < l.segments[j].id })
+
+	var entries = make(map[uint64]*Entry)
+	for i, s := range l.segments {
+		valid, err := l.replaySegment(s, entries)
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, errCorrupted) {
+			return err
+		}
+
+		if i < len(l.segments)-1 {
+			log.Error().Str("segment", s.path).Msgf("corrupted record in write-ahead log segment after %d bytes, the next records of the segment are lost", valid)
+			corruptedSegmentsTotal.WithLabelValues(l.dir).Inc()
+			continue
+		}
+
+		log.Warn().Str("segment", s.path).Msgf("write-ahead log segment truncated after %d bytes", valid)
+		if err := os.Truncate(s.path, valid); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		l.queue = append(l.queue, entry)
+	}
+	sort.Slice(l.queue, func(i, j int) bool { return l.queue[i].ID < l.queue[j].ID })
+
+	return l.compact()
+}
+
+// replaySegment reads the records of the segment, it returns the offset
+// after the last valid record
+func (l *Log) replaySegment(s *segment, entries map[uint64]*Entry) (int64, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var reader = bufio.NewReader(file)
+	var offset int64
+	for {
+		kind, id, data, err := readRecord(reader)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(headerSize + len(data))
+
+		if id >= l.nextID {
+			l.nextID = id + 1
+		}
+
+		switch kind {
+		case kindAppend:
+			entries[id] = &Entry{ID: id, Data: data}
+			l.pending[id] = s
+			s.live++
+		case kindAck:
+			if pending, ok := l.pending[id]; ok {
+				delete(entries, id)
+				delete(l.pending, id)
+				pending.live--
+			}
+		}
+	}
+}
+
+// readRecord reads the next record, it returns io.EOF at the end of the
+// segment and errCorrupted when the record is incomplete or invalid
+func readRecord(reader io.Reader) (kind byte, id uint64, data []byte, err error) {
+	var header [headerSize]byte
+	if _, err = io.ReadFull(reader, header[:]); err == io.EOF {
+		return 0, 0, nil, io.EOF
+	} else if err != nil {
+		return 0, 0, nil, errCorrupted
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return 0, 0, nil, errCorrupted
+	}
+
+	data = make([]byte, length)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return 0, 0, nil, errCorrupted
+	}
+
+	checksum := crc32.ChecksumIEEE(header[8:])
+	checksum = crc32.Update(checksum, crc32.IEEETable, data)
+	if checksum != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, 0, nil, errCorrupted
+	}
+
+	return header[8], binary.BigEndian.Uint64(header[9:]), data, nil
+}
+
+// Append writes the entry on the disk and queues it to be consumed. The
+// entry is synced on the disk when Append returns. The id of a failed
+// entry is not reused, the entry written but not synced may be replayed
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return 0, ErrClosed
+	}
+
+	if len(l.pending) >= l.options.MaxPending {
+		return 0, ErrFull
+	}
+
+	// the id is not reused once the record may be on the disk
+	id := l.nextID
+	l.nextID++
+	if err := l.write(kindAppend, id, data); err != nil {
+		return 0, err
+	}
+	if err := l.active.Sync(); err != nil {
+		return 0, err
+	}
+
+	s := l.segments[len(l.segments)-1]
+	s.live++
+	l.pending[id] = s
+	l.queue = append(l.queue, &Entry{ID: id, Data: data})
+	l.signal()
+
+	return id, nil
+}
+
+// Next returns the next entry to consume, waiting for an entry to be
+// appended. The entry must be acknowledged with Ack once processed, or
+// queued again with Requeue
+func (l *Log) Next(ctx context.Context) (*Entry, error) {
+	for {
+		l.mu.Lock()
+		if l.active == nil {
+			l.mu.Unlock()
+			return nil, ErrClosed
+		}
+
+		if len(l.queue) > 0 {
+			entry := l.queue[0]
+			l.queue = l.queue[1:]
+			if len(l.queue) > 0 {
+				l.signal()
+			}
+			l.mu.Unlock()
+			return entry, nil
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-l.ready:
+		case <-l.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Requeue queues the consumed entry again
+func (l *Log) Requeue(entry *Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.pending[entry.ID]; !ok {
+		return
+	}
+
+	l.queue = append(l.queue, entry)
+	l.signal()
+}
+
+// Ack acknowledges the entry, it is not replayed anymore. The segments
+// containing only acknowledged entries are deleted
+func (l *Log) Ack(id uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return ErrClosed
+	}
+
+	s, ok := l.pending[id]
+	if !ok {
+		return nil
+	}
+
+	if err := l.write(kindAck, id, nil); err != nil {
+		return err
+	}
+
+	delete(l.pending, id)
+	s.live--
+	return l.compact()
+}
+
+// Len returns the number of entries not acknowledged
+func (l *Log) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.pending)
+}
+
+// Close syncs and closes the active segment. The entries not acknowledged
+// are kept on the disk
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return nil
+	}
+	close(l.done)
+
+	err := l.closeActive()
+	l.active = nil
+	if cerr := l.compact(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write appends the record to the active segment and creates the next
+// segment when the active one is full. A partially written record is
+// truncated, the next records are not written after an invalid one. The
+// caller must hold the mutex
+func (l *Log) write(kind byte, id uint64, data []byte) error {
+	if l.activeSize >= l.options.SegmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	var record = make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	record[8] = kind
+	binary.BigEndian.PutUint64(record[9:17], id)
+	copy(record[headerSize:], data)
+
+	checksum := crc32.ChecksumIEEE(record[8:])
+	binary.BigEndian.PutUint32(record[4:8], checksum)
+
+	n, err := l.active.Write(record)
+	if err != nil {
+		if n > 0 {
+			if terr := l.active.Truncate(l.activeSize); terr != nil {
+				l.activeSize += int64(n)
+			}
+		}
+		return fmt.Errorf("cannot write the write-ahead log: %w", err)
+	}
+	l.activeSize += int64(n)
+	return nil
+}
+
+// rotate closes the active segment and creates the next one. The caller
+// must hold the mutex
+func (l *Log) rotate() error {
+	if err := l.closeActive(); err != nil {
+		return err
+	}
+
+	var id uint64 = 1
+	if len(l.segments) > 0 {
+		id = l.segments[len(l.segments)-1].id + 1
+	}
+
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	l.active, l.activeSize = file, 0
+	l.segments = append(l.segments, &segment{id: id, path: path})
+	return l.compact()
+}
+
+// closeActive syncs and closes the active segment. The caller must hold
+// the mutex
+func (l *Log) closeActive() error {
+	if l.active == nil {
+		return nil
+	}
+
+	if err := l.active.Sync(); err != nil {
+		l.active.Close()
+		return err
+	}
+	return l.active.Close()
+}
+
+// compact deletes the oldest segments without pending entries. A segment is
+// deleted only when the previous ones are deleted, so an ack record is
+// never deleted before the entry it acknowledges. The caller must hold the
+// mutex
+func (l *Log) compact() error {
+	for len(l.segments) > 0 {
+		s := l.segments[0]
+		if s.live > 0 || (l.active != nil && len(l.segments) == 1) {
+			return nil
+		}
+
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// signal wakes up a consumer waiting for an entry. The caller must hold
+// the mutex
+func (l *Log) signal() {
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
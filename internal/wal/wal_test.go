@@ -0,0 +1,241 @@
+package wal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	require.NoError(t, err)
+	return files
+}
+
+func TestLog(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{})
+	require.NoError(t, err)
+
+	for _, data := range []string{"first", "second", "third"} {
+		_, err := l.Append([]byte(data))
+		assert.NoError(err)
+	}
+	assert.Equal(3, l.Len())
+
+	entry, err := l.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(uint64(1), entry.ID)
+	assert.Equal("first", string(entry.Data))
+	assert.NoError(l.Ack(entry.ID))
+
+	entry, err = l.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal("second", string(entry.Data))
+	l.Requeue(entry)
+
+	entry, err = l.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal("third", string(entry.Data))
+	assert.NoError(l.Close())
+
+	_, err = l.Append([]byte("closed"))
+	assert.ErrorIs(err, ErrClosed)
+	_, err = l.Next(context.Background())
+	assert.ErrorIs(err, ErrClosed)
+
+	// the entries not acknowledged are replayed in order
+	l, err = Open(dir, Options{})
+	require.NoError(t, err)
+	assert.Equal(2, l.Len())
+
+	entry, err = l.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(uint64(2), entry.ID)
+	assert.NoError(l.Ack(entry.ID))
+
+	entry, err = l.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(uint64(3), entry.ID)
+	assert.NoError(l.Ack(entry.ID))
+
+	id, err := l.Append([]byte("fourth"))
+	assert.NoError(err)
+	assert.Equal(uint64(4), id)
+	assert.NoError(l.Ack(id))
+	assert.NoError(l.Close())
+	assert.Empty(segmentFiles(t, dir))
+}
+
+func TestLog_Next(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := Open(t.TempDir(), Options{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.Next(ctx)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = l.Append([]byte("late"))
+	}()
+	entry, err := l.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal("late", string(entry.Data))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Close()
+	}()
+	_, err = l.Next(context.Background())
+	assert.ErrorIs(err, ErrClosed)
+}
+
+func TestLog_Full(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := Open(t.TempDir(), Options{MaxPending: 1})
+	require.NoError(t, err)
+	defer l.Close()
+
+	id, err := l.Append([]byte("first"))
+	assert.NoError(err)
+	_, err = l.Append([]byte("second"))
+	assert.ErrorIs(err, ErrFull)
+
+	assert.NoError(l.Ack(id))
+	_, err = l.Append([]byte("second"))
+	assert.NoError(err)
+}
+
+func TestLog_Segments(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{SegmentSize: 1})
+	require.NoError(t, err)
+
+	var ids []uint64
+	for _, data := range []string{"first", "second", "third"} {
+		id, err := l.Append([]byte(data))
+		assert.NoError(err)
+		ids = append(ids, id)
+	}
+	assert.Len(segmentFiles(t, dir), 3)
+
+	// the second segment is kept until the first one is deleted
+	assert.NoError(l.Ack(ids[1]))
+	assert.Len(segmentFiles(t, dir), 4)
+	assert.NoError(l.Ack(ids[0]))
+	assert.Len(segmentFiles(t, dir), 3)
+	assert.NoError(l.Close())
+
+	l, err = Open(dir, Options{SegmentSize: 1})
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(1, l.Len())
+
+	entry, err := l.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal("third", string(entry.Data))
+}
+
+func TestLog_TruncatedRecord(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{})
+	require.NoError(t, err)
+	_, err = l.Append([]byte("complete"))
+	assert.NoError(err)
+	_, err = l.Append([]byte("interrupted"))
+	assert.NoError(err)
+	assert.NoError(l.Close())
+
+	files := segmentFiles(t, dir)
+	require.Len(t, files, 1)
+	info, err := os.Stat(files[0])
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(files[0], info.Size()-3))
+
+	l, err = Open(dir, Options{})
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(1, l.Len())
+
+	entry, err := l.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal("complete", string(entry.Data))
+
+	id, err := l.Append([]byte("next"))
+	assert.NoError(err)
+	assert.Equal(uint64(2), id)
+}
+
+func TestLog_CorruptedSegment(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{SegmentSize: 1})
+	require.NoError(t, err)
+	for _, data := range []string{"first", "second", "third"} {
+		_, err := l.Append([]byte(data))
+		assert.NoError(err)
+	}
+	assert.NoError(l.Close())
+
+	// the corrupted record of a segment other than the last one is lost
+	// and counted, the next segments are replayed
+	files := segmentFiles(t, dir)
+	require.Len(t, files, 3)
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	content[len(content)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(files[0], content, 0640))
+
+	l, err = Open(dir, Options{SegmentSize: 1})
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(2, l.Len())
+	assert.Equal(1.0, testutil.ToFloat64(corruptedSegmentsTotal.WithLabelValues(dir)))
+
+	entry, err := l.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal("second", string(entry.Data))
+}
+
+func TestLog_FailedAppend(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	id, err := l.Append([]byte("first"))
+	assert.NoError(err)
+	assert.Equal(uint64(1), id)
+
+	// the id of the failed append is not reused
+	path := l.active.Name()
+	require.NoError(t, l.active.Close())
+	_, err = l.Append([]byte("failed"))
+	assert.Error(err)
+
+	l.active, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0640)
+	require.NoError(t, err)
+	id, err = l.Append([]byte("next"))
+	assert.NoError(err)
+	assert.Equal(uint64(3), id)
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"text/template"
 )
@@ -50,6 +51,23 @@ func New() *Formatter {
 	}
 }
 
+// Clone returns a copy of the Formatter with its own data map. The copy can
+// be modified and rendered concurrently with the original
+func (d *Formatter) Clone() *Formatter {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var data = make(map[string]interface{}, len(d.data))
+	for name, value := range d.data {
+		data[name] = value
+	}
+
+	return &Formatter{
+		tmplString: d.tmplString,
+		data:       data,
+	}
+}
+
 // WithTemplate sets the template string. The template string is the string that
 // will be used to render the template.
 func (d *Formatter) WithTemplate(tmplString string) *Formatter {
@@ -111,6 +129,16 @@ func (d *Formatter) Render() (string, error) {
 	return buf.String(), nil
 }
 
+// Validate returns an error when the template string cannot be parsed. It
+// allows to report the template errors when the configuration is loaded
+// instead of the first rendering
+func Validate(tmplString string) error {
+	if _, err := template.New("formattingTmpl").Funcs(funcMap()).Parse(tmplString); err != nil {
+		return fmt.Errorf("error in your template: %s", err.Error())
+	}
+	return nil
+}
+
 // FromContext returns the Formatter instance stored in the context. It returns
 // an error if the Formatter instance is not found in the context.
 func FromContext(ctx context.Context) (*Formatter, error) {
@@ -126,3 +154,19 @@ func FromContext(ctx context.Context) (*Formatter, error) {
 func ToContext(ctx context.Context, d *Formatter) context.Context {
 	return context.WithValue(ctx, formatterCtxKey, d)
 }
+
+// RenderFromContext renders the given template with the Formatter instance
+// stored in the context and the given payload. Templates without action are
+// returned as is and do not require a Formatter instance in the context.
+func RenderFromContext(ctx context.Context, tmplString string, payload []byte) (string, error) {
+	if !strings.Contains(tmplString, "{{") {
+		return tmplString, nil
+	}
+
+	formatter, err := FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return formatter.WithPayload(payload).WithTemplate(tmplString).Render()
+}
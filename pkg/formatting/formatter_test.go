@@ -39,6 +39,19 @@ func Test_WithData(t *testing.T) {
 	assert.Equal(true, tmpl.data["test"])
 }
 
+func Test_Clone(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpl := New().WithTemplate("{{ .test }}").WithData("test", true)
+	clone := tmpl.Clone().WithData("test", false).WithData("other", true)
+
+	assert.Equal("{{ .test }}", clone.tmplString)
+	assert.Equal(true, tmpl.data["test"])
+	assert.Equal(1, len(tmpl.data))
+	assert.Equal(false, clone.data["test"])
+	assert.Equal(2, len(clone.data))
+}
+
 func Test_WithRequest(t *testing.T) {
 	assert := assert.New(t)
 
@@ -152,6 +165,14 @@ func Test_Render(t *testing.T) {
 	assert.Equal("", str)
 }
 
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(Validate(`{{ eq (.Request.Header | getHeader "X-Event") "push" }}`))
+	assert.ErrorContains(Validate("{{ .Payload }"), "error in your template: ")
+	assert.Error(Validate("{{ unknownFunction .Payload }}"))
+}
+
 func TestFromContext(t *testing.T) {
 	// Test case 1: context value is not a *Formatter
 	ctx1 := context.Background()
@@ -177,3 +198,19 @@ func TestToContext(t *testing.T) {
 	ctx2 = ToContext(ctx2, formatter)
 	assert.Equal(t, formatter, ctx2.Value(formatterCtxKey))
 }
+
+func TestRenderFromContext(t *testing.T) {
+	assert := assert.New(t)
+
+	result, err := RenderFromContext(context.Background(), "static", []byte("Hello"))
+	assert.NoError(err)
+	assert.Equal("static", result)
+
+	_, err = RenderFromContext(context.Background(), "{{ .Payload }}", []byte("Hello"))
+	assert.ErrorIs(err, ErrNotFoundInContext)
+
+	ctx := ToContext(context.Background(), New())
+	result, err = RenderFromContext(ctx, "key:{{ .Payload }}", []byte("Hello"))
+	assert.NoError(err)
+	assert.Equal("key:Hello", result)
+}
@@ -33,6 +33,7 @@ func funcMap() template.FuncMap {
 		"getHeader": getHeader,
 
 		// Time manipulation functions
+		"now":        time.Now,
 		"formatTime": formatTime,
 		"parseTime":  parseTime,
 
@@ -20,6 +20,7 @@ func Test_funcMap(t *testing.T) {
 	assert.Contains(funcMap, "toPrettyJson")
 	assert.Contains(funcMap, "ternary")
 	assert.Contains(funcMap, "getHeader")
+	assert.Contains(funcMap, "now")
 }
 
 func Test_dft(t *testing.T) {
@@ -182,6 +183,9 @@ func Test_formatTime(t *testing.T) {
 	teaTime = parseTime("2023-01-01T08:42:00Z", time.RFC3339)
 	assert.Equal("Sun Jan  1 08:42:00 UTC 2023", formatTime(teaTime.Unix(), "", time.UnixDate))
 
+	// from now
+	assert.Equal(time.Now().Format("2006.01"), formatTime(time.Now(), "", "2006.01"))
+
 	assert.Equal("", formatTime("INVALID_TIME", "", ""))
 	assert.Equal("", formatTime(nil, "", ""))
 }
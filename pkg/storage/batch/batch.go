@@ -0,0 +1,338 @@
+// Package batch wraps the storages with a batching layer, accumulating the
+// formatted payloads and pushing them at once, rendered with a batch
+// template. Like the retry package, it does not depend on the storage
+// package and forwards the optional interfaces of the wrapped storage
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+)
+
+// Options is the configuration of the batching of a storage
+type Options struct {
+	// Size is the maximum number of payloads of a batch, the batch is
+	// pushed as soon as it is reached
+	Size int
+	// Interval is the maximum duration a payload waits in the batch, the
+	// batch is pushed when it is elapsed since its first payload
+	Interval time.Duration
+	// Timeout is the maximum duration of the push of a batch (default: no
+	// timeout)
+	Timeout time.Duration
+	// Template renders the pushed batch with the payloads in `.Events`.
+	// The other data of the template are those of the formatter of the
+	// first payload of the batch, see Push
+	Template string
+	// Data are the additional data of the formatter of the batch
+	Data map[string]interface{}
+	// WaitFlush makes Push wait for the push of the batch of the payload
+	// and return its error. Otherwise Push returns once the payload is added
+	// to the batch and the errors of the batch are only logged
+	WaitFlush bool
+}
+
+// Pusher is the storage wrapped by the batching layer, it has the same
+// methods than storage.Pusher
+type Pusher interface {
+	Name() string
+	Push(ctx context.Context, value []byte) error
+}
+
+// pusher is the storage wrapped with the batching layer. The optional
+// interfaces of the storage are forwarded
+type pusher struct {
+	Pusher
+	options Options
+	// spec and name identify the storage in the metrics and the logs
+	spec, name string
+	// flushes are the pushes of batches in progress
+	flushes sync.WaitGroup
+
+	mu sync.Mutex // protect following fields
+	// pending are the payloads of the current batch
+	pending []*item
+	// generation identifies the current batch, the timer of a batch
+	// already pushed is ignored
+	generation uint64
+	// timer pushes the current batch when the interval is elapsed
+	timer *time.Timer
+	// closed is true once the storage is closed
+	closed bool
+}
+
+// item is a payload of a batch with the channel receiving the result of
+// the push of its batch
+type item struct {
+	value []byte
+	// formatter is the formatter of the context of the push, nil when the
+	// context has none
+	formatter *formatting.Formatter
+	done      chan error
+}
+
+var (
+	// ErrClosed is returned by Push when the storage is closed
+	ErrClosed = errors.New("batch is closed")
+
+	// flushesTotal is the number of pushed batches of each storage
+	flushesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webhooked",
+		Name:      "storage_batch_flushes_total",
+		Help:      "Number of batches pushed to the storage",
+	}, []string{"spec", "storage", "result"})
+
+	// batchSize is the number of payloads of the pushed batches
+	batchSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "webhooked",
+		Name:      "storage_batch_size",
+		Help:      "Number of payloads of the batches pushed to the storage",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"spec", "storage"})
+)
+
+// Wrap returns the storage wrapped with the batching layer
+// @param spec and name identify the storage in the metrics and the logs
+func Wrap(p Pusher, options Options, spec, name string) Pusher {
+	return &pusher{
+		Pusher:  p,
+		options: options,
+		spec:    spec,
+		name:    name,
+	}
+}
+
+// Push adds the value to the current batch. The batch is pushed when it is
+// full or when the interval is elapsed. With WaitFlush, it waits for the
+// push of the batch until the context is done, the value is then removed
+// from the batch. A value already taken by a push in progress cannot be
+// removed, the result of its push is awaited to not report a failure for a
+// delivered value.
+// The formatter of the context is kept with the value, the batch is
+// rendered with the data of the first payload (eg: `.Request`, `.Spec`,
+// `.Config`) completed by `.Events` and the data of the options
+func (p *pusher) Push(ctx context.Context, value []byte) error {
+	it := &item{value: value, done: make(chan error, 1)}
+	if formatter, err := formatting.FromContext(ctx); err == nil {
+		it.formatter = formatter.Clone()
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+
+	p.pending = append(p.pending, it)
+	if len(p.pending) == 1 {
+		generation := p.generation
+		p.timer = time.AfterFunc(p.options.Interval, func() { p.flushGeneration(generation) })
+	}
+
+	var full []*item
+	if len(p.pending) >= p.options.Size {
+		full = p.take()
+	}
+	p.mu.Unlock()
+
+	if full != nil {
+		go p.flush(full)
+	}
+
+	if !p.options.WaitFlush {
+		return nil
+	}
+
+	select {
+	case err := <-it.done:
+		return err
+	case <-ctx.Done():
+	}
+
+	if p.remove(it) {
+		return ctx.Err()
+	}
+	return <-it.done
+}
+
+// remove removes the item from the current batch, it returns false when the
+// item is not in the current batch anymore
+func (p *pusher) remove(it *item) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, pending := range p.pending {
+		if pending != it {
+			continue
+		}
+
+		// the timer of an empty batch is not kept for the next batch
+		if p.pending = append(p.pending[:i:i], p.pending[i+1:]...); len(p.pending) == 0 {
+			p.timer.Stop()
+			p.timer = nil
+			p.generation++
+		}
+		return true
+	}
+	return false
+}
+
+// Close pushes the current batch, waits for the pushes in progress until
+// the context is done and closes the wrapped storage. The wrapped storage
+// is closed even when the pushes in progress are not done
+func (p *pusher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	last := p.take()
+	p.mu.Unlock()
+
+	if last != nil {
+		p.flush(last)
+	}
+
+	var done = make(chan struct{})
+	go func() {
+		p.flushes.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("pushes of batches in progress not done: %w", ctx.Err())
+	}
+
+	if closer, ok := p.Pusher.(interface{ Close(context.Context) error }); ok {
+		if closeErr := closer.Close(ctx); closeErr != nil {
+			if err != nil {
+				return fmt.Errorf("%s, close: %w", err.Error(), closeErr)
+			}
+			return closeErr
+		}
+	}
+	return err
+}
+
+// Ping checks the health of the wrapped storage
+func (p *pusher) Ping(ctx context.Context) error {
+	if checker, ok := p.Pusher.(interface{ Ping(context.Context) error }); ok {
+		return checker.Ping(ctx)
+	}
+	return nil
+}
+
+// Capabilities returns the capabilities of the wrapped storage with the
+// batch capability
+func (p *pusher) Capabilities() []capability.Capability {
+	var capabilities []capability.Capability
+	if reporter, ok := p.Pusher.(interface {
+		Capabilities() []capability.Capability
+	}); ok {
+		capabilities = reporter.Capabilities()
+	}
+
+	for _, c := range capabilities {
+		if c == capability.Batch {
+			return capabilities
+		}
+	}
+	return append(capabilities, capability.Batch)
+}
+
+// take returns the current batch and starts a new one. The caller must
+// hold the mutex and push the returned batch
+func (p *pusher) take() []*item {
+	if len(p.pending) == 0 {
+		return nil
+	}
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	batch := p.pending
+	p.pending = nil
+	p.generation++
+	p.flushes.Add(1)
+	return batch
+}
+
+// flushGeneration pushes the current batch when it is still the batch of
+// the generation
+func (p *pusher) flushGeneration(generation uint64) {
+	p.mu.Lock()
+	var batch []*item
+	if p.generation == generation {
+		batch = p.take()
+	}
+	p.mu.Unlock()
+
+	if batch != nil {
+		p.flush(batch)
+	}
+}
+
+// flush renders the batch and pushes it to the wrapped storage, the result
+// is sent to each payload of the batch
+func (p *pusher) flush(batch []*item) {
+	defer p.flushes.Done()
+
+	err := p.push(batch)
+	for _, it := range batch {
+		it.done <- err
+	}
+
+	batchSize.WithLabelValues(p.spec, p.name).Observe(float64(len(batch)))
+	if err != nil {
+		flushesTotal.WithLabelValues(p.spec, p.name, "failure").Inc()
+		log.Error().Err(err).Str("spec", p.spec).Str("storage", p.name).Msgf("Error during the push of a batch of %d payloads", len(batch))
+		return
+	}
+
+	flushesTotal.WithLabelValues(p.spec, p.name, "success").Inc()
+	log.Debug().Str("spec", p.spec).Str("storage", p.name).Msgf("batch of %d payloads stored successfully", len(batch))
+}
+
+// push renders the batch and pushes it within the timeout. The push is not
+// bound to the context of the requests of the batch
+func (p *pusher) push(batch []*item) error {
+	var events = make([]string, len(batch))
+	for i, it := range batch {
+		events[i] = string(it.value)
+	}
+
+	batchFormatter := formatting.New()
+	if batch[0].formatter != nil {
+		batchFormatter = batch[0].formatter.Clone()
+	}
+	batchFormatter.WithData("Events", events)
+	for name, data := range p.options.Data {
+		batchFormatter.WithData(name, data)
+	}
+
+	value, err := batchFormatter.Clone().WithTemplate(p.options.Template).Render()
+	if err != nil {
+		return err
+	}
+
+	ctx := formatting.ToContext(context.Background(), batchFormatter.WithPayload([]byte(value)))
+	if p.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.Timeout)
+		defer cancel()
+	}
+
+	return p.Pusher.Push(ctx, []byte(value))
+}
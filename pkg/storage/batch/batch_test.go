@@ -0,0 +1,200 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+)
+
+// recorderPusher records the pushed values and the name of the storage
+// rendered from the formatter of the context
+type recorderPusher struct {
+	err error
+	// block delays the pushes until it is closed when defined
+	block chan struct{}
+
+	mu     sync.Mutex
+	values []string
+	closed bool
+}
+
+func (r *recorderPusher) Name() string { return "recorder" }
+func (r *recorderPusher) Push(ctx context.Context, value []byte) error {
+	if r.block != nil {
+		<-r.block
+	}
+
+	name, err := formatting.RenderFromContext(ctx, "{{ .Storage }}:{{ len .Events }}", value)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values = append(r.values, name+"|"+string(value))
+	return r.err
+}
+func (r *recorderPusher) Close(ctx context.Context) error {
+	r.closed = true
+	return nil
+}
+func (r *recorderPusher) Capabilities() []capability.Capability {
+	return []capability.Capability{capability.Ordering}
+}
+
+func (r *recorderPusher) pushed() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.values...)
+}
+
+func newOptions(size int, interval time.Duration, waitFlush bool) Options {
+	return Options{
+		Size:      size,
+		Interval:  interval,
+		Template:  `[{{ range $i, $e := .Events }}{{ if $i }},{{ end }}{{ $e }}{{ end }}]`,
+		Data:      map[string]interface{}{"Storage": "recorder"},
+		WaitFlush: waitFlush,
+	}
+}
+
+func TestPusher_Size(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &recorderPusher{}
+	p := Wrap(recorder, newOptions(3, time.Hour, false), "spec", "storage")
+
+	for _, value := range []string{"1", "2", "3", "4"} {
+		assert.NoError(p.Push(context.Background(), []byte(value)))
+	}
+	assert.Eventually(func() bool { return len(recorder.pushed()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal([]string{"recorder:3|[1,2,3]"}, recorder.pushed())
+
+	// the last batch is pushed on close
+	assert.NoError(p.(*pusher).Close(context.Background()))
+	assert.Equal([]string{"recorder:3|[1,2,3]", "recorder:1|[4]"}, recorder.pushed())
+	assert.True(recorder.closed)
+	assert.ErrorIs(p.Push(context.Background(), []byte("5")), ErrClosed)
+}
+
+func TestPusher_Interval(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &recorderPusher{}
+	p := Wrap(recorder, newOptions(100, 20*time.Millisecond, true), "spec", "storage")
+
+	var wg sync.WaitGroup
+	for _, value := range []string{`{"a":1}`, `{"b":2}`} {
+		wg.Add(1)
+		go func(value string) {
+			defer wg.Done()
+			assert.NoError(p.Push(context.Background(), []byte(value)))
+		}(value)
+	}
+	wg.Wait()
+
+	pushed := recorder.pushed()
+	assert.Len(pushed, 1)
+	assert.Contains([]string{`recorder:2|[{"a":1},{"b":2}]`, `recorder:2|[{"b":2},{"a":1}]`}, pushed[0])
+
+	// the value of a canceled push is removed from the batch, it is not
+	// delivered after the failure reported to the caller
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(p.Push(ctx, []byte("late")), context.DeadlineExceeded)
+	assert.NoError(p.(*pusher).Close(context.Background()))
+	assert.Len(recorder.pushed(), 1)
+}
+
+func TestPusher_CanceledDuringPush(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &recorderPusher{block: make(chan struct{})}
+	p := Wrap(recorder, newOptions(1, time.Hour, true), "spec", "storage")
+
+	// the value taken by a push in progress is delivered, its result is
+	// returned instead of the cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		close(recorder.block)
+	}()
+	assert.NoError(p.Push(ctx, []byte("1")))
+	assert.Equal([]string{"recorder:1|[1]"}, recorder.pushed())
+}
+
+func TestPusher_Error(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &recorderPusher{err: errors.New("connection refused")}
+	p := Wrap(recorder, newOptions(1, time.Hour, true), "spec", "storage")
+	assert.EqualError(p.Push(context.Background(), []byte("1")), "connection refused")
+
+	// the errors are only logged without waiting for the flush
+	p = Wrap(recorder, newOptions(1, time.Hour, false), "spec", "storage")
+	assert.NoError(p.Push(context.Background(), []byte("1")))
+
+	options := newOptions(1, time.Hour, true)
+	options.Template = "{{ .Unknown.Field }}"
+	p = Wrap(&recorderPusher{}, options, "spec", "storage")
+	assert.Error(p.Push(context.Background(), []byte("1")))
+}
+
+func TestPusher_Formatter(t *testing.T) {
+	assert := assert.New(t)
+
+	options := newOptions(2, time.Hour, true)
+	options.Template = `{{ .Spec }}:{{ .Storage }}:{{ len .Events }}`
+	recorder := &recorderPusher{}
+	p := Wrap(recorder, options, "spec", "storage")
+
+	// the batch is rendered with the formatter of the first payload
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx := formatting.ToContext(context.Background(), formatting.New().WithData("Spec", "first"))
+		assert.NoError(p.Push(ctx, []byte("1")))
+	}()
+	assert.Eventually(func() bool {
+		p.(*pusher).mu.Lock()
+		defer p.(*pusher).mu.Unlock()
+		return len(p.(*pusher).pending) == 1
+	}, time.Second, time.Millisecond)
+
+	ctx := formatting.ToContext(context.Background(), formatting.New().WithData("Spec", "second"))
+	assert.NoError(p.Push(ctx, []byte("2")))
+	wg.Wait()
+	assert.Equal([]string{"recorder:2|first:recorder:2"}, recorder.pushed())
+}
+
+func TestPusher_CloseTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &recorderPusher{block: make(chan struct{})}
+	defer close(recorder.block)
+	p := Wrap(recorder, newOptions(1, time.Hour, false), "spec", "storage").(*pusher)
+	assert.NoError(p.Push(context.Background(), []byte("1")))
+
+	// the wrapped storage is closed even when the pushes are not done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(p.Close(ctx), context.DeadlineExceeded)
+	assert.True(recorder.closed)
+}
+
+func TestPusher_Capabilities(t *testing.T) {
+	assert := assert.New(t)
+
+	p := Wrap(&recorderPusher{}, newOptions(1, time.Hour, true), "spec", "storage").(*pusher)
+	assert.Equal([]capability.Capability{capability.Ordering, capability.Batch}, p.Capabilities())
+	assert.NoError(p.Ping(context.Background()))
+}
@@ -0,0 +1,22 @@
+// Package capability defines the capabilities declared by the storages.
+// The package is kept apart from the storage package to be imported by the
+// storages without import cycle
+package capability
+
+// Capability is a feature declared by a storage, used by the server to
+// adapt its behavior to the storage
+type Capability string
+
+const (
+	// Batch is declared by the storages buffering the data to insert them
+	// in batch
+	Batch Capability = "batch"
+	// Transaction is declared by the storages inserting the data in
+	// transactions
+	Transaction Capability = "transaction"
+	// Ordering is declared by the storages keeping the order of the data
+	Ordering Capability = "ordering"
+	// Deduplication is declared by the storages ignoring the data already
+	// received
+	Deduplication Capability = "deduplication"
+)
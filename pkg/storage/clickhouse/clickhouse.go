@@ -0,0 +1,442 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/rs/zerolog/log"
+
+	"atomys.codes/webhooked/internal/tlsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// storage is the struct contains client and config
+// Run is made from external caller at begins programs
+type storage struct {
+	client driver.Conn
+	config *config
+	// columns is the sorted list of the inserted columns
+	columns []string
+	// types contains the scan type of each column, in the same order
+	types []reflect.Type
+	// query is the insert query used to prepare each batch
+	query string
+
+	mu sync.Mutex // protect following fields
+	// rows contains the rows waiting for the next flush
+	rows []*row
+	// closed is true once the storage is closed, the rows pushed after
+	// would never be flushed
+	closed bool
+
+	// full is notified when the batch size is reached
+	full chan struct{}
+	// done is closed when the storage is closed
+	done chan struct{}
+	// stopped is closed when the flush loop is stopped
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// config is the struct contains config for connect client
+// Run is made from internal caller
+type config struct {
+	// DatabaseURL is the DSN of the database. The protocol is chosen from the
+	// scheme: clickhouse://host:9000/db for the native protocol or
+	// http(s)://host:8123/db for the HTTP protocol
+	DatabaseURL valuable.Valuable `mapstructure:"databaseUrl" json:"databaseUrl"`
+	// Table is the table where the rows are inserted
+	Table string `mapstructure:"table" json:"table"`
+	// Columns are the inserted columns with the template of their value
+	// using the formatting feature (see pkg/formatting). Each value is
+	// converted to the type of its column
+	Columns map[string]string `mapstructure:"columns" json:"columns"`
+	// Timeout is the maximum duration of each insert (default: 10s)
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout"`
+	// Batch is the configuration of the in-memory batch
+	Batch batchConfig `mapstructure:"batch" json:"batch"`
+	// TLS is the TLS configuration used to connect to the database
+	TLS tlsconfig.Config `mapstructure:"tls" json:"-"`
+}
+
+// row is a buffered row with the number of flushes that rejected it
+type row struct {
+	values   []interface{}
+	attempts int
+}
+
+// batchConfig is the struct contains the configuration of the batch
+type batchConfig struct {
+	// Size is the number of rows that triggers the flush of the batch
+	// (default: 1000)
+	Size int `mapstructure:"size" json:"size"`
+	// FlushInterval is the maximum duration between two flushes
+	// (default: 1s)
+	FlushInterval time.Duration `mapstructure:"flushInterval" json:"flushInterval"`
+	// MaxBufferSize is the maximum number of rows kept in memory, including
+	// the rows of the failed flushes. The push fails when the buffer is
+	// full (default: 10 times the batch size)
+	MaxBufferSize int `mapstructure:"maxBufferSize" json:"maxBufferSize"`
+	// MaxAttempts is the maximum number of flushes rejecting a row while
+	// the database is reachable, the row is then dropped and logged
+	// (default: 5)
+	MaxAttempts int `mapstructure:"maxAttempts" json:"maxAttempts"`
+}
+
+// errBufferFull is returned when the buffer cannot receive more rows
+// because the database is not reachable
+var errBufferFull = errors.New("clickhouse buffer is full, the rows cannot be flushed")
+
+// errBatchClosed is returned when a row is pushed after the close of the
+// storage
+var errBatchClosed = errors.New("clickhouse batch is closed")
+
+// NewStorage is the function for create new ClickHouse client storage
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return ClickHouseStorage the struct contains client connected and config
+// @return an error if the the client is not initialized successfully
+func NewStorage(configRaw map[string]interface{}) (*storage, error) {
+	newClient := storage{
+		config:  &config{},
+		full:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	if err := valuable.Decode(configRaw, &newClient.config); err != nil {
+		return nil, err
+	}
+
+	if err := newClient.config.validate(); err != nil {
+		return nil, err
+	}
+
+	options, err := clickhouse.ParseDSN(newClient.config.DatabaseURL.First())
+	if err != nil {
+		return nil, err
+	}
+
+	if options.TLS, err = newClient.config.TLS.Load(); err != nil {
+		return nil, err
+	}
+
+	if newClient.client, err = clickhouse.Open(options); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), newClient.config.Timeout)
+	defer cancel()
+
+	if err := newClient.client.Ping(ctx); err != nil {
+		newClient.client.Close()
+		return nil, err
+	}
+
+	for name := range newClient.config.Columns {
+		newClient.columns = append(newClient.columns, name)
+	}
+	sort.Strings(newClient.columns)
+
+	if newClient.types, err = newClient.columnTypes(ctx); err != nil {
+		newClient.client.Close()
+		return nil, err
+	}
+
+	newClient.query = fmt.Sprintf("INSERT INTO %s (%s)", newClient.config.Table, strings.Join(newClient.columns, ", "))
+
+	go newClient.run()
+	return &newClient, nil
+}
+
+// validate checks the required fields and sets the default values
+func (c *config) validate() error {
+	if c.Table == "" {
+		return fmt.Errorf("the table is required")
+	}
+
+	if len(c.Columns) == 0 {
+		return fmt.Errorf("at least one column is required")
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+
+	if c.Batch.Size <= 0 {
+		c.Batch.Size = 1000
+	}
+
+	if c.Batch.FlushInterval == 0 {
+		c.Batch.FlushInterval = time.Second
+	}
+
+	if c.Batch.MaxBufferSize < c.Batch.Size {
+		c.Batch.MaxBufferSize = 10 * c.Batch.Size
+	}
+
+	if c.Batch.MaxAttempts <= 0 {
+		c.Batch.MaxAttempts = 5
+	}
+
+	return nil
+}
+
+// columnTypes returns the scan type of each column, read from the table
+func (c *storage) columnTypes(ctx context.Context) ([]reflect.Type, error) {
+	rows, err := c.client.Query(ctx, fmt.Sprintf("SELECT %s FROM %s LIMIT 0", strings.Join(c.columns, ", "), c.config.Table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var types []reflect.Type
+	for _, column := range rows.ColumnTypes() {
+		types = append(types, column.ScanType())
+	}
+	return types, rows.Err()
+}
+
+// Name is the function for identified if the storage config is define in the webhooks
+// Run is made from external caller
+func (c *storage) Name() string {
+	return "clickhouse"
+}
+
+// Push is the function for push data in the storage
+// The row is rendered and added to the in-memory batch, it is inserted
+// with the next flush of the batch. The push succeeds once the row is
+// buffered, before its insert: the rows are lost when the instance stops
+// without closing the storage, and the rows rejected by the database are
+// dropped after the max attempts without failing the webhook call. The
+// push fails once the storage is closed
+// A run is made from external caller
+// @param value that will be pushed
+// @return an error if the push failed
+func (c *storage) Push(ctx context.Context, value []byte) error {
+	formatter, err := formatting.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	var values = make([]interface{}, len(c.columns))
+	for i, name := range c.columns {
+		rendered, err := formatter.
+			WithPayload(value).
+			WithTemplate(c.config.Columns[name]).
+			WithData("FieldName", name).
+			Render()
+		if err != nil {
+			return retry.Permanent(err)
+		}
+
+		if values[i], err = convert(rendered, c.types[i]); err != nil {
+			return retry.Permanent(fmt.Errorf("invalid value for column %s: %s", name, err.Error()))
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errBatchClosed
+	}
+
+	if len(c.rows) >= c.config.Batch.MaxBufferSize {
+		return errBufferFull
+	}
+
+	if c.rows = append(c.rows, &row{values: values}); len(c.rows) >= c.config.Batch.Size {
+		select {
+		case c.full <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Ping checks that the database is reachable
+func (c *storage) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx)
+}
+
+// Capabilities returns the capabilities of the storage
+func (c *storage) Capabilities() []capability.Capability {
+	return []capability.Capability{capability.Batch}
+}
+
+// Close stops the flush loop, flushes the remaining rows and closes the
+// connection to the database
+func (c *storage) Close(ctx context.Context) error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+
+		close(c.done)
+		<-c.stopped
+
+		if err = c.flush(ctx); err != nil {
+			c.client.Close()
+			return
+		}
+		err = c.client.Close()
+	})
+	return err
+}
+
+// run flushes the batch when the batch size is reached or when the flush
+// interval is elapsed, until the storage is closed
+func (c *storage) run() {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(c.config.Batch.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		case <-c.full:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.config.Timeout)
+		if err := c.flush(ctx); err != nil {
+			log.Error().Err(err).Msg("cannot flush the clickhouse batch, retrying on next flush")
+		}
+		cancel()
+	}
+}
+
+// flush inserts the buffered rows. When the database is not reachable,
+// the rows are kept in the buffer for the next flush. When the database
+// rejects the batch, it is split to insert the valid rows and the rejected
+// rows are kept until their max attempts, then dropped
+func (c *storage) flush(ctx context.Context) error {
+	c.mu.Lock()
+	rows := c.rows
+	c.rows = nil
+	c.mu.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	err := c.insert(ctx, rows)
+	if err == nil {
+		return nil
+	}
+
+	var rejected = rows
+	if pingErr := c.client.Ping(ctx); pingErr == nil {
+		rejected = c.split(ctx, rows)
+		for _, r := range rejected {
+			r.attempts++
+		}
+	}
+
+	var kept = make([]*row, 0, len(rejected))
+	for _, r := range rejected {
+		if r.attempts >= c.config.Batch.MaxAttempts {
+			log.Error().Err(err).Interface("row", r.values).Msgf("clickhouse row rejected %d times, row dropped", r.attempts)
+			continue
+		}
+		kept = append(kept, r)
+	}
+
+	c.mu.Lock()
+	c.rows = append(kept, c.rows...)
+	c.mu.Unlock()
+	return err
+}
+
+// split inserts the halves of the rejected rows separately, recursively,
+// and returns the rows rejected alone. The rows not inserted before the
+// context is done are returned as rejected
+func (c *storage) split(ctx context.Context, rows []*row) []*row {
+	if len(rows) <= 1 || ctx.Err() != nil {
+		return rows
+	}
+
+	var rejected []*row
+	for _, half := range [][]*row{rows[:len(rows)/2], rows[len(rows)/2:]} {
+		if err := c.insert(ctx, half); err != nil {
+			rejected = append(rejected, c.split(ctx, half)...)
+		}
+	}
+	return rejected
+}
+
+// insert sends the rows in a single batch
+func (c *storage) insert(ctx context.Context, rows []*row) error {
+	batch, err := c.client.PrepareBatch(ctx, c.query)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		if err := batch.Append(r.values...); err != nil {
+			_ = batch.Abort()
+			return err
+		}
+	}
+
+	return batch.Send()
+}
+
+// convert converts the rendered value to the scan type of its column.
+// Numeric and boolean columns are parsed, other columns accept the string
+// as is. An empty value is inserted as NULL in a nullable column
+func convert(value string, typ reflect.Type) (interface{}, error) {
+	if typ == nil {
+		return value, nil
+	}
+
+	if typ.Kind() == reflect.Ptr {
+		if value == "" {
+			return nil, nil
+		}
+		typ = typ.Elem()
+	}
+
+	trimmed := strings.TrimSpace(value)
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(trimmed, 10, typ.Bits())
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(n).Convert(typ).Interface(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(trimmed, 10, typ.Bits())
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(n).Convert(typ).Interface(), nil
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(trimmed, typ.Bits())
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(n).Convert(typ).Interface(), nil
+	case reflect.Bool:
+		return strconv.ParseBool(trimmed)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,372 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+type ClickHouseSetupTestSuite struct {
+	suite.Suite
+	client      driver.Conn
+	databaseUrl string
+	ctx         context.Context
+}
+
+// Create Table for running test
+func (suite *ClickHouseSetupTestSuite) BeforeTest(suiteName, testName string) {
+	var err error
+
+	suite.databaseUrl = fmt.Sprintf(
+		"clickhouse://%s:%s@%s:%s/%s",
+		os.Getenv("CLICKHOUSE_USER"),
+		os.Getenv("CLICKHOUSE_PASSWORD"),
+		os.Getenv("CLICKHOUSE_HOST"),
+		os.Getenv("CLICKHOUSE_PORT"),
+		os.Getenv("CLICKHOUSE_DB"),
+	)
+
+	options, err := clickhouse.ParseDSN(suite.databaseUrl)
+	if err != nil {
+		suite.T().Error(err)
+	}
+
+	if suite.client, err = clickhouse.Open(options); err != nil {
+		suite.T().Error(err)
+	}
+
+	err = suite.client.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS test (spec String, size UInt64, note Nullable(String), payload String) ENGINE = Memory")
+	if err != nil {
+		suite.T().Error(err)
+	}
+
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().WithData("Spec", map[string]string{"Name": "test"}),
+	)
+}
+
+// Delete Table after test
+func (suite *ClickHouseSetupTestSuite) AfterTest(suiteName, testName string) {
+	if err := suite.client.Exec(context.Background(), "DROP TABLE test"); err != nil {
+		suite.T().Error(err)
+	}
+	suite.client.Close()
+}
+
+func (suite *ClickHouseSetupTestSuite) TestClickHouseNewStorage() {
+	_, err := NewStorage(map[string]interface{}{
+		"databaseUrl": []int{1},
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+		"table":       "unknown",
+		"columns":     map[string]string{"payload": "{{ .Payload }}"},
+	})
+	assert.Error(suite.T(), err)
+
+	newClient, err := NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+		"table":       "test",
+		"columns":     map[string]string{"payload": "{{ .Payload }}"},
+	})
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), newClient.Close(context.Background()))
+}
+
+func (suite *ClickHouseSetupTestSuite) TestClickHousePush() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+		"table":       "test",
+		"columns": map[string]string{
+			"spec":    "{{ .Spec.Name }}",
+			"size":    "{{ len .Payload }}",
+			"note":    "",
+			"payload": "{{ .Payload }}",
+		},
+		"batch": map[string]interface{}{
+			"size":          2,
+			"flushInterval": "1h",
+		},
+	})
+	assert.NoError(suite.T(), err)
+
+	err = newClient.Push(context.Background(), []byte("Hello"))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("World!")))
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Flushed on close")))
+
+	assert.Eventually(suite.T(), func() bool {
+		return suite.count() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(suite.T(), newClient.Close(context.Background()))
+	assert.Equal(suite.T(), uint64(3), suite.count())
+
+	var size uint64
+	var note *string
+	row := suite.client.QueryRow(context.Background(), "SELECT size, note FROM test WHERE payload = 'World!'")
+	assert.NoError(suite.T(), row.Scan(&size, &note))
+	assert.Equal(suite.T(), uint64(6), size)
+	assert.Nil(suite.T(), note)
+}
+
+// count returns the number of rows of the test table
+func (suite *ClickHouseSetupTestSuite) count() uint64 {
+	var count uint64
+	if err := suite.client.QueryRow(context.Background(), "SELECT count() FROM test").Scan(&count); err != nil {
+		suite.T().Error(err)
+	}
+	return count
+}
+
+func TestRunClickHousePush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("clickhouse testing is skiped in short version of test")
+		return
+	}
+
+	suite.Run(t, new(ClickHouseSetupTestSuite))
+}
+
+// fakeConn is a connection recording the inserted rows, the methods not
+// used by the storage are not implemented
+type fakeConn struct {
+	driver.Conn
+
+	mu     sync.Mutex
+	fail   bool
+	closed bool
+	rows   [][]interface{}
+}
+
+type fakeBatch struct {
+	driver.Batch
+	conn *fakeConn
+	rows [][]interface{}
+}
+
+func (c *fakeConn) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	return &fakeBatch{conn: c}, nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.fail {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) inserted() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.rows)
+}
+
+func (b *fakeBatch) Append(v ...interface{}) error {
+	b.rows = append(b.rows, v)
+	return nil
+}
+
+func (b *fakeBatch) Abort() error {
+	return nil
+}
+
+func (b *fakeBatch) Send() error {
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+
+	if b.conn.fail {
+		return errors.New("connection refused")
+	}
+
+	// the poison rows are rejected with their batch
+	for _, row := range b.rows {
+		if row[0] == "poison" {
+			return errors.New("cannot parse the row")
+		}
+	}
+	b.conn.rows = append(b.conn.rows, b.rows...)
+	return nil
+}
+
+// newTestStorage returns a storage using the fake connection
+func newTestStorage(conn *fakeConn, batch batchConfig) *storage {
+	c := &storage{
+		client:  conn,
+		config:  &config{Table: "test", Columns: map[string]string{"payload": "{{ .Payload }}"}, Batch: batch},
+		columns: []string{"payload"},
+		types:   []reflect.Type{reflect.TypeOf("")},
+		full:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	_ = c.config.validate()
+
+	go c.run()
+	return c
+}
+
+func TestPushBatch(t *testing.T) {
+	assert := assert.New(t)
+	ctx := formatting.ToContext(context.Background(), formatting.New())
+
+	conn := &fakeConn{fail: true}
+	c := newTestStorage(conn, batchConfig{Size: 2, FlushInterval: time.Hour, MaxBufferSize: 3})
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(c.Push(ctx, []byte("Hello")))
+	}
+
+	// the failed flushes keep the rows in the buffer until it is full
+	assert.Eventually(func() bool {
+		return errors.Is(c.Push(ctx, []byte("Hello")), errBufferFull)
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(0, conn.inserted())
+
+	// the rows that cannot be rendered are not retried
+	c.config.Columns["payload"] = "{{ .Unknown.Field }}"
+	err := c.Push(ctx, []byte("Hello"))
+	assert.Error(err)
+	assert.False(retry.IsRetryable(err))
+	c.config.Columns["payload"] = "{{ .Payload }}"
+
+	conn.mu.Lock()
+	conn.fail = false
+	conn.mu.Unlock()
+
+	assert.NoError(c.Close(context.Background()))
+	assert.Equal(3, conn.inserted())
+	assert.True(conn.closed)
+	assert.NoError(c.Close(context.Background()))
+
+	// the rows pushed after the close are refused, they would never be
+	// flushed
+	assert.ErrorIs(c.Push(ctx, []byte("Hello")), errBatchClosed)
+	assert.Equal(3, conn.inserted())
+}
+
+func TestPushPoisonRow(t *testing.T) {
+	assert := assert.New(t)
+	ctx := formatting.ToContext(context.Background(), formatting.New())
+
+	conn := &fakeConn{}
+	c := newTestStorage(conn, batchConfig{Size: 100, FlushInterval: time.Hour, MaxAttempts: 2})
+
+	for _, value := range []string{"1", "2", "poison", "3"} {
+		assert.NoError(c.Push(ctx, []byte(value)))
+	}
+
+	// the batch is split to insert the valid rows, the poison row is kept
+	// for the next flush
+	assert.Error(c.flush(context.Background()))
+	assert.Equal(3, conn.inserted())
+	c.mu.Lock()
+	assert.Len(c.rows, 1)
+	assert.Equal(1, c.rows[0].attempts)
+	c.mu.Unlock()
+
+	// the poison row is dropped after the max attempts
+	assert.NoError(c.Push(ctx, []byte("4")))
+	assert.Error(c.flush(context.Background()))
+	assert.Equal(4, conn.inserted())
+	c.mu.Lock()
+	assert.Empty(c.rows)
+	c.mu.Unlock()
+
+	assert.NoError(c.Close(context.Background()))
+}
+
+func TestPushFlushInterval(t *testing.T) {
+	assert := assert.New(t)
+	ctx := formatting.ToContext(context.Background(), formatting.New())
+
+	conn := &fakeConn{}
+	c := newTestStorage(conn, batchConfig{Size: 100, FlushInterval: 20 * time.Millisecond})
+
+	assert.NoError(c.Push(ctx, []byte("Hello")))
+	assert.Eventually(func() bool {
+		return conn.inserted() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(c.Close(context.Background()))
+}
+
+func TestClickHouseName(t *testing.T) {
+	assert.Equal(t, "clickhouse", (&storage{}).Name())
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error((&config{Columns: map[string]string{"payload": "{{ .Payload }}"}}).validate())
+	assert.Error((&config{Table: "test"}).validate())
+
+	c := &config{Table: "test", Columns: map[string]string{"payload": "{{ .Payload }}"}}
+	assert.NoError(c.validate())
+	assert.Equal(10*time.Second, c.Timeout)
+	assert.Equal(1000, c.Batch.Size)
+	assert.Equal(time.Second, c.Batch.FlushInterval)
+	assert.Equal(10000, c.Batch.MaxBufferSize)
+	assert.Equal(5, c.Batch.MaxAttempts)
+}
+
+func TestConvert(t *testing.T) {
+	assert := assert.New(t)
+	var text *string
+
+	tests := []struct {
+		value    string
+		typ      reflect.Type
+		expected interface{}
+		err      bool
+	}{
+		{" Hello ", reflect.TypeOf(""), " Hello ", false},
+		{"Hello", nil, "Hello", false},
+		{"", reflect.TypeOf(text), nil, false},
+		{"Hello", reflect.TypeOf(text), "Hello", false},
+		{" 42 ", reflect.TypeOf(uint64(0)), uint64(42), false},
+		{"-42", reflect.TypeOf(uint8(0)), nil, true},
+		{"-42", reflect.TypeOf(int32(0)), int32(-42), false},
+		{"128", reflect.TypeOf(int8(0)), nil, true},
+		{"4.2", reflect.TypeOf(float64(0)), 4.2, false},
+		{"true", reflect.TypeOf(false), true, false},
+		{"yes", reflect.TypeOf(false), nil, true},
+		{"2023-01-01 08:42:00", reflect.TypeOf(time.Time{}), "2023-01-01 08:42:00", false},
+	}
+
+	for _, test := range tests {
+		value, err := convert(test.value, test.typ)
+		if test.err {
+			assert.Error(err, test.value)
+			continue
+		}
+		assert.NoError(err, test.value)
+		assert.Equal(test.expected, value, test.value)
+	}
+}
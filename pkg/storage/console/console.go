@@ -0,0 +1,256 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+// storage is the struct contains the writer and config
+// Run is made from external caller at begins programs
+type storage struct {
+	name   string
+	config *config
+
+	mu     sync.Mutex // protect the writer to avoid interleaved lines
+	writer io.Writer
+}
+
+// config is the struct contains config of the console storage
+// Run is made from internal caller
+type config struct {
+	// Format is the format of the written lines: line writes the payload as
+	// is, json wraps the payload in an envelope with the spec name, the
+	// timestamp and the headers of the request (default: line)
+	Format string `mapstructure:"format" json:"format"`
+	// Redact is the list of the JSON fields of the payload replaced by
+	// [REDACTED] before writing. Nested fields are separated by dots
+	// (eg: user.password), arrays are traversed
+	Redact []string `mapstructure:"redact" json:"redact"`
+	// RedactHeaders is the list of the headers replaced by [REDACTED] in
+	// the json envelope (default: Authorization, Cookie and
+	// Proxy-Authorization)
+	RedactHeaders []string `mapstructure:"redactHeaders" json:"redactHeaders"`
+}
+
+// envelope is the JSON object written with the json format
+type envelope struct {
+	Spec      string              `json:"spec,omitempty"`
+	Timestamp time.Time           `json:"timestamp"`
+	Headers   map[string][]string `json:"headers,omitempty"`
+	Payload   json.RawMessage     `json:"payload"`
+}
+
+const (
+	// formatLine writes the payload followed by a new line
+	formatLine = "line"
+	// formatJSON writes the payload wrapped in an envelope
+	formatJSON = "json"
+
+	// redacted is the value of the redacted fields and headers
+	redacted = "[REDACTED]"
+
+	// specNameTemplate and headersTemplate read the spec name and the
+	// headers of the request from the formatting data
+	specNameTemplate = "{{ with .Spec }}{{ .Name }}{{ end }}"
+	headersTemplate  = "{{ with .Request }}{{ .Header | toJson }}{{ end }}"
+)
+
+// NewStdoutStorage is the function for create new storage writing on the
+// standard output
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return ConsoleStorage the struct contains the writer and config
+// @return an error if the the storage is not initialized successfully
+func NewStdoutStorage(configRaw map[string]interface{}) (*storage, error) {
+	return newStorage("stdout", os.Stdout, configRaw)
+}
+
+// NewStderrStorage is the function for create new storage writing on the
+// standard error output
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return ConsoleStorage the struct contains the writer and config
+// @return an error if the the storage is not initialized successfully
+func NewStderrStorage(configRaw map[string]interface{}) (*storage, error) {
+	return newStorage("stderr", os.Stderr, configRaw)
+}
+
+// newStorage creates the storage writing on the given writer
+func newStorage(name string, writer io.Writer, configRaw map[string]interface{}) (*storage, error) {
+	newClient := storage{
+		name:   name,
+		config: &config{},
+		writer: writer,
+	}
+
+	if err := valuable.Decode(configRaw, &newClient.config); err != nil {
+		return nil, err
+	}
+
+	switch newClient.config.Format {
+	case "":
+		newClient.config.Format = formatLine
+	case formatLine, formatJSON:
+	default:
+		return nil, fmt.Errorf("invalid format %s, must be %s or %s", newClient.config.Format, formatLine, formatJSON)
+	}
+
+	if newClient.config.RedactHeaders == nil {
+		newClient.config.RedactHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+	}
+
+	return &newClient, nil
+}
+
+// Name is the function for identified if the storage config is define in the webhooks
+// Run is made from external caller
+func (c *storage) Name() string {
+	return c.name
+}
+
+// Push is the function for push data in the storage
+// The payload is written on a single line, as is or wrapped in a JSON
+// envelope, after the redaction of the configured fields
+// A run is made from external caller
+// @param value that will be pushed
+// @return an error if the push failed
+func (c *storage) Push(ctx context.Context, value []byte) error {
+	payload := redactFields(value, c.config.Redact)
+
+	var line []byte
+	if c.config.Format == formatJSON {
+		var err error
+		if line, err = c.envelope(ctx, payload); err != nil {
+			return err
+		}
+	} else {
+		line = payload
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.writer.Write(append(line, '\n'))
+	return err
+}
+
+// envelope returns the payload wrapped in the JSON envelope with the spec
+// name, the current time and the redacted headers of the request
+func (c *storage) envelope(ctx context.Context, payload []byte) ([]byte, error) {
+	formatter, err := formatting.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := formatter.WithTemplate(specNameTemplate).Render()
+	if err != nil {
+		return nil, err
+	}
+
+	rawHeaders, err := formatter.WithTemplate(headersTemplate).Render()
+	if err != nil {
+		return nil, err
+	}
+
+	var headers map[string][]string
+	if rawHeaders != "" {
+		if err := json.Unmarshal([]byte(rawHeaders), &headers); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range headers {
+		for _, redactedHeader := range c.config.RedactHeaders {
+			if strings.EqualFold(name, redactedHeader) {
+				headers[name] = []string{redacted}
+			}
+		}
+	}
+
+	var rawPayload json.RawMessage
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, payload) == nil {
+		rawPayload = compacted.Bytes()
+	} else if rawPayload, err = marshal(string(payload)); err != nil {
+		return nil, err
+	}
+
+	return marshal(envelope{
+		Spec:      spec,
+		Timestamp: time.Now().UTC(),
+		Headers:   headers,
+		Payload:   rawPayload,
+	})
+}
+
+// redactFields replaces the given fields of the JSON payload by [REDACTED].
+// The payload is returned as is when it is not a JSON document or when
+// there is nothing to redact
+func redactFields(payload []byte, fields []string) []byte {
+	if len(fields) == 0 {
+		return payload
+	}
+
+	// numbers are kept as is to avoid the loss of precision of float64
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return payload
+	}
+
+	for _, field := range fields {
+		redactPath(document, strings.Split(field, "."))
+	}
+
+	redactedPayload, err := marshal(document)
+	if err != nil {
+		return payload
+	}
+	return redactedPayload
+}
+
+// marshal returns the JSON encoding of the value without escaping the HTML
+// characters, to keep the payload readable
+func marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// redactPath replaces the value at the given path of the document,
+// traversing the arrays
+func redactPath(document interface{}, path []string) {
+	switch node := document.(type) {
+	case []interface{}:
+		for _, item := range node {
+			redactPath(item, path)
+		}
+	case map[string]interface{}:
+		value, ok := node[path[0]]
+		if !ok {
+			return
+		}
+
+		if len(path) == 1 {
+			node[path[0]] = redacted
+			return
+		}
+		redactPath(value, path[1:])
+	}
+}
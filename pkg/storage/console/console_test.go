@@ -0,0 +1,121 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+func TestNewStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	stdout, err := NewStdoutStorage(map[string]interface{}{})
+	assert.NoError(err)
+	assert.Equal("stdout", stdout.Name())
+	assert.Equal(formatLine, stdout.config.Format)
+	assert.Equal([]string{"Authorization", "Cookie", "Proxy-Authorization"}, stdout.config.RedactHeaders)
+
+	stderr, err := NewStderrStorage(map[string]interface{}{"format": "json", "redactHeaders": []string{}})
+	assert.NoError(err)
+	assert.Equal("stderr", stderr.Name())
+	assert.Empty(stderr.config.RedactHeaders)
+
+	_, err = NewStdoutStorage(map[string]interface{}{"format": "xml"})
+	assert.Error(err)
+
+	_, err = NewStdoutStorage(map[string]interface{}{"redact": 1})
+	assert.Error(err)
+}
+
+func TestPushLine(t *testing.T) {
+	assert := assert.New(t)
+
+	var buffer bytes.Buffer
+	c, err := newStorage("stdout", &buffer, map[string]interface{}{
+		"redact": []string{"password"},
+	})
+	assert.NoError(err)
+
+	assert.NoError(c.Push(context.Background(), []byte("Hello")))
+	assert.NoError(c.Push(context.Background(), []byte(`{"user": "a", "password": "b", "id": 12345678901234567890}`)))
+	assert.Equal("Hello\n{\"id\":12345678901234567890,\"password\":\"[REDACTED]\",\"user\":\"a\"}\n", buffer.String())
+}
+
+func TestPushJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	var buffer bytes.Buffer
+	c, err := newStorage("stdout", &buffer, map[string]interface{}{
+		"format": "json",
+		"redact": []string{"user.token"},
+	})
+	assert.NoError(err)
+
+	err = c.Push(context.Background(), []byte("Hello"))
+	assert.ErrorIs(err, formatting.ErrNotFoundInContext)
+
+	ctx := formatting.ToContext(
+		context.Background(),
+		formatting.New().
+			WithData("Spec", map[string]string{"Name": "test"}).
+			WithRequest(&http.Request{Header: http.Header{
+				"X-Event":       []string{"push"},
+				"Authorization": []string{"Bearer secret"},
+			}}),
+	)
+
+	assert.NoError(c.Push(ctx, []byte(`{"user": {"name": "<a>", "token": "secret"}}`)))
+	assert.NoError(c.Push(ctx, []byte("Hello\nWorld")))
+
+	lines := bytes.Split(bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), []byte("\n"))
+	assert.Len(lines, 2)
+
+	var written struct {
+		envelope
+		Payload interface{} `json:"payload"`
+	}
+	assert.NoError(json.Unmarshal(lines[0], &written))
+	assert.Equal("test", written.Spec)
+	assert.WithinDuration(time.Now(), written.Timestamp, time.Minute)
+	assert.Equal(map[string][]string{"X-Event": {"push"}, "Authorization": {"[REDACTED]"}}, written.Headers)
+	assert.Equal(map[string]interface{}{"user": map[string]interface{}{"name": "<a>", "token": "[REDACTED]"}}, written.Payload)
+	assert.Contains(string(lines[0]), `"name":"<a>"`)
+
+	assert.NoError(json.Unmarshal(lines[1], &written))
+	assert.Equal("Hello\nWorld", written.Payload)
+
+	// without spec and request in the formatting data
+	buffer.Reset()
+	assert.NoError(c.Push(formatting.ToContext(context.Background(), formatting.New()), []byte("Hello")))
+	assert.NotContains(buffer.String(), `"spec"`)
+	assert.NotContains(buffer.String(), `"headers"`)
+}
+
+func TestRedactFields(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		payload  string
+		fields   []string
+		expected string
+	}{
+		{`{"a": 1}`, nil, `{"a": 1}`},
+		{"not json", []string{"a"}, "not json"},
+		{`{"a": 1, "b": 2}`, []string{"a"}, `{"a":"[REDACTED]","b":2}`},
+		{`{"a": {"b": {"c": 1}}}`, []string{"a.b.c", "a.x.y"}, `{"a":{"b":{"c":"[REDACTED]"}}}`},
+		{`{"a": [{"b": 1}, {"c": 2}]}`, []string{"a.b"}, `{"a":[{"b":"[REDACTED]"},{"c":2}]}`},
+		{`[{"a": 1}, {"a": 2}]`, []string{"a"}, `[{"a":"[REDACTED]"},{"a":"[REDACTED]"}]`},
+		{`{"a": {"b": 1}}`, []string{"a"}, `{"a":"[REDACTED]"}`},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.expected, string(redactFields([]byte(test.payload), test.fields)), test.payload)
+	}
+}
@@ -0,0 +1,187 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// bulkItem is a document waiting to be sent with the bulk API
+type bulkItem struct {
+	// action is the metadata line of the document in the bulk request
+	action []byte
+	// document is the source line of the document in the bulk request
+	document []byte
+	// result receives the result of the indexation of the document
+	result chan error
+}
+
+// errIndexerStopped is returned when a document is added after the stop of
+// the indexer
+var errIndexerStopped = errors.New("elasticsearch bulk indexer is stopped")
+
+// bulkIndexer accumulates the documents and sends them with the bulk API
+// when the flush size is reached or when the flush interval is elapsed
+type bulkIndexer struct {
+	flushSize     int
+	flushInterval time.Duration
+	// send sends the items and returns the error of each item, or an error
+	// for the whole request
+	send func(items []*bulkItem) ([]error, error)
+
+	queue chan *bulkItem
+	// done is closed when the indexer is stopped
+	done chan struct{}
+	// stopped is closed when the run loop is stopped
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// newBulkItem returns the item indexing the value in the given index. The
+// value is indexed as is when it is a JSON object, otherwise it is wrapped
+// in the `payload` field of a new document
+func newBulkItem(index, documentID string, value []byte) (*bulkItem, error) {
+	type indexAction struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id,omitempty"`
+	}
+
+	action, err := json.Marshal(map[string]indexAction{
+		"index": {Index: index, ID: documentID},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var document []byte
+	if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed) {
+		// the bulk API is line delimited, the document must fit on one line
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, trimmed); err != nil {
+			return nil, err
+		}
+		document = compacted.Bytes()
+	} else if document, err = json.Marshal(map[string]string{"payload": string(value)}); err != nil {
+		return nil, err
+	}
+
+	return &bulkItem{
+		action:   action,
+		document: document,
+		result:   make(chan error, 1),
+	}, nil
+}
+
+// newBulkIndexer creates the bulk indexer and starts its flush loop
+func newBulkIndexer(flushSize int, flushInterval time.Duration, send func(items []*bulkItem) ([]error, error)) *bulkIndexer {
+	indexer := &bulkIndexer{
+		flushSize:     flushSize,
+		flushInterval: flushInterval,
+		send:          send,
+		queue:         make(chan *bulkItem, flushSize),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	go indexer.run()
+	return indexer
+}
+
+// add queues the item and waits for the result of its indexation
+func (b *bulkIndexer) add(ctx context.Context, item *bulkItem) error {
+	select {
+	case b.queue <- item:
+	case <-b.done:
+		return errIndexerStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-item.result:
+		return err
+	case <-b.stopped:
+		// the item is flushed by the stop unless it was queued after it
+		select {
+		case err := <-item.result:
+			return err
+		default:
+			return errIndexerStopped
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop stops the run loop after the flush of the queued items
+func (b *bulkIndexer) stop() {
+	b.stopOnce.Do(func() {
+		close(b.done)
+		<-b.stopped
+	})
+}
+
+// run accumulates the queued items and flushes them when the batch is full
+// or when the oldest item waited for the flush interval, until the indexer
+// is stopped
+func (b *bulkIndexer) run() {
+	defer close(b.stopped)
+
+	var batch = make([]*bulkItem, 0, b.flushSize)
+	var timer = time.NewTimer(b.flushInterval)
+	timer.Stop()
+
+	for {
+		select {
+		case item := <-b.queue:
+			if len(batch) == 0 {
+				timer.Reset(b.flushInterval)
+			}
+
+			if batch = append(batch, item); len(batch) < b.flushSize {
+				continue
+			}
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		case <-b.done:
+			timer.Stop()
+			for {
+				select {
+				case item := <-b.queue:
+					batch = append(batch, item)
+				default:
+					b.flush(batch)
+					return
+				}
+			}
+		}
+
+		b.flush(batch)
+		batch = make([]*bulkItem, 0, b.flushSize)
+	}
+}
+
+// flush sends the batch and reports the result to each item
+func (b *bulkIndexer) flush(batch []*bulkItem) {
+	if len(batch) == 0 {
+		return
+	}
+
+	errs, err := b.send(batch)
+	for i, item := range batch {
+		if err != nil {
+			item.result <- err
+		} else {
+			item.result <- errs[i]
+		}
+	}
+}
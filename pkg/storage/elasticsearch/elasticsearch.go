@@ -0,0 +1,308 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"atomys.codes/webhooked/internal/tlsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// storage is the struct contains client and config
+// Run is made from external caller at begins programs
+type storage struct {
+	client  *http.Client
+	config  *config
+	indexer *bulkIndexer
+}
+
+// config is the struct contains config for connect client
+// Run is made from internal caller
+type config struct {
+	// Addresses is the list of the nodes urls (eg: http://localhost:9200).
+	// The nodes are used in order, the next one is used when a node is
+	// not reachable
+	Addresses []string `mapstructure:"addresses" json:"addresses"`
+	// Username and Password are used for the basic authentication
+	Username valuable.Valuable `mapstructure:"username" json:"username"`
+	Password valuable.Valuable `mapstructure:"password" json:"-"`
+	// APIKey is the base64 encoded API key used for the authentication,
+	// it takes precedence over the basic authentication
+	APIKey valuable.Valuable `mapstructure:"apiKey" json:"-"`
+	// Index is the index where the documents are indexed. The index can use
+	// the formatting feature (see pkg/formatting) to create date based
+	// indices (eg: webhooks-{{ formatTime now "" "2006.01" }})
+	Index string `mapstructure:"index" json:"index"`
+	// DocumentID is the identifier of the indexed document. The identifier
+	// can use the formatting feature. When defined, a document with the same
+	// identifier is replaced, allowing idempotent deliveries. When empty,
+	// the identifier is generated by the cluster
+	DocumentID string `mapstructure:"documentId" json:"documentId"`
+	// Timeout is the maximum duration of each request (default: 10s)
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout"`
+	// Bulk is the configuration of the bulk indexer
+	Bulk bulkConfig `mapstructure:"bulk" json:"bulk"`
+	// TLS is the TLS configuration used to connect to the cluster
+	TLS tlsconfig.Config `mapstructure:"tls" json:"-"`
+}
+
+// bulkConfig is the struct contains the configuration of the bulk indexer
+type bulkConfig struct {
+	// FlushSize is the number of documents that triggers the flush of the
+	// bulk request (default: 100)
+	FlushSize int `mapstructure:"flushSize" json:"flushSize"`
+	// FlushInterval is the maximum duration a document waits before the
+	// flush of the bulk request (default: 1s)
+	FlushInterval time.Duration `mapstructure:"flushInterval" json:"flushInterval"`
+}
+
+// NewStorage is the function for create new Elasticsearch client storage.
+// The storage is compatible with OpenSearch
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return ElasticsearchStorage the struct contains client connected and config
+// @return an error if the the client is not initialized successfully
+func NewStorage(configRaw map[string]interface{}) (*storage, error) {
+	newClient := storage{
+		config: &config{},
+	}
+
+	if err := valuable.Decode(configRaw, &newClient.config); err != nil {
+		return nil, err
+	}
+
+	if err := newClient.config.validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newClient.config.TLS.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	newClient.client = &http.Client{
+		Transport: transport,
+		Timeout:   newClient.config.Timeout,
+	}
+
+	// Ping the cluster for testing config
+	if err := newClient.Ping(context.Background()); err != nil {
+		return nil, err
+	}
+
+	newClient.indexer = newBulkIndexer(
+		newClient.config.Bulk.FlushSize,
+		newClient.config.Bulk.FlushInterval,
+		newClient.bulk,
+	)
+
+	return &newClient, nil
+}
+
+// validate checks the required fields and sets the default values
+func (c *config) validate() error {
+	if len(c.Addresses) == 0 {
+		return fmt.Errorf("at least one address is required")
+	}
+
+	if c.Index == "" {
+		return fmt.Errorf("the index is required")
+	}
+
+	for i, address := range c.Addresses {
+		c.Addresses[i] = strings.TrimSuffix(address, "/")
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+
+	if c.Bulk.FlushSize <= 0 {
+		c.Bulk.FlushSize = 100
+	}
+
+	if c.Bulk.FlushInterval == 0 {
+		c.Bulk.FlushInterval = time.Second
+	}
+
+	return nil
+}
+
+// Name is the function for identified if the storage config is define in the webhooks
+// Run is made from external caller
+func (c storage) Name() string {
+	return "elasticsearch"
+}
+
+// Push is the function for push data in the storage
+// The value is indexed in the rendered index by the bulk indexer, the
+// function waits for the flush of the bulk request containing the document
+// A run is made from external caller
+// @param value that will be pushed
+// @return an error if the push failed
+func (c storage) Push(ctx context.Context, value []byte) error {
+	index, err := formatting.RenderFromContext(ctx, c.config.Index, value)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	var documentID string
+	if c.config.DocumentID != "" {
+		if documentID, err = formatting.RenderFromContext(ctx, c.config.DocumentID, value); err != nil {
+			return retry.Permanent(err)
+		}
+	}
+
+	item, err := newBulkItem(index, documentID, value)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	return c.indexer.add(ctx, item)
+}
+
+// Close flushes the queued documents and stops the bulk indexer
+func (c storage) Close(ctx context.Context) error {
+	c.indexer.stop()
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// Capabilities returns the capabilities of the storage, the documents are
+// deduplicated when their identifier is defined
+func (c storage) Capabilities() []capability.Capability {
+	if c.config.DocumentID != "" {
+		return []capability.Capability{capability.Batch, capability.Deduplication}
+	}
+	return []capability.Capability{capability.Batch}
+}
+
+// Ping checks that the cluster is reachable with the configured credentials
+func (c storage) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/", nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// drain the body to allow the connection to be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("cluster responded with status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// bulkResponse is the part of the bulk API response used to report the
+// result of each document
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk sends the items with the bulk API and returns the error of each
+// item, in the same order. The returned error is set when the whole
+// request failed
+func (c storage) bulk(items []*bulkItem) ([]error, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		body.Write(item.action)
+		body.WriteByte('\n')
+		body.Write(item.document)
+		body.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.Timeout)
+	defer cancel()
+
+	resp, err := c.do(ctx, http.MethodPost, "/_bulk", body.Bytes(), "application/x-ndjson")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, statusError(fmt.Errorf("cluster responded with status code %d", resp.StatusCode), resp.StatusCode)
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("cannot decode the bulk response: %s", err.Error())
+	}
+
+	if len(result.Items) != len(items) {
+		return nil, fmt.Errorf("bulk response contains %d items, %d expected", len(result.Items), len(items))
+	}
+
+	var errs = make([]error, len(items))
+	for i, item := range result.Items {
+		for _, status := range item {
+			if status.Status < 200 || status.Status >= 300 {
+				errs[i] = statusError(fmt.Errorf("document rejected with status code %d: %s", status.Status, status.Error), status.Status)
+			}
+		}
+	}
+
+	return errs, nil
+}
+
+// statusError marks the error of the status code as permanent when the
+// request must not be retried, like a document rejected by the mapping.
+// The rejections of an overloaded cluster (429) are retried
+func statusError(err error, statusCode int) error {
+	if retry.IsPermanentStatus(statusCode) {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+// do sends the request to the first reachable node with the authentication
+func (c storage) do(ctx context.Context, method, path string, body []byte, contentType string) (*http.Response, error) {
+	var lastErr error
+	for _, address := range c.config.Addresses {
+		req, err := http.NewRequestWithContext(ctx, method, address+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		if apiKey := c.config.APIKey.First(); apiKey != "" {
+			req.Header.Set("Authorization", "ApiKey "+apiKey)
+		} else if username := c.config.Username.First(); username != "" {
+			req.SetBasicAuth(username, c.config.Password.First())
+		}
+
+		resp, err := c.client.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,241 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+type ElasticsearchSetupTestSuite struct {
+	suite.Suite
+	server *httptest.Server
+	ctx    context.Context
+
+	mu sync.Mutex
+	// bulks contains the lines of each received bulk request
+	bulks [][]string
+	// headers contains the headers of the last received request
+	headers http.Header
+	// reject is the document id rejected by the fake cluster
+	reject string
+}
+
+func (suite *ElasticsearchSetupTestSuite) SetupTest() {
+	suite.bulks = nil
+	suite.reject = ""
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.mu.Lock()
+		defer suite.mu.Unlock()
+		suite.headers = r.Header.Clone()
+
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `{"version":{"number":"8.10.0"}}`)
+			return
+		}
+
+		var lines []string
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+			if len(lines)%2 == 0 {
+				continue
+			}
+
+			var action map[string]map[string]string
+			_ = json.Unmarshal(scanner.Bytes(), &action)
+			if action["index"]["_id"] != "" && action["index"]["_id"] == suite.reject {
+				items = append(items, `{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}`)
+			} else {
+				items = append(items, `{"index":{"status":201}}`)
+			}
+		}
+		suite.bulks = append(suite.bulks, lines)
+
+		fmt.Fprintf(w, `{"errors":false,"items":[%s]}`, strings.Join(items, ","))
+	}))
+
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().WithData("Spec", map[string]string{"Name": "test"}),
+	)
+}
+
+func (suite *ElasticsearchSetupTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *ElasticsearchSetupTestSuite) TestElasticsearchNewStorage() {
+	_, err := NewStorage(map[string]interface{}{
+		"addresses": 1,
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"addresses": []string{"http://127.0.0.1:1"},
+		"index":     "webhooks",
+		"timeout":   "100ms",
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"addresses": []string{"http://127.0.0.1:1", suite.server.URL + "/"},
+		"index":     "webhooks",
+		"apiKey":    "a2V5",
+	})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "ApiKey a2V5", suite.headers.Get("Authorization"))
+
+	_, err = NewStorage(map[string]interface{}{
+		"addresses": []string{suite.server.URL},
+		"index":     "webhooks",
+		"username":  "elastic",
+		"password":  "changeme",
+	})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "Basic ZWxhc3RpYzpjaGFuZ2VtZQ==", suite.headers.Get("Authorization"))
+}
+
+func (suite *ElasticsearchSetupTestSuite) TestElasticsearchPush() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"addresses":  []string{suite.server.URL},
+		"index":      "webhooks-{{ .Spec.Name }}",
+		"documentId": "{{ .Payload | fromJson | lookup \"id\" }}",
+		"bulk": map[string]interface{}{
+			"flushSize":     2,
+			"flushInterval": "50ms",
+		},
+	})
+	assert.NoError(suite.T(), err)
+
+	err = newClient.Push(context.Background(), []byte(`{"id":"1"}`))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	var wg sync.WaitGroup
+	for _, payload := range []string{`{"id":"1"}`, "{\n  \"id\": \"2\"\n}"} {
+		wg.Add(1)
+		go func(payload string) {
+			defer wg.Done()
+			assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte(payload)))
+		}(payload)
+	}
+	wg.Wait()
+
+	suite.mu.Lock()
+	assert.Len(suite.T(), suite.bulks, 1)
+	assert.Len(suite.T(), suite.bulks[0], 4)
+	assert.Contains(suite.T(), suite.bulks[0], `{"id":"2"}`)
+	assert.Contains(suite.T(), suite.bulks[0], `{"index":{"_index":"webhooks-test","_id":"2"}}`)
+	assert.Equal(suite.T(), "application/x-ndjson", suite.headers.Get("Content-Type"))
+	suite.reject = "3"
+	suite.mu.Unlock()
+
+	// the interval flushes an incomplete batch
+	start := time.Now()
+	err = newClient.Push(suite.ctx, []byte(`{"id":"3"}`))
+	assert.ErrorContains(suite.T(), err, "status code 400")
+	assert.GreaterOrEqual(suite.T(), time.Since(start), 50*time.Millisecond)
+
+	assert.Equal(suite.T(), []capability.Capability{capability.Batch, capability.Deduplication}, newClient.Capabilities())
+
+	suite.server.Close()
+	assert.Error(suite.T(), newClient.Push(suite.ctx, []byte(`{"id":"4"}`)))
+	assert.NoError(suite.T(), newClient.Close(context.Background()))
+}
+
+func TestRunElasticsearchPush(t *testing.T) {
+	suite.Run(t, new(ElasticsearchSetupTestSuite))
+}
+
+func TestElasticsearchName(t *testing.T) {
+	assert.Equal(t, "elasticsearch", storage{}.Name())
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error((&config{Index: "webhooks"}).validate())
+	assert.Error((&config{Addresses: []string{"http://localhost:9200"}}).validate())
+
+	c := &config{Addresses: []string{"http://localhost:9200/"}, Index: "webhooks"}
+	assert.NoError(c.validate())
+	assert.Equal([]string{"http://localhost:9200"}, c.Addresses)
+	assert.Equal(10*time.Second, c.Timeout)
+	assert.Equal(100, c.Bulk.FlushSize)
+	assert.Equal(time.Second, c.Bulk.FlushInterval)
+}
+
+func TestStatusError(t *testing.T) {
+	assert := assert.New(t)
+
+	err := errors.New("document rejected")
+	assert.False(retry.IsRetryable(statusError(err, http.StatusBadRequest)))
+	assert.True(retry.IsRetryable(statusError(err, http.StatusTooManyRequests)))
+	assert.True(retry.IsRetryable(statusError(err, http.StatusServiceUnavailable)))
+	assert.ErrorIs(statusError(err, http.StatusBadRequest), err)
+}
+
+func TestNewBulkItem(t *testing.T) {
+	assert := assert.New(t)
+
+	item, err := newBulkItem("webhooks", "", []byte(" {\"a\": 1}\n"))
+	assert.NoError(err)
+	assert.Equal(`{"index":{"_index":"webhooks"}}`, string(item.action))
+	assert.Equal(`{"a":1}`, string(item.document))
+
+	item, err = newBulkItem("webhooks", "id", []byte("[1, 2]"))
+	assert.NoError(err)
+	assert.Equal(`{"index":{"_index":"webhooks","_id":"id"}}`, string(item.action))
+	assert.Equal(`{"payload":"[1, 2]"}`, string(item.document))
+
+	item, err = newBulkItem("webhooks", "", []byte("hello\nworld"))
+	assert.NoError(err)
+	assert.Equal(`{"payload":"hello\nworld"}`, string(item.document))
+}
+
+func TestBulkIndexer(t *testing.T) {
+	assert := assert.New(t)
+
+	indexer := newBulkIndexer(10, time.Hour, func(items []*bulkItem) ([]error, error) {
+		return nil, io.ErrUnexpectedEOF
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(indexer.add(ctx, &bulkItem{result: make(chan error, 1)}), context.DeadlineExceeded)
+
+	indexer = newBulkIndexer(1, time.Hour, func(items []*bulkItem) ([]error, error) {
+		return nil, io.ErrUnexpectedEOF
+	})
+	assert.ErrorIs(indexer.add(context.Background(), &bulkItem{result: make(chan error, 1)}), io.ErrUnexpectedEOF)
+
+	// the stop flushes the queued items
+	var flushed int
+	indexer = newBulkIndexer(10, time.Hour, func(items []*bulkItem) ([]error, error) {
+		flushed += len(items)
+		return make([]error, len(items)), nil
+	})
+	item := &bulkItem{result: make(chan error, 1)}
+	indexer.queue <- item
+	indexer.stop()
+	indexer.stop()
+	assert.Equal(1, flushed)
+	assert.NoError(<-item.result)
+	assert.ErrorIs(indexer.add(context.Background(), &bulkItem{result: make(chan error, 1)}), errIndexerStopped)
+}
@@ -0,0 +1,190 @@
+package gcppubsub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// storage is the struct contains client and config
+// Run is made from external caller at begins programs
+type storage struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+	config *config
+}
+
+// config is the struct contains config for connect client
+// Run is made from internal caller
+type config struct {
+	// ProjectID is the identifier of the GCP project of the topic
+	ProjectID valuable.Valuable `mapstructure:"projectId" json:"projectId"`
+	// Topic is the identifier of the topic where the messages are published
+	Topic string `mapstructure:"topic" json:"topic"`
+	// Credentials is the path of the service account key file, or its JSON
+	// content. When empty, the application default credentials are used.
+	// The credentials are ignored when the PUBSUB_EMULATOR_HOST environment
+	// variable targets an emulator
+	Credentials valuable.Valuable `mapstructure:"credentials" json:"-"`
+	// OrderingKey is the ordering key of the messages, the messages with
+	// the same key are delivered in order. The key can use the formatting
+	// feature (see pkg/formatting)
+	OrderingKey string `mapstructure:"orderingKey" json:"orderingKey"`
+	// Attributes are the message attributes. Each value can use the
+	// formatting feature to forward the request headers
+	// (eg: {{ .Request.Header | getHeader "X-Event" }}). Empty values are
+	// not sent
+	Attributes map[string]string `mapstructure:"attributes" json:"attributes"`
+}
+
+// NewStorage is the function for create new Google Pub/Sub client storage
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return PubSubStorage the struct contains client connected and config
+// @return an error if the the client is not initialized successfully
+func NewStorage(configRaw map[string]interface{}) (*storage, error) {
+	newClient := storage{
+		config: &config{},
+	}
+
+	if err := valuable.Decode(configRaw, &newClient.config); err != nil {
+		return nil, err
+	}
+
+	if newClient.config.ProjectID.First() == "" {
+		return nil, fmt.Errorf("the project id is required")
+	}
+
+	if newClient.config.Topic == "" {
+		return nil, fmt.Errorf("the topic is required")
+	}
+
+	var err error
+	ctx := context.Background()
+	if newClient.client, err = pubsub.NewClient(ctx, newClient.config.ProjectID.First(), newClient.config.clientOptions()...); err != nil {
+		return nil, err
+	}
+
+	newClient.topic = newClient.client.Topic(newClient.config.Topic)
+	newClient.topic.EnableMessageOrdering = newClient.config.OrderingKey != ""
+
+	// Check the topic for testing config
+	if err := newClient.Ping(ctx); err != nil {
+		newClient.client.Close()
+		return nil, err
+	}
+
+	return &newClient, nil
+}
+
+// clientOptions returns the options of the client with the credentials.
+// The emulator is detected by the client from the PUBSUB_EMULATOR_HOST
+// environment variable
+func (c *config) clientOptions() []option.ClientOption {
+	credentials := strings.TrimSpace(c.Credentials.First())
+	if credentials == "" || os.Getenv("PUBSUB_EMULATOR_HOST") != "" {
+		return nil
+	}
+
+	if strings.HasPrefix(credentials, "{") {
+		return []option.ClientOption{option.WithCredentialsJSON([]byte(credentials))}
+	}
+
+	return []option.ClientOption{option.WithCredentialsFile(credentials)}
+}
+
+// Name is the function for identified if the storage config is define in the webhooks
+// Run is made from external caller
+func (c storage) Name() string {
+	return "gcppubsub"
+}
+
+// Push is the function for push data in the storage
+// The function waits for the message to be acknowledged by the server
+// A run is made from external caller
+// @param value that will be pushed
+// @return an error if the push failed
+func (c storage) Push(ctx context.Context, value []byte) error {
+	message, err := c.message(ctx, value)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.topic.Publish(ctx, message).Get(ctx); err != nil {
+		if message.OrderingKey != "" {
+			// the publication of the key is paused after an error
+			c.topic.ResumePublish(message.OrderingKey)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Ping checks that the topic exists
+func (c storage) Ping(ctx context.Context) error {
+	exists, err := c.topic.Exists(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("the topic %s does not exist", c.config.Topic)
+	}
+
+	return nil
+}
+
+// Close flushes the pending messages and closes the connection
+func (c storage) Close(ctx context.Context) error {
+	c.topic.Stop()
+	return c.client.Close()
+}
+
+// Capabilities returns the capabilities of the storage, the messages are
+// ordered when the ordering key is defined
+func (c storage) Capabilities() []capability.Capability {
+	if c.config.OrderingKey != "" {
+		return []capability.Capability{capability.Ordering}
+	}
+	return nil
+}
+
+// message builds the published message with the rendered ordering key and
+// attributes
+func (c storage) message(ctx context.Context, value []byte) (*pubsub.Message, error) {
+	message := &pubsub.Message{
+		Data:       value,
+		Attributes: make(map[string]string, len(c.config.Attributes)),
+	}
+
+	if c.config.OrderingKey != "" {
+		orderingKey, err := formatting.RenderFromContext(ctx, c.config.OrderingKey, value)
+		if err != nil {
+			return nil, retry.Permanent(err)
+		}
+		message.OrderingKey = orderingKey
+	}
+
+	for name, template := range c.config.Attributes {
+		attribute, err := formatting.RenderFromContext(ctx, template, value)
+		if err != nil {
+			return nil, retry.Permanent(err)
+		}
+
+		if attribute != "" {
+			message.Attributes[name] = attribute
+		}
+	}
+
+	return message, nil
+}
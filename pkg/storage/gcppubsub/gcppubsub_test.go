@@ -0,0 +1,155 @@
+package gcppubsub
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+type PubSubSetupTestSuite struct {
+	suite.Suite
+	server       *pstest.Server
+	client       *pubsub.Client
+	subscription *pubsub.Subscription
+	ctx          context.Context
+}
+
+// Start the fake server and create the topic for running test
+func (suite *PubSubSetupTestSuite) SetupTest() {
+	var err error
+
+	suite.server = pstest.NewServer()
+	suite.T().Setenv("PUBSUB_EMULATOR_HOST", suite.server.Addr)
+
+	if suite.client, err = pubsub.NewClient(context.Background(), "webhooked"); err != nil {
+		suite.T().Fatal(err)
+	}
+
+	topic, err := suite.client.CreateTopic(context.Background(), "webhooks")
+	if err != nil {
+		suite.T().Fatal(err)
+	}
+
+	suite.subscription, err = suite.client.CreateSubscription(context.Background(), "webhooks", pubsub.SubscriptionConfig{
+		Topic:                 topic,
+		EnableMessageOrdering: true,
+	})
+	if err != nil {
+		suite.T().Fatal(err)
+	}
+
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().
+			WithData("Spec", map[string]string{"Name": "test"}).
+			WithRequest(&http.Request{Header: http.Header{"X-Event": []string{"push"}}}),
+	)
+}
+
+// Stop the fake server after test
+func (suite *PubSubSetupTestSuite) TearDownTest() {
+	suite.client.Close()
+	suite.server.Close()
+}
+
+func (suite *PubSubSetupTestSuite) TestPubSubNewStorage() {
+	_, err := NewStorage(map[string]interface{}{
+		"projectId": []int{1},
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"projectId": "webhooked",
+		"topic":     "unknown",
+	})
+	assert.ErrorContains(suite.T(), err, "does not exist")
+
+	newClient, err := NewStorage(map[string]interface{}{
+		"projectId":   "webhooked",
+		"topic":       "webhooks",
+		"credentials": "/path/ignored/with/the/emulator.json",
+	})
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), newClient.Close(context.Background()))
+}
+
+func (suite *PubSubSetupTestSuite) TestPubSubPush() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"projectId":   "webhooked",
+		"topic":       "webhooks",
+		"orderingKey": "{{ .Spec.Name }}",
+		"attributes": map[string]string{
+			"event": `{{ .Request.Header | getHeader "X-Event" }}`,
+		},
+	})
+	assert.NoError(suite.T(), err)
+	defer newClient.Close(context.Background())
+
+	err = newClient.Push(context.Background(), []byte("Hello"))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var received *pubsub.Message
+	err = suite.subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		msg.Ack()
+		received = msg
+		cancel()
+	})
+	assert.NoError(suite.T(), err)
+	if assert.NotNil(suite.T(), received) {
+		assert.Equal(suite.T(), []byte("Hello"), received.Data)
+		assert.Equal(suite.T(), "test", received.OrderingKey)
+		assert.Equal(suite.T(), map[string]string{"event": "push"}, received.Attributes)
+	}
+
+	// the publication of the ordering key is resumed after an error
+	assert.NoError(suite.T(), suite.client.Topic("webhooks").Delete(context.Background()))
+	assert.Error(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+
+	var paused pubsub.ErrPublishingPaused
+	err = newClient.Push(suite.ctx, []byte("Hello"))
+	assert.Error(suite.T(), err)
+	assert.False(suite.T(), errors.As(err, &paused))
+}
+
+func TestRunPubSubPush(t *testing.T) {
+	suite.Run(t, new(PubSubSetupTestSuite))
+}
+
+func TestPubSubName(t *testing.T) {
+	assert.Equal(t, "gcppubsub", storage{}.Name())
+}
+
+func TestNewStorageValidation(t *testing.T) {
+	_, err := NewStorage(map[string]interface{}{"topic": "webhooks"})
+	assert.ErrorContains(t, err, "project id is required")
+
+	_, err = NewStorage(map[string]interface{}{"projectId": "webhooked"})
+	assert.ErrorContains(t, err, "topic is required")
+}
+
+func TestClientOptions(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv("PUBSUB_EMULATOR_HOST", "")
+
+	assert.Len((&config{}).clientOptions(), 0)
+	assert.Len((&config{Credentials: valuable.Valuable{Values: []string{"/etc/gcp/key.json"}}}).clientOptions(), 1)
+	assert.Len((&config{Credentials: valuable.Valuable{Values: []string{`{"type": "service_account"}`}}}).clientOptions(), 1)
+
+	t.Setenv("PUBSUB_EMULATOR_HOST", "localhost:8085")
+	assert.Len((&config{Credentials: valuable.Valuable{Values: []string{"/etc/gcp/key.json"}}}).clientOptions(), 0)
+}
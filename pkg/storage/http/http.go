@@ -0,0 +1,217 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"atomys.codes/webhooked/internal/tlsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// storage is the struct contains client and config
+// Run is made from external caller at begins programs
+type storage struct {
+	client *http.Client
+	config *config
+}
+
+// config is the struct contains config for connect client
+// Run is made from internal caller
+type config struct {
+	// URL is the url where the payload is sent. The url can use the
+	// formatting feature (see pkg/formatting)
+	URL string `mapstructure:"url" json:"url"`
+	// Method is the HTTP method used to send the payload (default: POST)
+	Method string `mapstructure:"method" json:"method"`
+	// DefinedContentType is the content type of the sent payload
+	// (default: application/json)
+	DefinedContentType string `mapstructure:"contentType" json:"contentType"`
+	// Headers are the headers added to the request. Each value can use the
+	// formatting feature (see pkg/formatting)
+	Headers map[string]string `mapstructure:"headers" json:"-"`
+	// Timeout is the maximum duration of the request (default: 10s)
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout"`
+	// Retry is the default retry policy of the storage, used when the retry
+	// of the storage is not configured next to its specs. The requests
+	// failing with a 5xx status code are retried (default: 3 attempts with
+	// an initial interval of 500ms, see DefaultRetry)
+	Retry *retry.Config `mapstructure:"retry" json:"retry"`
+	// Signature is the configuration used to sign the payload with HMAC
+	// before sending it. Let the secret empty to disable the signature
+	Signature signatureConfig `mapstructure:"signature" json:"-"`
+	// TLS is the TLS configuration used to connect to the server, define
+	// a client certificate to use mutual TLS authentication
+	TLS tlsconfig.Config `mapstructure:"tls" json:"-"`
+}
+
+// signatureConfig is the struct contains the HMAC signature configuration
+type signatureConfig struct {
+	// Secret is the secret used to compute the HMAC-SHA256 of the payload
+	Secret valuable.Valuable `mapstructure:"secret" json:"-"`
+	// Header is the header where the signature is set
+	// (default: X-Webhooked-Signature)
+	Header string `mapstructure:"header" json:"header"`
+	// Prefix is prepended to the hex encoded signature (eg: sha256=)
+	Prefix string `mapstructure:"prefix" json:"prefix"`
+}
+
+// NewStorage is the function for create new HTTP client storage
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return HTTPStorage the struct contains client and config
+// @return an error if the the client is not initialized successfully
+func NewStorage(configRaw map[string]interface{}) (*storage, error) {
+	newClient := storage{
+		config: &config{},
+	}
+
+	if err := valuable.Decode(configRaw, &newClient.config); err != nil {
+		return nil, err
+	}
+
+	if newClient.config.URL == "" {
+		return nil, fmt.Errorf("the url is required")
+	}
+
+	if newClient.config.Method == "" {
+		newClient.config.Method = http.MethodPost
+	}
+
+	if newClient.config.Timeout == 0 {
+		newClient.config.Timeout = 10 * time.Second
+	}
+
+	if newClient.config.Signature.Header == "" {
+		newClient.config.Signature.Header = "X-Webhooked-Signature"
+	}
+
+	tlsConfig, err := newClient.config.TLS.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	newClient.client = &http.Client{
+		Transport: transport,
+		Timeout:   newClient.config.Timeout,
+	}
+
+	return &newClient, nil
+}
+
+// ContentType is the function for get content type used to send the payload.
+// When no content type is defined, the default one is used instead
+// Default: application/json
+func (c *config) ContentType() string {
+	if c.DefinedContentType != "" {
+		return c.DefinedContentType
+	}
+
+	return "application/json"
+}
+
+// Name is the function for identified if the storage config is define in the webhooks
+// Run is made from external caller
+func (c storage) Name() string {
+	return "http"
+}
+
+// DefaultRetry returns the retry policy of the storage when the retry is
+// not configured next to its specs: the retry of the specs of the storage,
+// or 3 attempts with an initial interval of 500ms by default
+func (c storage) DefaultRetry() *retry.Config {
+	if c.config.Retry != nil {
+		config := *c.config.Retry
+		return &config
+	}
+
+	return &retry.Config{
+		MaxAttempts:     3,
+		InitialInterval: 500 * time.Millisecond,
+		MaxInterval:     10 * time.Second,
+	}
+}
+
+// Push is the function for push data in the storage
+// The payload is sent once to the rendered url, the failed requests are
+// retried by the retry policy of the storage (see DefaultRetry) unless the
+// server rejected them with a 4xx status code other than 408 and 429
+// A run is made from external caller
+// @param value that will be pushed
+// @return an error if the push failed
+func (c storage) Push(ctx context.Context, value []byte) error {
+	formatter, err := formatting.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	url, err := formatter.WithPayload(value).WithTemplate(c.config.URL).Render()
+	if err != nil {
+		return err
+	}
+
+	var headers = make(http.Header, len(c.config.Headers))
+	for name, template := range c.config.Headers {
+		headerValue, err := formatter.WithTemplate(template).Render()
+		if err != nil {
+			return err
+		}
+		headers.Set(name, headerValue)
+	}
+
+	headers.Set("Content-Type", c.config.ContentType())
+	if secret := c.config.Signature.Secret.First(); secret != "" {
+		headers.Set(c.config.Signature.Header, c.config.Signature.Prefix+sign(secret, value))
+	}
+
+	return c.send(ctx, url, headers, value)
+}
+
+// send performs a single request and returns an error if the request
+// cannot be sent or if the server does not respond with a 2xx status code.
+// The 4xx status codes are permanent errors, except 408 Request Timeout and
+// 429 Too Many Requests, the request is not retried
+func (c storage) send(ctx context.Context, url string, headers http.Header, value []byte) error {
+	req, err := http.NewRequestWithContext(ctx, c.config.Method, url, bytes.NewReader(value))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header = headers.Clone()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// drain the body to allow the connection to be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("server responded with status code %d", resp.StatusCode)
+		if retry.IsPermanentStatus(resp.StatusCode) {
+			return retry.Permanent(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the value with the given secret
+func sign(secret string, value []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(value)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,213 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+type HTTPSetupTestSuite struct {
+	suite.Suite
+	server   *httptest.Server
+	handler  http.HandlerFunc
+	received []*http.Request
+	bodies   []string
+	calls    int32
+	ctx      context.Context
+}
+
+func (suite *HTTPSetupTestSuite) SetupTest() {
+	suite.received = nil
+	suite.bodies = nil
+	suite.calls = 0
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {}
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&suite.calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		suite.received = append(suite.received, r)
+		suite.bodies = append(suite.bodies, string(body))
+		suite.handler(w, r)
+	}))
+
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().WithData("Spec", map[string]string{"Name": "test"}),
+	)
+}
+
+func (suite *HTTPSetupTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *HTTPSetupTestSuite) TestHTTPName() {
+	newHTTP := storage{}
+	assert.Equal(suite.T(), "http", newHTTP.Name())
+}
+
+func (suite *HTTPSetupTestSuite) TestHTTPNewStorage() {
+	_, err := NewStorage(map[string]interface{}{
+		"url": []int{1},
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"url": suite.server.URL,
+		"tls": map[string]interface{}{"cert": "/not/exist.pem", "key": "/not/exist.pem"},
+	})
+	assert.Error(suite.T(), err)
+
+	newClient, err := NewStorage(map[string]interface{}{
+		"url": suite.server.URL,
+	})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), http.MethodPost, newClient.config.Method)
+	assert.Equal(suite.T(), 10*time.Second, newClient.config.Timeout)
+	assert.Equal(suite.T(), "X-Webhooked-Signature", newClient.config.Signature.Header)
+}
+
+func (suite *HTTPSetupTestSuite) TestHTTPPush() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"url":         suite.server.URL + "/{{ .Spec.Name }}",
+		"method":      "PUT",
+		"contentType": "text/plain",
+		"headers": map[string]string{
+			"X-Spec": "{{ .Spec.Name }}",
+		},
+		"signature": map[string]interface{}{
+			"secret": "secret",
+			"prefix": "sha256=",
+		},
+	})
+	assert.NoError(suite.T(), err)
+
+	err = newClient.Push(context.Background(), []byte("Hello"))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+	assert.Len(suite.T(), suite.received, 1)
+
+	req := suite.received[0]
+	assert.Equal(suite.T(), "PUT", req.Method)
+	assert.Equal(suite.T(), "/test", req.URL.Path)
+	assert.Equal(suite.T(), "test", req.Header.Get("X-Spec"))
+	assert.Equal(suite.T(), "text/plain", req.Header.Get("Content-Type"))
+	assert.Equal(suite.T(), "sha256="+sign("secret", []byte("Hello")), req.Header.Get("X-Webhooked-Signature"))
+	assert.Equal(suite.T(), "Hello", suite.bodies[0])
+}
+
+func (suite *HTTPSetupTestSuite) TestHTTPPushRetry() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"url": suite.server.URL,
+		"retry": map[string]interface{}{
+			"maxAttempts":     3,
+			"initialInterval": "1ms",
+			"maxInterval":     "2ms",
+		},
+	})
+	assert.NoError(suite.T(), err)
+
+	// the payload is sent once, the retries are made by the retry policy
+	// of the storage, defined by the retry of its specs
+	pusher, err := retry.Wrap(newClient, nil, nil, "test", "http")
+	assert.NoError(suite.T(), err)
+
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&suite.calls) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	assert.Error(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+	assert.Equal(suite.T(), int32(1), suite.calls)
+	assert.NoError(suite.T(), pusher.Push(suite.ctx, []byte("Hello")))
+	assert.Equal(suite.T(), int32(3), suite.calls)
+
+	suite.calls = 0
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	assert.Error(suite.T(), pusher.Push(suite.ctx, []byte("Hello")))
+	assert.Equal(suite.T(), int32(3), suite.calls)
+
+	suite.calls = 0
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	err = pusher.Push(suite.ctx, []byte("Hello"))
+	assert.Error(suite.T(), err)
+	assert.False(suite.T(), retry.IsRetryable(err))
+	assert.Equal(suite.T(), int32(1), suite.calls)
+
+	suite.calls = 0
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	err = pusher.Push(suite.ctx, []byte("Hello"))
+	assert.Error(suite.T(), err)
+	assert.True(suite.T(), retry.IsRetryable(err))
+	assert.Equal(suite.T(), int32(3), suite.calls)
+}
+
+func (suite *HTTPSetupTestSuite) TestHTTPPushDefaultRetry() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"url": suite.server.URL,
+	})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 3, newClient.DefaultRetry().MaxAttempts)
+	assert.Equal(suite.T(), 500*time.Millisecond, newClient.DefaultRetry().InitialInterval)
+
+	// the 5xx are retried without retry configured
+	pusher, err := retry.Wrap(newClient, nil, nil, "test", "http")
+	assert.NoError(suite.T(), err)
+
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&suite.calls) < 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+	assert.NoError(suite.T(), pusher.Push(suite.ctx, []byte("Hello")))
+	assert.Equal(suite.T(), int32(2), suite.calls)
+
+	// an invalid retry is rejected when the storage is wrapped
+	newClient, err = NewStorage(map[string]interface{}{
+		"url":   suite.server.URL,
+		"retry": map[string]interface{}{"maxAttempts": -1},
+	})
+	assert.NoError(suite.T(), err)
+	_, err = retry.Wrap(newClient, nil, nil, "test", "http")
+	assert.Error(suite.T(), err)
+}
+
+func (suite *HTTPSetupTestSuite) TestHTTPPushTimeout() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"url":     suite.server.URL,
+		"timeout": "10ms",
+	})
+	assert.NoError(suite.T(), err)
+
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Error(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+}
+
+func TestRunHTTPPush(t *testing.T) {
+	suite.Run(t, new(HTTPSetupTestSuite))
+}
+
+func TestContentType(t *testing.T) {
+	assert.Equal(t, "application/json", (&config{}).ContentType())
+	assert.Equal(t, "text/plain", (&config{DefinedContentType: "text/plain"}).ContentType())
+}
@@ -0,0 +1,190 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+type MongoDBSetupTestSuite struct {
+	suite.Suite
+	client      *mongo.Client
+	databaseUrl string
+	ctx         context.Context
+}
+
+func (suite *MongoDBSetupTestSuite) BeforeTest(suiteName, testName string) {
+	var err error
+
+	suite.databaseUrl = fmt.Sprintf(
+		"mongodb://%s:%s@%s:%s",
+		os.Getenv("MONGODB_USER"),
+		os.Getenv("MONGODB_PASSWORD"),
+		os.Getenv("MONGODB_HOST"),
+		os.Getenv("MONGODB_PORT"),
+	)
+
+	if suite.client, err = mongo.Connect(context.Background(), options.Client().ApplyURI(suite.databaseUrl)); err != nil {
+		suite.T().Error(err)
+	}
+
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().WithTemplate("{{.}}").WithData("Spec", map[string]string{"Name": "test"}),
+	)
+}
+
+// Drop the database after test
+func (suite *MongoDBSetupTestSuite) AfterTest(suiteName, testName string) {
+	if err := suite.client.Database("webhooked").Drop(context.Background()); err != nil {
+		suite.T().Error(err)
+	}
+}
+
+func (suite *MongoDBSetupTestSuite) TestMongoDBNewStorage() {
+	_, err := NewStorage(map[string]interface{}{
+		"databaseUrl": []int{1},
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+		"database":    "webhooked",
+		"collection":  "test",
+		"upsert":      map[string]interface{}{"field": "deliveryId"},
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl":  suite.databaseUrl,
+		"database":     "webhooked",
+		"collection":   "test",
+		"writeConcern": map[string]interface{}{"w": []int{1}},
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl": "invalid://url",
+		"database":    "webhooked",
+		"collection":  "test",
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+		"database":    "webhooked",
+		"collection":  "test",
+		"writeConcern": map[string]interface{}{
+			"w":       "majority",
+			"journal": true,
+			"timeout": "5s",
+		},
+	})
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *MongoDBSetupTestSuite) TestMongoDBPush() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+		"database":    "webhooked",
+		"collection":  "{{ .Spec.Name }}",
+	})
+	assert.NoError(suite.T(), err)
+
+	err = newClient.Push(context.Background(), []byte(`{"hello":"world"}`))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte(`{"hello":"world"}`)))
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+
+	count, err := suite.client.Database("webhooked").Collection("test").CountDocuments(context.Background(), bson.M{})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), count)
+}
+
+func (suite *MongoDBSetupTestSuite) TestMongoDBPushUpsert() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+		"database":    "webhooked",
+		"collection":  "test",
+		"upsert": map[string]interface{}{
+			"field": "deliveryId",
+			"key":   `{{ (fromJson .Payload).id }}`,
+		},
+	})
+	assert.NoError(suite.T(), err)
+
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte(`{"id":"1","version":1}`)))
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte(`{"id":"1","version":2}`)))
+
+	var result bson.M
+	collection := suite.client.Database("webhooked").Collection("test")
+	count, err := collection.CountDocuments(context.Background(), bson.M{})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(1), count)
+
+	assert.NoError(suite.T(), collection.FindOne(context.Background(), bson.M{"deliveryId": "1"}).Decode(&result))
+	assert.EqualValues(suite.T(), 2, result["version"])
+}
+
+func TestRunMongoDBPush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mongodb testing is skiped in short version of test")
+		return
+	}
+
+	suite.Run(t, new(MongoDBSetupTestSuite))
+}
+
+func TestMongoDBName(t *testing.T) {
+	assert.Equal(t, "mongodb", storage{}.Name())
+}
+
+func TestDocument(t *testing.T) {
+	var s = storage{config: &config{PayloadField: "payload"}}
+
+	assert.Equal(t, bson.M{"hello": "world"}, s.document([]byte(`{"hello":"world"}`)))
+	assert.Equal(t, bson.M{"payload": "Hello"}, s.document([]byte("Hello")))
+	assert.Equal(t, bson.M{"payload": `["a"]`}, s.document([]byte(`["a"]`)))
+}
+
+func TestWriteConcernBuild(t *testing.T) {
+	assert := assert.New(t)
+	journal := true
+
+	wc, err := (&writeConcernConfig{}).build()
+	assert.NoError(err)
+	assert.Nil(wc.W)
+
+	wc, err = (&writeConcernConfig{W: "majority", Journal: &journal, Timeout: time.Second}).build()
+	assert.NoError(err)
+	assert.Equal("majority", wc.W)
+	assert.Equal(&journal, wc.Journal)
+	assert.Equal(time.Second, wc.WTimeout)
+
+	wc, err = (&writeConcernConfig{W: "2"}).build()
+	assert.NoError(err)
+	assert.Equal(2, wc.W)
+
+	wc, err = (&writeConcernConfig{W: 1}).build()
+	assert.NoError(err)
+	assert.Equal(1, wc.W)
+
+	_, err = (&writeConcernConfig{W: 1.5}).build()
+	assert.Error(err)
+}
@@ -0,0 +1,216 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+
+	"atomys.codes/webhooked/internal/tlsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// storage is the struct contains client and config
+// Run is made from external caller at begins programs
+type storage struct {
+	client paho.Client
+	config *config
+}
+
+// config is the struct contains config for connect client
+// Run is made from internal caller
+type config struct {
+	// BrokerURL is the url of the broker (eg: tcp://localhost:1883). Many
+	// brokers can be defined with the `values` field, they are used in order
+	BrokerURL valuable.Valuable `mapstructure:"brokerUrl" json:"brokerUrl"`
+	// ClientID is the identifier of the client on the broker
+	// (default: webhooked-<random>)
+	ClientID valuable.Valuable `mapstructure:"clientId" json:"clientId"`
+	Username valuable.Valuable `mapstructure:"username" json:"username"`
+	Password valuable.Valuable `mapstructure:"password" json:"password"`
+	// Topic is the topic where the data is published. The topic can use the
+	// formatting feature (see pkg/formatting)
+	Topic string `mapstructure:"topic" json:"topic"`
+	// QoS is the quality of service of the published messages: 0, 1 or 2
+	QoS byte `mapstructure:"qos" json:"qos"`
+	// Retained asks the broker to keep the last message of the topic for
+	// the future subscribers
+	Retained bool `mapstructure:"retained" json:"retained"`
+	// ConnectTimeout is the maximum duration to connect to the broker
+	// (default: 10s)
+	ConnectTimeout time.Duration `mapstructure:"connectTimeout" json:"connectTimeout"`
+	// PublishTimeout is the maximum duration to wait for the broker to
+	// acknowledge a message (default: 10s)
+	PublishTimeout time.Duration `mapstructure:"publishTimeout" json:"publishTimeout"`
+	// MaxReconnectInterval is the maximum duration between two reconnection
+	// attempts when the connection is lost (default: 1m)
+	MaxReconnectInterval time.Duration `mapstructure:"maxReconnectInterval" json:"maxReconnectInterval"`
+	// TLS is the TLS configuration used to connect to the broker
+	TLS tlsconfig.Config `mapstructure:"tls" json:"tls"`
+}
+
+// errPublishTimeout is returned when the broker does not acknowledge the
+// message in time
+var errPublishTimeout = errors.New("timeout while waiting for the broker acknowledgment")
+
+// errDisconnected is returned by Ping when the client is not connected to
+// the broker
+var errDisconnected = errors.New("not connected to the mqtt broker")
+
+// disconnectQuiesce is the duration given to the messages in flight on
+// disconnect
+const disconnectQuiesce = 250 * time.Millisecond
+
+// NewStorage is the function for create new MQTT client storage
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return MQTTStorage the struct contains client connected and config
+// @return an error if the the client is not initialized successfully
+func NewStorage(configRaw map[string]interface{}) (*storage, error) {
+	newClient := storage{
+		config: &config{},
+	}
+
+	if err := valuable.Decode(configRaw, &newClient.config); err != nil {
+		return nil, err
+	}
+
+	options, err := newClient.config.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	newClient.client = paho.NewClient(options)
+	token := newClient.client.Connect()
+	// the client is disconnected on error to stop its reconnection
+	if !token.WaitTimeout(newClient.config.ConnectTimeout) {
+		newClient.client.Disconnect(0)
+		return nil, fmt.Errorf("timeout while connecting to %s", newClient.config.BrokerURL.First())
+	}
+	if err := token.Error(); err != nil {
+		newClient.client.Disconnect(0)
+		return nil, err
+	}
+
+	return &newClient, nil
+}
+
+// clientOptions validates the configuration and returns the options of the
+// client. The client reconnects automatically when the connection is lost
+func (c *config) clientOptions() (*paho.ClientOptions, error) {
+	if len(c.BrokerURL.Get()) == 0 {
+		return nil, fmt.Errorf("the broker url is required")
+	}
+
+	if c.Topic == "" {
+		return nil, fmt.Errorf("the topic is required")
+	}
+
+	if c.QoS > 2 {
+		return nil, fmt.Errorf("invalid qos %d, must be 0, 1 or 2", c.QoS)
+	}
+
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = 10 * time.Second
+	}
+
+	if c.PublishTimeout == 0 {
+		c.PublishTimeout = 10 * time.Second
+	}
+
+	if c.MaxReconnectInterval == 0 {
+		c.MaxReconnectInterval = time.Minute
+	}
+
+	clientID := c.ClientID.First()
+	if clientID == "" {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		clientID = "webhooked-" + hex.EncodeToString(suffix)
+	}
+
+	tlsConfig, err := c.TLS.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	options := paho.NewClientOptions().
+		SetClientID(clientID).
+		SetUsername(c.Username.First()).
+		SetPassword(c.Password.First()).
+		SetConnectTimeout(c.ConnectTimeout).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(c.MaxReconnectInterval).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Warn().Err(err).Msg("connection to mqtt broker lost, reconnecting...")
+		}).
+		SetReconnectingHandler(func(_ paho.Client, _ *paho.ClientOptions) {
+			log.Debug().Msg("reconnecting to mqtt broker")
+		})
+
+	if tlsConfig != nil {
+		options.SetTLSConfig(tlsConfig)
+	}
+
+	for _, broker := range c.BrokerURL.Get() {
+		options.AddBroker(broker)
+	}
+
+	return options, nil
+}
+
+// Name is the function for identified if the storage config is define in the webhooks
+// Run is made from external caller
+func (c storage) Name() string {
+	return "mqtt"
+}
+
+// Ping returns an error when the client is not connected to the broker
+func (c storage) Ping(ctx context.Context) error {
+	if !c.client.IsConnectionOpen() {
+		return errDisconnected
+	}
+	return nil
+}
+
+// Close disconnects the client, waiting for the messages in flight
+func (c storage) Close(ctx context.Context) error {
+	c.client.Disconnect(uint(disconnectQuiesce.Milliseconds()))
+	return nil
+}
+
+// Push is the function for push data in the storage
+// The value is published on the rendered topic and the function waits for
+// the acknowledgment of the broker according to the QoS
+// A run is made from external caller
+// @param value that will be pushed
+// @return an error if the push failed
+func (c storage) Push(ctx context.Context, value []byte) error {
+	topic, err := formatting.RenderFromContext(ctx, c.config.Topic, value)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	token := c.client.Publish(topic, c.config.QoS, c.config.Retained, value)
+
+	timer := time.NewTimer(c.config.PublishTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-timer.C:
+		return errPublishTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
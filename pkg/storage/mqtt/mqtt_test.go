@@ -0,0 +1,142 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/internal/tlsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+type MQTTSetupTestSuite struct {
+	suite.Suite
+	brokerUrl string
+	ctx       context.Context
+}
+
+func (suite *MQTTSetupTestSuite) BeforeTest(suiteName, testName string) {
+	suite.brokerUrl = fmt.Sprintf(
+		"tcp://%s:%s",
+		os.Getenv("MQTT_HOST"),
+		os.Getenv("MQTT_PORT"),
+	)
+
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().WithData("Spec", map[string]string{"Name": "test"}),
+	)
+}
+
+func (suite *MQTTSetupTestSuite) TestMQTTNewStorage() {
+	_, err := NewStorage(map[string]interface{}{
+		"brokerUrl": []int{1},
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"brokerUrl":      "tcp://127.0.0.1:1",
+		"topic":          "webhooks",
+		"connectTimeout": "100ms",
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"brokerUrl": suite.brokerUrl,
+		"clientId":  "webhooked-test",
+		"topic":     "webhooks",
+		"qos":       1,
+	})
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *MQTTSetupTestSuite) TestMQTTPush() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"brokerUrl": suite.brokerUrl,
+		"topic":     "webhooks/{{ .Spec.Name }}",
+		"qos":       1,
+	})
+	assert.NoError(suite.T(), err)
+
+	var received = make(chan paho.Message, 1)
+	subscriber := paho.NewClient(paho.NewClientOptions().AddBroker(suite.brokerUrl))
+	token := subscriber.Connect()
+	assert.True(suite.T(), token.WaitTimeout(5*time.Second))
+	assert.NoError(suite.T(), token.Error())
+	defer subscriber.Disconnect(0)
+
+	token = subscriber.Subscribe("webhooks/test", 1, func(_ paho.Client, msg paho.Message) {
+		received <- msg
+	})
+	assert.True(suite.T(), token.WaitTimeout(5*time.Second))
+	assert.NoError(suite.T(), token.Error())
+
+	err = newClient.Push(context.Background(), []byte("Hello"))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+
+	select {
+	case msg := <-received:
+		assert.Equal(suite.T(), "webhooks/test", msg.Topic())
+		assert.Equal(suite.T(), []byte("Hello"), msg.Payload())
+	case <-time.After(5 * time.Second):
+		suite.T().Error("message not received")
+	}
+}
+
+func TestRunMQTTPush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mqtt testing is skiped in short version of test")
+		return
+	}
+
+	suite.Run(t, new(MQTTSetupTestSuite))
+}
+
+func TestMQTTName(t *testing.T) {
+	assert.Equal(t, "mqtt", storage{}.Name())
+}
+
+func TestClientOptions(t *testing.T) {
+	assert := assert.New(t)
+	broker := valuable.Valuable{Values: []string{"tcp://broker-1:1883", "tcp://broker-2:1883"}}
+
+	_, err := (&config{Topic: "webhooks"}).clientOptions()
+	assert.Error(err)
+
+	_, err = (&config{BrokerURL: broker}).clientOptions()
+	assert.Error(err)
+
+	_, err = (&config{BrokerURL: broker, Topic: "webhooks", QoS: 3}).clientOptions()
+	assert.Error(err)
+
+	var c = &config{BrokerURL: broker, Topic: "webhooks"}
+	options, err := c.clientOptions()
+	assert.NoError(err)
+	assert.Len(options.Servers, 2)
+	assert.Contains(options.ClientID, "webhooked-")
+	assert.True(options.AutoReconnect)
+	assert.Nil(options.TLSConfig)
+	assert.Equal(10*time.Second, c.ConnectTimeout)
+	assert.Equal(10*time.Second, c.PublishTimeout)
+	assert.Equal(time.Minute, c.MaxReconnectInterval)
+
+	options, err = (&config{
+		BrokerURL: broker,
+		ClientID:  valuable.Valuable{Values: []string{"client"}},
+		Topic:     "webhooks",
+		QoS:       2,
+		TLS:       tlsconfig.Config{Enabled: true},
+	}).clientOptions()
+	assert.NoError(err)
+	assert.Equal("client", options.ClientID)
+	assert.NotNil(options.TLSConfig)
+}
@@ -0,0 +1,153 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+
+	"atomys.codes/webhooked/internal/tlsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// storage is the struct contains client and config
+// Run is made from external caller at begins programs
+type storage struct {
+	client *sqlx.DB
+	config *config
+}
+
+// config is the struct contains config for connect client
+// Run is made from internal caller
+type config struct {
+	// DatabaseURL is the DSN used to connect to the database following the
+	// go-sql-driver format (eg: user:password@tcp(host:3306)/database)
+	DatabaseURL valuable.Valuable `mapstructure:"databaseUrl" json:"databaseUrl"`
+	// The query to perform on the database with named arguments
+	Query string `mapstructure:"query" json:"query"`
+	// The arguments to use in the query with the formatting feature (see pkg/formatting)
+	Args map[string]string `mapstructure:"args" json:"args"`
+
+	// MaxOpenConns is the maximum number of open connections to the database
+	// (default: 0, unlimited)
+	MaxOpenConns int `mapstructure:"maxOpenConns" json:"maxOpenConns"`
+	// MaxIdleConns is the maximum number of connections in the idle pool
+	// (default: 2)
+	MaxIdleConns int `mapstructure:"maxIdleConns" json:"maxIdleConns"`
+	// ConnMaxLifetime is the maximum amount of time a connection may be reused
+	// (default: 0, forever)
+	ConnMaxLifetime time.Duration `mapstructure:"connMaxLifetime" json:"connMaxLifetime"`
+	// ConnMaxIdleTime is the maximum amount of time a connection may be idle
+	// (default: 0, forever)
+	ConnMaxIdleTime time.Duration `mapstructure:"connMaxIdleTime" json:"connMaxIdleTime"`
+
+	// TLS is the TLS configuration used to connect to the database
+	TLS tlsconfig.Config `mapstructure:"tls" json:"tls"`
+}
+
+// NewStorage is the function for create new MySQL client storage
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return MySQLStorage the struct contains client connected and config
+// @return an error if the the client is not initialized successfully
+func NewStorage(configRaw map[string]interface{}) (*storage, error) {
+	newClient := storage{
+		config: &config{},
+	}
+
+	if err := valuable.Decode(configRaw, &newClient.config); err != nil {
+		return nil, err
+	}
+
+	if newClient.config.Query == "" {
+		return nil, fmt.Errorf("the query is required")
+	}
+
+	if newClient.config.Args == nil {
+		newClient.config.Args = make(map[string]string, 0)
+	}
+
+	dsn, err := driver.ParseDSN(newClient.config.DatabaseURL.First())
+	if err != nil {
+		return nil, err
+	}
+
+	if newClient.config.TLS.IsEnabled() {
+		if dsn.TLS, err = newClient.config.TLS.Load(); err != nil {
+			return nil, err
+		}
+	}
+
+	connector, err := driver.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(newClient.config.MaxOpenConns)
+	db.SetConnMaxLifetime(newClient.config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(newClient.config.ConnMaxIdleTime)
+	if newClient.config.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(newClient.config.MaxIdleConns)
+	}
+
+	newClient.client = sqlx.NewDb(db, "mysql")
+
+	// Ping MySQL for testing config
+	if err := newClient.client.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &newClient, nil
+}
+
+// Name is the function for identified if the storage config is define in the webhooks
+// Run is made from external caller
+func (c storage) Name() string {
+	return "mysql"
+}
+
+// Ping checks that the database is reachable
+func (c storage) Ping(ctx context.Context) error {
+	return c.client.PingContext(ctx)
+}
+
+// Close closes the connections to the database
+func (c storage) Close(ctx context.Context) error {
+	return c.client.Close()
+}
+
+// Push is the function for push data in the storage.
+// The data is formatted with the formatting feature and each argument is
+// rendered before being bound to the named query
+// A run is made from external caller
+// @param value that will be pushed
+// @return an error if the push failed
+func (c storage) Push(ctx context.Context, value []byte) error {
+	formatter, err := formatting.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	var namedArgs = make(map[string]interface{}, 0)
+	for name, template := range c.config.Args {
+		value, err := formatter.
+			WithPayload(value).
+			WithTemplate(template).
+			WithData("FieldName", name).
+			Render()
+		if err != nil {
+			return retry.Permanent(err)
+		}
+
+		namedArgs[name] = value
+	}
+
+	_, err = c.client.NamedExecContext(ctx, c.config.Query, namedArgs)
+	return err
+}
@@ -0,0 +1,128 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+type MySQLSetupTestSuite struct {
+	suite.Suite
+	client      *sqlx.DB
+	databaseUrl string
+	ctx         context.Context
+}
+
+// Create Table for running test
+func (suite *MySQLSetupTestSuite) BeforeTest(suiteName, testName string) {
+	var err error
+
+	suite.databaseUrl = fmt.Sprintf(
+		"%s:%s@tcp(%s:%s)/%s",
+		os.Getenv("MYSQL_USER"),
+		os.Getenv("MYSQL_PASSWORD"),
+		os.Getenv("MYSQL_HOST"),
+		os.Getenv("MYSQL_PORT"),
+		os.Getenv("MYSQL_DATABASE"),
+	)
+
+	if suite.client, err = sqlx.Open("mysql", suite.databaseUrl); err != nil {
+		suite.T().Error(err)
+	}
+	if _, err := suite.client.Exec("CREATE TABLE test (test_field TEXT)"); err != nil {
+		suite.T().Error(err)
+	}
+
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().WithTemplate("{{.}}"),
+	)
+}
+
+// Delete Table after test
+func (suite *MySQLSetupTestSuite) AfterTest(suiteName, testName string) {
+	if _, err := suite.client.Exec("DROP TABLE test"); err != nil {
+		suite.T().Error(err)
+	}
+}
+
+func (suite *MySQLSetupTestSuite) TestMySQLName() {
+	newMySQL := storage{}
+	assert.Equal(suite.T(), "mysql", newMySQL.Name())
+}
+
+func (suite *MySQLSetupTestSuite) TestMySQLNewStorage() {
+	_, err := NewStorage(map[string]interface{}{
+		"databaseUrl": []int{1},
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl": "invalid dsn",
+		"query":       "INSERT INTO test (test_field) VALUES (:field)",
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+		"query":       "INSERT INTO test (test_field) VALUES (:field)",
+		"tls": map[string]interface{}{
+			"ca": "/not/exist.pem",
+		},
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"databaseUrl":     suite.databaseUrl,
+		"query":           "INSERT INTO test (test_field) VALUES (:field)",
+		"maxOpenConns":    10,
+		"maxIdleConns":    5,
+		"connMaxLifetime": "5m",
+		"connMaxIdleTime": "1m",
+	})
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *MySQLSetupTestSuite) TestMySQLPush() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"databaseUrl": suite.databaseUrl,
+		"query":       "INSERT INTO test (test_field) VALUES (:field)",
+		"args": map[string]string{
+			"field": "{{.Payload}}",
+		},
+	})
+	assert.NoError(suite.T(), err)
+
+	err = newClient.Push(context.Background(), []byte("Hello"))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	fakePayload := []byte("A strange payload")
+	err = newClient.Push(suite.ctx, fakePayload)
+	assert.NoError(suite.T(), err)
+
+	var result string
+	err = suite.client.Get(&result, "SELECT test_field FROM test")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), string(fakePayload), result)
+}
+
+func TestRunMySQLPush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql testing is skiped in short version of test")
+		return
+	}
+
+	suite.Run(t, new(MySQLSetupTestSuite))
+}
@@ -0,0 +1,463 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// batchConfig is the struct contains the configuration of the batch mode
+type batchConfig struct {
+	// Enabled buffers the rows rendered from the args and inserts them in
+	// batch instead of running the query for each push
+	Enabled bool `mapstructure:"enabled" json:"enabled"`
+	// Table is the table where the rows are inserted, the columns are the
+	// names of the args. The table can be prefixed by its schema
+	Table string `mapstructure:"table" json:"table"`
+	// Method is the method used to insert the rows: copy uses the COPY
+	// protocol, insert uses multi-row INSERT statements (default: copy)
+	Method string `mapstructure:"method" json:"method"`
+	// Size is the number of rows that triggers the flush of the batch
+	// (default: 1000)
+	Size int `mapstructure:"size" json:"size"`
+	// FlushInterval is the maximum duration between two flushes
+	// (default: 1s)
+	FlushInterval time.Duration `mapstructure:"flushInterval" json:"flushInterval"`
+	// Timeout is the maximum duration of each flush (default: 10s)
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout"`
+	// Async acknowledges the push as soon as the row is buffered instead of
+	// waiting for its flush. The rows of the failed flushes are kept for the
+	// next flush, and lost if the process stops before. The rows rejected by
+	// the database are dropped and logged, see MaxAttempts (default: false)
+	Async bool `mapstructure:"async" json:"async"`
+	// MaxBufferSize is the maximum number of rows kept in memory, including
+	// the rows of the failed flushes in async mode. The push fails when the
+	// buffer is full (default: 10 times the batch size)
+	MaxBufferSize int `mapstructure:"maxBufferSize" json:"maxBufferSize"`
+	// MaxAttempts is the maximum number of flushes failing for a row alone
+	// while the database is reachable in async mode, the row is then
+	// dropped and logged. The rows rejected by the database are dropped
+	// without waiting for the max attempts (default: 5)
+	MaxAttempts int `mapstructure:"maxAttempts" json:"maxAttempts"`
+}
+
+const (
+	// batchMethodCopy inserts the rows with the COPY protocol
+	batchMethodCopy = "copy"
+	// batchMethodInsert inserts the rows with multi-row INSERT statements
+	batchMethodInsert = "insert"
+
+	// maxParameters is the maximum number of parameters of a statement
+	// supported by postgres
+	maxParameters = 65535
+)
+
+// errBufferFull is returned when the buffer cannot receive more rows
+// because the database is not reachable
+var errBufferFull = errors.New("postgres buffer is full, the rows cannot be flushed")
+
+// errBatchClosed is returned when a row is pushed after the close of the
+// storage
+var errBatchClosed = errors.New("postgres batch is closed")
+
+// batchRow is a row waiting for the next flush
+type batchRow struct {
+	values []interface{}
+	// result receives the result of the flush of the row, nil in async mode
+	result chan error
+	// err is the error of the last insert of the row alone, see split
+	err error
+	// attempts is the number of flushes failing for the row alone
+	attempts int
+}
+
+// batcher buffers the rows and inserts them when the batch size is reached
+// or when the flush interval is elapsed
+type batcher struct {
+	config *batchConfig
+	// insert inserts the rows in a single transaction
+	insert func(ctx context.Context, rows [][]interface{}) error
+	// ping checks that the database is reachable after a failed insert
+	ping func(ctx context.Context) error
+
+	mu sync.Mutex // protect following fields
+	// rows contains the rows waiting for the next flush
+	rows   []*batchRow
+	closed bool
+
+	// full is notified when the batch size is reached
+	full chan struct{}
+	// done is closed when the batcher is closed
+	done chan struct{}
+	// stopped is closed when the flush loop is stopped
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// validate checks the batch configuration and sets the default values
+func (c *batchConfig) validate() error {
+	if c.Table == "" {
+		return fmt.Errorf("the table is required when the batch is enabled")
+	}
+
+	switch c.Method {
+	case "":
+		c.Method = batchMethodCopy
+	case batchMethodCopy, batchMethodInsert:
+	default:
+		return fmt.Errorf("invalid batch method %s, must be %s or %s", c.Method, batchMethodCopy, batchMethodInsert)
+	}
+
+	if c.Size <= 0 {
+		c.Size = 1000
+	}
+
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = time.Second
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+
+	if c.MaxBufferSize <= 0 {
+		c.MaxBufferSize = 10 * c.Size
+	}
+
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+
+	return nil
+}
+
+// newBatcher creates the batcher and starts its flush loop
+func newBatcher(config *batchConfig, insert func(ctx context.Context, rows [][]interface{}) error, ping func(ctx context.Context) error) *batcher {
+	b := &batcher{
+		config:  config,
+		insert:  insert,
+		ping:    ping,
+		full:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go b.run()
+	return b
+}
+
+// add buffers the row. In sync mode, the function waits for the flush of
+// the row and returns its result. When the context is done first, the row
+// is removed from the buffer and not inserted. A row already taken by a
+// flush cannot be removed, its result is awaited to not report a failure
+// for an inserted row
+func (b *batcher) add(ctx context.Context, values []interface{}) error {
+	row := &batchRow{values: values}
+	if !b.config.Async {
+		row.result = make(chan error, 1)
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errBatchClosed
+	}
+
+	if len(b.rows) >= b.config.MaxBufferSize {
+		b.mu.Unlock()
+		return errBufferFull
+	}
+
+	if b.rows = append(b.rows, row); len(b.rows) >= b.config.Size {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	b.mu.Unlock()
+
+	if row.result == nil {
+		return nil
+	}
+
+	select {
+	case err := <-row.result:
+		return err
+	case <-ctx.Done():
+	}
+
+	if b.remove(row) {
+		return ctx.Err()
+	}
+	return <-row.result
+}
+
+// remove removes the row from the buffer, it returns false when the row
+// is not buffered anymore
+func (b *batcher) remove(row *batchRow) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, buffered := range b.rows {
+		if buffered == row {
+			b.rows = append(b.rows[:i:i], b.rows[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// close stops the flush loop and flushes the remaining rows
+func (b *batcher) close(ctx context.Context) error {
+	var err error
+	b.closeOnce.Do(func() {
+		b.mu.Lock()
+		b.closed = true
+		b.mu.Unlock()
+
+		close(b.done)
+		<-b.stopped
+
+		err = b.flush(ctx)
+	})
+	return err
+}
+
+// run flushes the batch when the batch size is reached or when the flush
+// interval is elapsed, until the batcher is closed
+func (b *batcher) run() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		case <-b.full:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.config.Timeout)
+		if err := b.flush(ctx); err != nil {
+			log.Error().Err(err).Msg("cannot flush the postgres batch")
+		}
+		cancel()
+	}
+}
+
+// flush inserts the buffered rows and reports the result to the waiting
+// pushes. When the database rejects the batch or is still reachable, the
+// batch is split to insert the valid rows and to isolate the failed ones.
+// The rows rejected by the database are dropped, the rows of the async
+// pushes failing with a transient error are kept in the buffer for the next
+// flush until their max attempts. When the database is not reachable, they
+// are kept without counting the attempt
+func (b *batcher) flush(ctx context.Context) error {
+	b.mu.Lock()
+	rows := b.rows
+	b.rows = nil
+	b.mu.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	err := b.insertRows(ctx, rows)
+	if err == nil {
+		b.report(rows, nil)
+		return nil
+	}
+
+	var failed = rows
+	if !retry.IsRetryable(err) || b.ping(ctx) == nil {
+		failed = b.split(ctx, rows, err)
+		b.report(rows, failed)
+	} else {
+		for _, row := range rows {
+			row.err = err
+		}
+	}
+
+	var kept []*batchRow
+	for _, row := range failed {
+		switch {
+		case row.result != nil:
+			row.result <- row.err
+		case !retry.IsRetryable(row.err):
+			log.Error().Err(row.err).Interface("row", row.values).Msg("postgres row rejected, row dropped")
+		case row.attempts >= b.config.MaxAttempts:
+			log.Error().Err(row.err).Interface("row", row.values).Msgf("postgres row failed %d times, row dropped", row.attempts)
+		default:
+			kept = append(kept, row)
+		}
+	}
+
+	if len(kept) > 0 {
+		b.mu.Lock()
+		b.rows = append(kept, b.rows...)
+		b.mu.Unlock()
+	}
+
+	return err
+}
+
+// split inserts the halves of the rejected rows separately, recursively,
+// and returns the rows failing alone with their error. The attempts of the
+// rows failing alone with a transient error are counted. The rows not
+// inserted before the context is done are returned with the error
+func (b *batcher) split(ctx context.Context, rows []*batchRow, err error) []*batchRow {
+	if len(rows) == 1 && retry.IsRetryable(err) {
+		rows[0].attempts++
+	}
+
+	if len(rows) <= 1 || ctx.Err() != nil {
+		for _, row := range rows {
+			row.err = err
+		}
+		return rows
+	}
+
+	var failed []*batchRow
+	for _, half := range [][]*batchRow{rows[:len(rows)/2], rows[len(rows)/2:]} {
+		if err := b.insertRows(ctx, half); err != nil {
+			failed = append(failed, b.split(ctx, half, err)...)
+		}
+	}
+	return failed
+}
+
+// insertRows inserts the values of the rows
+func (b *batcher) insertRows(ctx context.Context, rows []*batchRow) error {
+	var values = make([][]interface{}, len(rows))
+	for i, row := range rows {
+		values[i] = row.values
+	}
+	return b.insert(ctx, values)
+}
+
+// report sends the success to the waiting pushes of the rows that are not
+// failed
+func (b *batcher) report(rows, failed []*batchRow) {
+	var isFailed = make(map[*batchRow]bool, len(failed))
+	for _, row := range failed {
+		isFailed[row] = true
+	}
+
+	for _, row := range rows {
+		if row.result != nil && !isFailed[row] {
+			row.result <- nil
+		}
+	}
+}
+
+// copyIn inserts the rows with the COPY protocol in a single transaction
+func copyIn(ctx context.Context, db *sqlx.DB, table string, columns []string, rows [][]interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	var query string
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		query = pq.CopyInSchema(schema, name, columns...)
+	} else {
+		query = pq.CopyIn(table, columns...)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	// the empty exec sends the buffered rows to the server
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertMany inserts the rows with multi-row INSERT statements in a single
+// transaction. The rows are split to respect the parameters limit
+func insertMany(ctx context.Context, db *sqlx.DB, table string, columns []string, rows [][]interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	chunkSize := maxParameters / len(columns)
+	for start := 0; start < len(rows); start += chunkSize {
+		end := start + chunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		query, args := insertQuery(table, columns, rows[start:end])
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// insertQuery returns the multi-row INSERT statement of the rows and its
+// arguments
+func insertQuery(table string, columns []string, rows [][]interface{}) (string, []interface{}) {
+	var quotedColumns = make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = pq.QuoteIdentifier(column)
+	}
+
+	var quotedTable = make([]string, 0, 2)
+	for _, part := range strings.SplitN(table, ".", 2) {
+		quotedTable = append(quotedTable, pq.QuoteIdentifier(part))
+	}
+
+	var query strings.Builder
+	var args = make([]interface{}, 0, len(rows)*len(columns))
+	fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", strings.Join(quotedTable, "."), strings.Join(quotedColumns, ", "))
+
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+
+		query.WriteByte('(')
+		for j, value := range row {
+			if j > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, value)
+			fmt.Fprintf(&query, "$%d", len(args))
+		}
+		query.WriteByte(')')
+	}
+
+	return query.String(), args
+}
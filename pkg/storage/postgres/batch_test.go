@@ -0,0 +1,234 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/pkg/storage/retry"
+)
+
+// fakeInserter records the inserted rows and fails on demand. The inserts
+// containing a row with a key of rejected fail with its error
+type fakeInserter struct {
+	mu       sync.Mutex
+	fail     bool
+	rejected map[string]error
+	rows     [][]interface{}
+}
+
+func (f *fakeInserter) insert(ctx context.Context, rows [][]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fail {
+		return errors.New("connection refused")
+	}
+	for _, row := range rows {
+		if err, ok := f.rejected[row[0].(string)]; ok {
+			return err
+		}
+	}
+	f.rows = append(f.rows, rows...)
+	return nil
+}
+
+func (f *fakeInserter) ping(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fail {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (f *fakeInserter) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeInserter) inserted() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.rows)
+}
+
+func newTestBatcher(inserter *fakeInserter, config batchConfig) *batcher {
+	config.Table = "test"
+	_ = config.validate()
+	return newBatcher(&config, inserter.insert, inserter.ping)
+}
+
+func TestBatcherSync(t *testing.T) {
+	assert := assert.New(t)
+	inserter := &fakeInserter{}
+	b := newTestBatcher(inserter, batchConfig{Size: 2, FlushInterval: time.Hour})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(b.add(context.Background(), []interface{}{"Hello"}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(2, inserter.inserted())
+
+	// the rows of the canceled pushes are removed from the buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(b.add(ctx, []interface{}{"Hello"}), context.DeadlineExceeded)
+	assert.NoError(b.close(context.Background()))
+	assert.Equal(2, inserter.inserted())
+
+	assert.ErrorIs(b.add(context.Background(), []interface{}{"Hello"}), errBatchClosed)
+}
+
+func TestBatcherSyncFailure(t *testing.T) {
+	assert := assert.New(t)
+	inserter := &fakeInserter{fail: true}
+	b := newTestBatcher(inserter, batchConfig{Size: 1, FlushInterval: time.Hour})
+
+	// the failed rows are reported to the pushes and not retried
+	assert.Error(b.add(context.Background(), []interface{}{"Hello"}))
+	assert.NoError(b.close(context.Background()))
+	assert.Equal(0, inserter.inserted())
+}
+
+func TestBatcherSyncCanceledDuringFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	var started, unblock = make(chan struct{}), make(chan struct{})
+	b := newBatcher(&batchConfig{Table: "test", Size: 1, FlushInterval: time.Hour, Timeout: time.Second, MaxBufferSize: 10}, func(ctx context.Context, rows [][]interface{}) error {
+		close(started)
+		<-unblock
+		return nil
+	}, (&fakeInserter{}).ping)
+
+	// the row taken by the flush is inserted, its result is returned
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		close(unblock)
+	}()
+	assert.NoError(b.add(ctx, []interface{}{"Hello"}))
+	assert.NoError(b.close(context.Background()))
+}
+
+func TestBatcherFlushInterval(t *testing.T) {
+	assert := assert.New(t)
+	inserter := &fakeInserter{}
+	b := newTestBatcher(inserter, batchConfig{Size: 100, FlushInterval: 20 * time.Millisecond})
+
+	assert.NoError(b.add(context.Background(), []interface{}{"Hello"}))
+	assert.Equal(1, inserter.inserted())
+	assert.NoError(b.close(context.Background()))
+}
+
+func TestBatcherAsync(t *testing.T) {
+	assert := assert.New(t)
+	inserter := &fakeInserter{fail: true}
+	b := newTestBatcher(inserter, batchConfig{Size: 2, FlushInterval: time.Hour, MaxBufferSize: 3, Async: true})
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(b.add(context.Background(), []interface{}{"Hello"}))
+	}
+
+	// the failed flushes keep the rows in the buffer until it is full
+	assert.ErrorIs(b.add(context.Background(), []interface{}{"Hello"}), errBufferFull)
+	assert.Equal(0, inserter.inserted())
+
+	inserter.setFail(false)
+	assert.NoError(b.close(context.Background()))
+	assert.Equal(3, inserter.inserted())
+	assert.NoError(b.close(context.Background()))
+}
+
+func TestBatcherRejectedRows(t *testing.T) {
+	assert := assert.New(t)
+	inserter := &fakeInserter{rejected: map[string]error{
+		"invalid": retry.Permanent(errors.New("invalid input syntax")),
+		"failing": errors.New("could not serialize access"),
+	}}
+	b := newTestBatcher(inserter, batchConfig{Size: 100, FlushInterval: time.Hour, Async: true, MaxAttempts: 2})
+
+	for _, value := range []string{"a", "invalid", "b", "failing", "c"} {
+		assert.NoError(b.add(context.Background(), []interface{}{value}))
+	}
+
+	// the batch is split, the valid rows are inserted and the rejected row
+	// is dropped. The row failing alone is kept until its max attempts
+	assert.Error(b.flush(context.Background()))
+	assert.Equal(3, inserter.inserted())
+	assert.Len(b.rows, 1)
+	assert.Equal(1, b.rows[0].attempts)
+
+	assert.Error(b.flush(context.Background()))
+	assert.Len(b.rows, 0)
+	assert.NoError(b.close(context.Background()))
+	assert.Equal(3, inserter.inserted())
+}
+
+func TestBatcherSyncRejectedRows(t *testing.T) {
+	assert := assert.New(t)
+	inserter := &fakeInserter{rejected: map[string]error{
+		"invalid": retry.Permanent(errors.New("invalid input syntax")),
+	}}
+	b := newTestBatcher(inserter, batchConfig{Size: 2, FlushInterval: time.Hour})
+
+	// only the push of the rejected row fails
+	var results = make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, value := range []string{"valid", "invalid"} {
+		wg.Add(1)
+		go func(value string) {
+			defer wg.Done()
+			err := b.add(context.Background(), []interface{}{value})
+			mu.Lock()
+			results[value] = err
+			mu.Unlock()
+		}(value)
+	}
+	wg.Wait()
+
+	assert.NoError(results["valid"])
+	assert.False(retry.IsRetryable(results["invalid"]))
+	assert.Equal(1, inserter.inserted())
+	assert.NoError(b.close(context.Background()))
+}
+
+func TestBatchConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error((&batchConfig{}).validate())
+	assert.Error((&batchConfig{Table: "test", Method: "unknown"}).validate())
+
+	c := &batchConfig{Table: "test"}
+	assert.NoError(c.validate())
+	assert.Equal(batchMethodCopy, c.Method)
+	assert.Equal(1000, c.Size)
+	assert.Equal(time.Second, c.FlushInterval)
+	assert.Equal(10*time.Second, c.Timeout)
+	assert.Equal(10000, c.MaxBufferSize)
+	assert.Equal(5, c.MaxAttempts)
+}
+
+func TestInsertQuery(t *testing.T) {
+	query, args := insertQuery("public.test", []string{"event", "payload"}, [][]interface{}{
+		{"push", "Hello"},
+		{"pull", "World"},
+	})
+
+	assert.Equal(t, `INSERT INTO "public"."test" ("event", "payload") VALUES ($1, $2), ($3, $4)`, query)
+	assert.Equal(t, []interface{}{"push", "Hello", "pull", "World"}, args)
+}
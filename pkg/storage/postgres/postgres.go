@@ -2,14 +2,22 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
 
+	"atomys.codes/webhooked/internal/tlsconfig"
 	"atomys.codes/webhooked/internal/valuable"
 	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+	"atomys.codes/webhooked/pkg/storage/retry"
 )
 
 // storage is the struct contains client and config
@@ -17,6 +25,16 @@ import (
 type storage struct {
 	client *sqlx.DB
 	config *config
+
+	mu sync.Mutex // protect following field
+	// stmt is the named statement of the query, prepared once and reused
+	// by each push
+	stmt *sqlx.NamedStmt
+
+	// columns is the sorted list of the args inserted in batch mode
+	columns []string
+	// batcher buffers the rows in batch mode
+	batcher *batcher
 }
 
 // config is the struct contains config for connect client
@@ -33,16 +51,48 @@ type config struct {
 	Query string `mapstructure:"query" json:"query"`
 	// The arguments to use in the query with the formatting feature (see pkg/formatting)
 	Args map[string]string `mapstructure:"args" json:"args"`
+	// DedupKey is the deduplication key of the payload, rendered with the
+	// formatting feature and bound to the `:dedupKey` named argument. Used
+	// with an `ON CONFLICT (...) DO NOTHING` clause, a payload already stored
+	// is ignored without error
+	DedupKey string `mapstructure:"dedupKey" json:"dedupKey"`
+
+	// MaxOpenConns is the maximum number of open connections to the database
+	// (default: 0, unlimited)
+	MaxOpenConns int `mapstructure:"maxOpenConns" json:"maxOpenConns"`
+	// MaxIdleConns is the maximum number of connections in the idle pool
+	// (default: 2)
+	MaxIdleConns int `mapstructure:"maxIdleConns" json:"maxIdleConns"`
+	// ConnMaxLifetime is the maximum amount of time a connection may be reused
+	// (default: 0, forever)
+	ConnMaxLifetime time.Duration `mapstructure:"connMaxLifetime" json:"connMaxLifetime"`
+	// ConnMaxIdleTime is the maximum amount of time a connection may be idle
+	// (default: 0, forever)
+	ConnMaxIdleTime time.Duration `mapstructure:"connMaxIdleTime" json:"connMaxIdleTime"`
+	// PingOnStartup checks the connection and prepares the query when the
+	// storage is created. When disabled, the query is prepared on the first
+	// push (default: true)
+	PingOnStartup *bool `mapstructure:"pingOnStartup" json:"pingOnStartup"`
+
+	// Batch is the configuration of the batch mode, inserting the rows
+	// rendered from the args with COPY or multi-row inserts
+	Batch batchConfig `mapstructure:"batch" json:"batch"`
+
+	// TLS is the TLS configuration used to connect to the database. The
+	// certificates can be file paths or PEM contents, the PEM contents
+	// require a client certificate
+	TLS tlsconfig.Config `mapstructure:"tls" json:"tls"`
 }
 
+// dedupKeyArg is the named argument receiving the rendered deduplication key
+const dedupKeyArg = "dedupKey"
+
 // NewStorage is the function for create new Postgres client storage
 // Run is made from external caller at begins programs
 // @param config contains config define in the webhooks yaml file
 // @return PostgresStorage the struct contains client connected and config
 // @return an error if the the client is not initialized successfully
 func NewStorage(configRaw map[string]interface{}) (*storage, error) {
-	var err error
-
 	newClient := storage{
 		config: &config{},
 	}
@@ -61,25 +111,146 @@ func NewStorage(configRaw map[string]interface{}) (*storage, error) {
 			return nil, fmt.Errorf("the formatting feature is enabled, the TableName and DataField are deprecated and cannot be used in the same time")
 		}
 
-		if newClient.config.Query == "" {
+		if newClient.config.Query == "" && !newClient.config.Batch.Enabled {
 			return nil, fmt.Errorf("the query is required when the formatting feature is enabled")
 		}
 
 		if newClient.config.Args == nil {
 			newClient.config.Args = make(map[string]string, 0)
 		}
+
+		if newClient.config.DedupKey != "" && !strings.Contains(newClient.config.Query, ":"+dedupKeyArg) {
+			return nil, fmt.Errorf("the query must use the :%s argument when the dedupKey is defined", dedupKeyArg)
+		}
 	}
 
-	if newClient.client, err = sqlx.Open("postgres", newClient.config.DatabaseURL.First()); err != nil {
+	if newClient.config.Batch.Enabled {
+		if err := newClient.config.validateBatch(); err != nil {
+			return nil, err
+		}
+
+		for name := range newClient.config.Args {
+			newClient.columns = append(newClient.columns, name)
+		}
+		sort.Strings(newClient.columns)
+	}
+
+	dsn, err := newClient.config.dataSourceName()
+	if err != nil {
 		return nil, err
 	}
 
+	if newClient.client, err = sqlx.Open("postgres", dsn); err != nil {
+		return nil, err
+	}
+
+	newClient.client.SetMaxOpenConns(newClient.config.MaxOpenConns)
+	newClient.client.SetConnMaxLifetime(newClient.config.ConnMaxLifetime)
+	newClient.client.SetConnMaxIdleTime(newClient.config.ConnMaxIdleTime)
+	if newClient.config.MaxIdleConns != 0 {
+		newClient.client.SetMaxIdleConns(newClient.config.MaxIdleConns)
+	}
+
+	if newClient.config.PingOnStartup == nil || *newClient.config.PingOnStartup {
+		// Ping Postgres for testing config
+		if err := newClient.client.Ping(); err != nil {
+			newClient.client.Close()
+			return nil, err
+		}
+
+		if newClient.config.UseFormattingToPerformQuery && !newClient.config.Batch.Enabled {
+			if _, err := newClient.statement(context.Background()); err != nil {
+				newClient.client.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if newClient.config.Batch.Enabled {
+		newClient.batcher = newBatcher(&newClient.config.Batch, newClient.insert, newClient.client.PingContext)
+	}
+
 	return &newClient, nil
 }
 
+// validateBatch checks that the batch mode can be used with the
+// configuration and sets its default values
+func (c *config) validateBatch() error {
+	if !c.UseFormattingToPerformQuery {
+		return fmt.Errorf("the formatting feature is required when the batch is enabled")
+	}
+
+	if len(c.Args) == 0 {
+		return fmt.Errorf("the args are required when the batch is enabled")
+	}
+
+	if c.DedupKey != "" {
+		return fmt.Errorf("the dedupKey cannot be used when the batch is enabled")
+	}
+
+	return c.Batch.validate()
+}
+
+// dataSourceName returns the DSN of the database with the TLS parameters
+// of lib/pq when the TLS is enabled
+func (c *config) dataSourceName() (string, error) {
+	dsn := c.DatabaseURL.First()
+	if !c.TLS.IsEnabled() {
+		return dsn, nil
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return "", err
+		}
+	}
+
+	var params = map[string]string{
+		"sslmode": "verify-full",
+	}
+	if c.TLS.InsecureSkipVerify {
+		params["sslmode"] = "require"
+	}
+
+	ca, cert, key := c.TLS.CA.First(), c.TLS.Cert.First(), c.TLS.Key.First()
+	if (cert == "") != (key == "") {
+		return "", errors.New("both cert and key must be defined to use a client certificate")
+	}
+
+	// lib/pq reads the certificates from files, or from the parameters with
+	// sslinline which requires a client certificate
+	if tlsconfig.IsPEM(ca) || tlsconfig.IsPEM(cert) || tlsconfig.IsPEM(key) {
+		if cert == "" || !tlsconfig.IsPEM(cert) || !tlsconfig.IsPEM(key) || (ca != "" && !tlsconfig.IsPEM(ca)) {
+			return "", errors.New("the PEM contents require a client certificate and cannot be mixed with file paths")
+		}
+		params["sslinline"] = "true"
+	}
+
+	if ca != "" {
+		params["sslrootcert"] = ca
+	}
+	if cert != "" {
+		params["sslcert"] = cert
+		params["sslkey"] = key
+	}
+
+	for _, name := range []string{"sslmode", "sslinline", "sslrootcert", "sslcert", "sslkey"} {
+		value, ok := params[name]
+		if !ok {
+			continue
+		}
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		value = strings.ReplaceAll(value, `'`, `\'`)
+		dsn += fmt.Sprintf(" %s='%s'", name, value)
+	}
+
+	return strings.TrimSpace(dsn), nil
+}
+
 // Name is the function for identified if the storage config is define in the webhooks
 // Run is made from external caller
-func (c storage) Name() string {
+func (c *storage) Name() string {
 	return "postgres"
 }
 
@@ -89,14 +260,12 @@ func (c storage) Name() string {
 // A run is made from external caller
 // @param value that will be pushed
 // @return an error if the push failed
-func (c storage) Push(ctx context.Context, value []byte) error {
+func (c *storage) Push(ctx context.Context, value []byte) error {
 	// ! Deprecation notice: End of life in v1.0.0
 	if !c.config.UseFormattingToPerformQuery {
 		request := fmt.Sprintf("INSERT INTO %s(%s) VALUES ($1)", c.config.TableName, c.config.DataField)
-		if _, err := c.client.Query(request, value); err != nil {
-			return err
-		}
-		return nil
+		_, err := c.client.ExecContext(ctx, request, value)
+		return err
 	}
 
 	formatter, err := formatting.FromContext(ctx)
@@ -104,12 +273,57 @@ func (c storage) Push(ctx context.Context, value []byte) error {
 		return err
 	}
 
-	stmt, err := c.client.PrepareNamedContext(ctx, c.config.Query)
+	namedArgs, err := c.renderArgs(formatter, value)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	if c.batcher != nil {
+		var row = make([]interface{}, len(c.columns))
+		for i, column := range c.columns {
+			row[i] = namedArgs[column]
+		}
+		return c.batcher.add(ctx, row)
+	}
+
+	stmt, err := c.statement(ctx)
 	if err != nil {
 		return err
 	}
 
-	var namedArgs = make(map[string]interface{}, 0)
+	if c.config.DedupKey != "" {
+		dedupKey, err := formatter.
+			WithPayload(value).
+			WithTemplate(c.config.DedupKey).
+			WithData("FieldName", dedupKeyArg).
+			Render()
+		if err != nil {
+			return retry.Permanent(err)
+		}
+
+		if strings.TrimSpace(dedupKey) == "" {
+			return retry.Permanent(fmt.Errorf("the rendered dedupKey is empty"))
+		}
+		namedArgs[dedupKeyArg] = dedupKey
+	}
+
+	result, err := stmt.ExecContext(ctx, namedArgs)
+	if err != nil {
+		return classifyError(err)
+	}
+
+	if c.config.DedupKey != "" {
+		if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+			log.Debug().Msgf("payload with dedup key %v already stored, ignored", namedArgs[dedupKeyArg])
+		}
+	}
+
+	return nil
+}
+
+// renderArgs renders the args of the query with the payload
+func (c *storage) renderArgs(formatter *formatting.Formatter, value []byte) (map[string]interface{}, error) {
+	var namedArgs = make(map[string]interface{}, len(c.config.Args))
 	for name, template := range c.config.Args {
 		value, err := formatter.
 			WithPayload(value).
@@ -117,12 +331,98 @@ func (c storage) Push(ctx context.Context, value []byte) error {
 			WithData("FieldName", name).
 			Render()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		namedArgs[name] = value
 	}
 
-	_, err = stmt.QueryContext(ctx, namedArgs)
-	return err
+	return namedArgs, nil
+}
+
+// insert inserts the rows of the batch with the configured method. The
+// errors caused by the rows are permanent, see classifyError
+func (c *storage) insert(ctx context.Context, rows [][]interface{}) error {
+	if c.config.Batch.Method == batchMethodInsert {
+		return classifyError(insertMany(ctx, c.client, c.config.Batch.Table, c.columns, rows))
+	}
+	return classifyError(copyIn(ctx, c.client, c.config.Batch.Table, c.columns, rows))
+}
+
+// statement returns the prepared statement of the query, preparing it on
+// the first call. A failed preparation is retried on the next call
+func (c *storage) statement(ctx context.Context) (*sqlx.NamedStmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stmt != nil {
+		return c.stmt, nil
+	}
+
+	stmt, err := c.client.PrepareNamedContext(ctx, c.config.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.stmt = stmt
+	return stmt, nil
+}
+
+// Ping checks that the database is reachable
+func (c *storage) Ping(ctx context.Context) error {
+	return c.client.PingContext(ctx)
+}
+
+// Capabilities returns the capabilities of the storage according to its
+// configuration
+func (c *storage) Capabilities() []capability.Capability {
+	var capabilities []capability.Capability
+	if c.batcher != nil {
+		capabilities = append(capabilities, capability.Batch, capability.Transaction)
+	}
+	if c.config.DedupKey != "" {
+		capabilities = append(capabilities, capability.Deduplication)
+	}
+	return capabilities
+}
+
+// Close flushes the remaining rows of the batch, then closes the prepared
+// statement and the connections to the database
+func (c *storage) Close(ctx context.Context) error {
+	var flushErr error
+	if c.batcher != nil {
+		flushErr = c.batcher.close(ctx)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stmt != nil {
+		c.stmt.Close()
+		c.stmt = nil
+	}
+
+	if err := c.client.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// classifyError marks the errors caused by the payload or the query as
+// permanent, retrying them cannot succeed. The errors of the other classes
+// (connection, resources, ...) are transient
+func classifyError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	switch pqErr.Code.Class() {
+	case "22", // data exception
+		"23", // integrity constraint violation
+		"42": // syntax error or access rule violation
+		return retry.Permanent(err)
+	default:
+		return err
+	}
 }
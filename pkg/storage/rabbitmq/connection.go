@@ -0,0 +1,292 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
+)
+
+// connectionManager owns the connection to the broker and a bounded pool of
+// channels. It reconnects with an exponential backoff when the connection
+// is lost and declares the topology again on each new connection.
+// All methods are safe for concurrent use
+type connectionManager struct {
+	url string
+	// declare is called on a dedicated channel of each new connection to
+	// declare the exchanges, queues and bindings
+	declare func(ch *amqp.Channel) error
+	// setup is called on each new channel before its first use
+	setup func(ch *pooledChannel) error
+
+	reconnectInterval    time.Duration
+	reconnectMaxInterval time.Duration
+
+	mu sync.RWMutex // protect following fields
+	// conn is the current connection, nil while reconnecting
+	conn *amqp.Connection
+	// connected is closed when a connection is available
+	connected chan struct{}
+
+	// slots limits the number of channels opened at the same time
+	slots chan struct{}
+	// idle contains the channels available for the next publish
+	idle chan *pooledChannel
+	// done is closed when the manager is closed
+	done chan struct{}
+	// closeOnce guards the close of the manager, the storage can be closed
+	// more than once
+	closeOnce sync.Once
+}
+
+// pooledChannel is a channel of the pool with its notification channels
+type pooledChannel struct {
+	*amqp.Channel
+	closed   chan *amqp.Error
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+// errManagerClosed is returned when a channel is requested after the
+// manager has been closed
+var errManagerClosed = errors.New("rabbitmq connection manager is closed")
+
+// newConnectionManager dials the broker, declares the topology and starts
+// watching the connection to reconnect it when lost
+func newConnectionManager(url string, poolSize int, reconnectInterval, reconnectMaxInterval time.Duration, declare func(ch *amqp.Channel) error, setup func(ch *pooledChannel) error) (*connectionManager, error) {
+	m := &connectionManager{
+		url:                  url,
+		declare:              declare,
+		setup:                setup,
+		reconnectInterval:    reconnectInterval,
+		reconnectMaxInterval: reconnectMaxInterval,
+		connected:            make(chan struct{}),
+		slots:                make(chan struct{}, poolSize),
+		idle:                 make(chan *pooledChannel, poolSize),
+		done:                 make(chan struct{}),
+	}
+
+	conn, err := m.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	m.setConnection(conn)
+	return m, nil
+}
+
+// connect dials a new connection and declares the topology on it
+func (m *connectionManager) connect() (*amqp.Connection, error) {
+	conn, err := amqp.Dial(m.url)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer ch.Close()
+
+	if err := m.declare(ch); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// setConnection makes the given connection the current one and watches it
+func (m *connectionManager) setConnection(conn *amqp.Connection) {
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	m.mu.Lock()
+	m.conn = conn
+	close(m.connected)
+	m.mu.Unlock()
+
+	go m.watch(conn, closed)
+}
+
+// watch waits for the close of the current connection and reconnects it
+// with an exponential backoff until the manager is closed
+func (m *connectionManager) watch(conn *amqp.Connection, closed chan *amqp.Error) {
+	reason := <-closed
+	m.lost(conn)
+
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+
+	log.Warn().Msgf("connection to rabbitmq closed, reason: %v", reason)
+
+	interval := m.reconnectInterval
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-time.After(interval):
+		}
+
+		conn, err := m.connect()
+		if err == nil {
+			log.Info().Msg("reconnected to rabbitmq")
+			m.setConnection(conn)
+			return
+		}
+
+		log.Error().Err(err).Msgf("reconnect to rabbitmq failed, retrying in %s", interval)
+		if interval *= 2; interval > m.reconnectMaxInterval {
+			interval = m.reconnectMaxInterval
+		}
+	}
+}
+
+// lost marks the given connection as lost when it is still the current one,
+// the next channels will wait for the reconnection
+func (m *connectionManager) lost(conn *amqp.Connection) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == conn {
+		m.conn = nil
+		m.connected = make(chan struct{})
+	}
+}
+
+// healthy returns true when the manager is connected to the broker
+func (m *connectionManager) healthy() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.conn != nil && !m.conn.IsClosed()
+}
+
+// acquire returns a channel ready to publish. It reuses an idle channel
+// of the pool when available, or opens a new one when the pool is not full.
+// It waits for a free slot and for the connection when reconnecting until
+// the context is done. The channel must be given back with release
+func (m *connectionManager) acquire(ctx context.Context) (*pooledChannel, error) {
+	select {
+	case <-m.done:
+		return nil, errManagerClosed
+	default:
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	case <-m.done:
+		return nil, errManagerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		select {
+		case ch := <-m.idle:
+			if ch.isClosed() {
+				continue
+			}
+			return ch, nil
+		default:
+		}
+
+		ch, err := m.open(ctx)
+		if err != nil {
+			<-m.slots
+			return nil, err
+		}
+		return ch, nil
+	}
+}
+
+// open opens a new channel on the current connection, waiting for the
+// connection when reconnecting
+func (m *connectionManager) open(ctx context.Context) (*pooledChannel, error) {
+	for {
+		m.mu.RLock()
+		conn, connected := m.conn, m.connected
+		m.mu.RUnlock()
+
+		if conn == nil {
+			select {
+			case <-connected:
+				continue
+			case <-m.done:
+				return nil, errManagerClosed
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		channel, err := conn.Channel()
+		if errors.Is(err, amqp.ErrClosed) {
+			// the connection is closed but not yet handled by the watcher
+			m.lost(conn)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		ch := &pooledChannel{
+			Channel: channel,
+			closed:  channel.NotifyClose(make(chan *amqp.Error, 1)),
+		}
+
+		if err := m.setup(ch); err != nil {
+			channel.Close()
+			return nil, err
+		}
+		return ch, nil
+	}
+}
+
+// release gives back the channel to the pool. A channel that received an
+// error is closed instead, since its state is unknown
+func (m *connectionManager) release(ch *pooledChannel, err error) {
+	defer func() { <-m.slots }()
+
+	if err != nil || ch.isClosed() {
+		ch.Close()
+		return
+	}
+
+	select {
+	case m.idle <- ch:
+	default:
+		ch.Close()
+	}
+}
+
+// close closes the connection and stops the reconnection. The next calls
+// do nothing and return nil
+func (m *connectionManager) close() (err error) {
+	m.closeOnce.Do(func() {
+		close(m.done)
+
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		if m.conn != nil {
+			err = m.conn.Close()
+		}
+	})
+	return err
+}
+
+// isClosed returns true if the channel has been closed by the broker or
+// by the connection
+func (ch *pooledChannel) isClosed() bool {
+	select {
+	case <-ch.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -3,21 +3,30 @@ package rabbitmq
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/streadway/amqp"
 
 	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
 )
 
 // storage is the struct contains client and config
 // Run is made from external caller at begins programs
 type storage struct {
-	config     *config
-	client     *amqp.Connection
-	channel    *amqp.Channel
-	routingKey amqp.Queue
+	config  *config
+	manager *connectionManager
+
+	mu sync.RWMutex // protect following field
+	// queue is the declared queue, used as default routing key. Its name can
+	// change on reconnection when the broker generates it
+	queue amqp.Queue
 }
 
 // config is the struct contains config for connect client
@@ -33,9 +42,71 @@ type config struct {
 	Mandatory          bool              `mapstructure:"mandatory" json:"mandatory"`
 	Immediate          bool              `mapstructure:"immediate" json:"immediate"`
 	Exchange           string            `mapstructure:"exchange" json:"exchange"`
+
+	// ExchangeType is the type of the exchange (direct, fanout, topic or
+	// headers). When defined, the exchange is declared at startup
+	ExchangeType string `mapstructure:"exchangeType" json:"exchangeType"`
+	// ExchangeDurable makes the declared exchange survive a broker restart
+	ExchangeDurable bool `mapstructure:"exchangeDurable" json:"exchangeDurable"`
+	// ExchangeAutoDelete deletes the declared exchange when no more queue
+	// is bound to it
+	ExchangeAutoDelete bool `mapstructure:"exchangeAutoDelete" json:"exchangeAutoDelete"`
+	// BindingKey is the key used to bind the queue to the exchange when both
+	// are defined (default: the queue name)
+	BindingKey string `mapstructure:"bindingKey" json:"bindingKey"`
+
+	// RoutingKey is the routing key of each message. The routing key can use
+	// the formatting feature (default: the queue name)
+	RoutingKey string `mapstructure:"routingKey" json:"routingKey"`
+	// Headers are the headers of each message. Each value can use the
+	// formatting feature (see pkg/formatting)
+	Headers map[string]string `mapstructure:"headers" json:"headers"`
+	// Properties are the properties of each message. Each value can use the
+	// formatting feature (see pkg/formatting)
+	Properties properties `mapstructure:"properties" json:"properties"`
+
+	// PublisherConfirms waits for the broker to confirm each message before
+	// considering the push successful
+	PublisherConfirms bool `mapstructure:"publisherConfirms" json:"publisherConfirms"`
+	// ConfirmTimeout is the maximum duration to wait for a confirm
+	// (default: 5s)
+	ConfirmTimeout time.Duration `mapstructure:"confirmTimeout" json:"confirmTimeout"`
+
+	// ChannelPoolSize is the maximum number of channels used at the same
+	// time to publish messages (default: 10)
+	ChannelPoolSize int `mapstructure:"channelPoolSize" json:"channelPoolSize"`
+	// PublishTimeout is the maximum duration of a push, including the wait
+	// of a free channel and of the reconnection to the broker (default: 10s)
+	PublishTimeout time.Duration `mapstructure:"publishTimeout" json:"publishTimeout"`
+	// ReconnectInterval is the duration to wait before the first reconnection
+	// attempt, doubled on each failed attempt (default: 500ms)
+	ReconnectInterval time.Duration `mapstructure:"reconnectInterval" json:"reconnectInterval"`
+	// ReconnectMaxInterval is the maximum duration to wait between two
+	// reconnection attempts (default: 30s)
+	ReconnectMaxInterval time.Duration `mapstructure:"reconnectMaxInterval" json:"reconnectMaxInterval"`
+}
+
+// properties is the struct contains the templates of the message properties
+type properties struct {
+	MessageID     string `mapstructure:"messageId" json:"messageId"`
+	CorrelationID string `mapstructure:"correlationId" json:"correlationId"`
+	// Priority must be rendered as a number between 0 and 9
+	Priority string `mapstructure:"priority" json:"priority"`
+	// Expiration must be rendered as a number of milliseconds
+	Expiration string `mapstructure:"expiration" json:"expiration"`
 }
 
-const maxAttempt = 5
+var (
+	// errNack is returned when the broker does not acknowledge the message
+	errNack = errors.New("message not acknowledged by the broker")
+	// errReturned is returned when a mandatory message cannot be routed
+	errReturned = errors.New("message returned by the broker")
+	// errConfirmTimeout is returned when the broker does not confirm the
+	// message in time
+	errConfirmTimeout = errors.New("timeout while waiting for the broker confirm")
+	// errDisconnected is returned by Ping when the connection is lost
+	errDisconnected = errors.New("not connected to rabbitmq")
+)
 
 // ContentType is the function for get content type used to push data in the
 // storage. When no content type is defined, the default one is used instead
@@ -64,35 +135,115 @@ func NewStorage(configRaw map[string]interface{}) (*storage, error) {
 		return nil, err
 	}
 
-	if newClient.client, err = amqp.Dial(newClient.config.DatabaseURL.First()); err != nil {
+	newClient.config.setDefaults()
+
+	if newClient.manager, err = newConnectionManager(
+		newClient.config.DatabaseURL.First(),
+		newClient.config.ChannelPoolSize,
+		newClient.config.ReconnectInterval,
+		newClient.config.ReconnectMaxInterval,
+		newClient.declare,
+		newClient.setupChannel,
+	); err != nil {
 		return nil, err
 	}
 
-	if newClient.channel, err = newClient.client.Channel(); err != nil {
-		return nil, err
+	return &newClient, nil
+}
+
+// setDefaults sets the default values of the optional fields
+func (c *config) setDefaults() {
+	if c.ConfirmTimeout == 0 {
+		c.ConfirmTimeout = 5 * time.Second
+	}
+
+	if c.ChannelPoolSize <= 0 {
+		c.ChannelPoolSize = 10
 	}
 
-	go func() {
-		for {
-			reason := <-newClient.client.NotifyClose(make(chan *amqp.Error))
-			log.Warn().Msgf("connection to rabbitmq closed, reason: %v", reason)
+	if c.PublishTimeout == 0 {
+		c.PublishTimeout = 10 * time.Second
+	}
 
-			newClient.reconnect()
+	if c.ReconnectInterval == 0 {
+		c.ReconnectInterval = 500 * time.Millisecond
+	}
+
+	if c.ReconnectMaxInterval == 0 {
+		c.ReconnectMaxInterval = 30 * time.Second
+	}
+}
+
+// declare declares the exchange, the queue and the binding between them.
+// It is called on each new connection to the broker
+func (c *storage) declare(ch *amqp.Channel) error {
+	if c.config.ExchangeType != "" {
+		if err := ch.ExchangeDeclare(
+			c.config.Exchange,
+			c.config.ExchangeType,
+			c.config.ExchangeDurable,
+			c.config.ExchangeAutoDelete,
+			false,
+			c.config.NoWait,
+			nil,
+		); err != nil {
+			return err
 		}
-	}()
-
-	if newClient.routingKey, err = newClient.channel.QueueDeclare(
-		newClient.config.QueueName,
-		newClient.config.Durable,
-		newClient.config.DeleteWhenUnused,
-		newClient.config.Exclusive,
-		newClient.config.NoWait,
+	}
+
+	// the queue is always declared with the default exchange for backward
+	// compatibility, otherwise only when a queue name is defined
+	if c.config.Exchange != "" && c.config.QueueName == "" {
+		return nil
+	}
+
+	queue, err := ch.QueueDeclare(
+		c.config.QueueName,
+		c.config.Durable,
+		c.config.DeleteWhenUnused,
+		c.config.Exclusive,
+		c.config.NoWait,
 		nil,
-	); err != nil {
-		return nil, err
+	)
+	if err != nil {
+		return err
 	}
 
-	return &newClient, nil
+	c.mu.Lock()
+	c.queue = queue
+	c.mu.Unlock()
+
+	if c.config.Exchange == "" {
+		return nil
+	}
+
+	bindingKey := c.config.BindingKey
+	if bindingKey == "" {
+		bindingKey = queue.Name
+	}
+
+	return ch.QueueBind(queue.Name, bindingKey, c.config.Exchange, c.config.NoWait, nil)
+}
+
+// setupChannel enables the publisher confirms on a new channel when
+// configured and listens for the returned messages
+func (c *storage) setupChannel(ch *pooledChannel) error {
+	if c.config.PublisherConfirms {
+		if err := ch.Confirm(false); err != nil {
+			return err
+		}
+		ch.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		ch.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	} else if c.config.Mandatory {
+		returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+		go func() {
+			for r := range returns {
+				log.Warn().Str("exchange", r.Exchange).Str("routingKey", r.RoutingKey).Msgf("message returned by rabbitmq: %s", r.ReplyText)
+			}
+		}()
+	}
+
+	return nil
 }
 
 // Name is the function for identified if the storage config is define in the webhooks
@@ -101,56 +252,154 @@ func (c *storage) Name() string {
 	return "rabbitmq"
 }
 
+// DefaultRetry returns the retry policy of the storage when the retry is
+// not configured next to its specs. The publishes are attempted 5 times,
+// waiting the reconnect interval of the connection before the first retry
+func (c *storage) DefaultRetry() *retry.Config {
+	return &retry.Config{
+		MaxAttempts:     5,
+		InitialInterval: c.config.ReconnectInterval,
+		MaxInterval:     c.config.ReconnectMaxInterval,
+	}
+}
+
 // Push is the function for push data in the storage
+// The message is published once, the failed publishes are retried by the
+// retry policy of the storage (see DefaultRetry)
 // A run is made from external caller
 // @param value that will be pushed
 // @return an error if the push failed
 func (c *storage) Push(ctx context.Context, value []byte) error {
-	for attempt := 0; attempt < maxAttempt; attempt++ {
-		err := c.channel.Publish(
-			c.config.Exchange,
-			c.routingKey.Name,
-			c.config.Mandatory,
-			c.config.Immediate,
-			amqp.Publishing{
-				ContentType: c.config.ContentType(),
-				Body:        value,
-			})
+	routingKey, publishing, err := c.message(ctx, value)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			if errors.Is(err, amqp.ErrClosed) {
-				log.Warn().Err(err).Msg("connection to rabbitmq closed. reconnecting...")
-				c.reconnect()
-				continue
-			} else {
-				return err
-			}
-		}
-		return nil
+	ctx, cancel := context.WithTimeout(ctx, c.config.PublishTimeout)
+	defer cancel()
+
+	ch, err := c.manager.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.publish(ctx, ch, routingKey, publishing)
+	c.manager.release(ch, err)
+	return err
+}
+
+// Ping returns an error when the storage is not connected to the broker
+func (c *storage) Ping(ctx context.Context) error {
+	if !c.manager.healthy() {
+		return errDisconnected
 	}
+	return nil
+}
 
-	return errors.New("max attempt to publish reached")
+// Close closes the channels and the connection to the broker
+func (c *storage) Close(ctx context.Context) error {
+	return c.manager.close()
 }
 
-// reconnect is the function to reconnect to the amqp server if the connection
-// is lost. It will try to reconnect every seconds until it succeed to connect
-func (c *storage) reconnect() {
+// publish publishes the message on the given channel. When the publisher
+// confirms are enabled, it waits for the broker confirm of the message
+func (c *storage) publish(ctx context.Context, ch *pooledChannel, routingKey string, publishing amqp.Publishing) error {
+	if err := ch.Publish(
+		c.config.Exchange,
+		routingKey,
+		c.config.Mandatory,
+		c.config.Immediate,
+		publishing,
+	); err != nil {
+		return err
+	}
+
+	if !c.config.PublisherConfirms {
+		return nil
+	}
+
+	timer := time.NewTimer(c.config.ConfirmTimeout)
+	defer timer.Stop()
+
+	// the broker sends the return of an unroutable message before its confirm
+	var returned bool
 	for {
-		// wait 1s for reconnect
-		time.Sleep(time.Second)
-
-		conn, err := amqp.Dial(c.config.DatabaseURL.First())
-		if err == nil {
-			c.client = conn
-			c.channel, err = c.client.Channel()
-			if err != nil {
-				log.Error().Err(err).Msg("channel cannot be connected")
-				continue
+		select {
+		case r := <-ch.returns:
+			log.Warn().Str("exchange", r.Exchange).Str("routingKey", r.RoutingKey).Msgf("message returned by rabbitmq: %s", r.ReplyText)
+			returned = true
+		case confirm, ok := <-ch.confirms:
+			switch {
+			case !ok:
+				return amqp.ErrClosed
+			case !confirm.Ack:
+				return errNack
+			case returned:
+				return errReturned
+			}
+			return nil
+		case <-timer.C:
+			// the channel is closed on release to never attribute a late
+			// confirm to the next message
+			return errConfirmTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// message builds the routing key and the message to publish for the given
+// value by rendering the configured templates
+func (c *storage) message(ctx context.Context, value []byte) (string, amqp.Publishing, error) {
+	var err error
+	var publishing = amqp.Publishing{
+		ContentType: c.config.ContentType(),
+		Body:        value,
+	}
+
+	c.mu.RLock()
+	routingKey := c.queue.Name
+	c.mu.RUnlock()
+
+	if c.config.RoutingKey != "" {
+		if routingKey, err = formatting.RenderFromContext(ctx, c.config.RoutingKey, value); err != nil {
+			return "", publishing, retry.Permanent(err)
+		}
+	}
+
+	if len(c.config.Headers) > 0 {
+		publishing.Headers = make(amqp.Table, len(c.config.Headers))
+		for name, template := range c.config.Headers {
+			if publishing.Headers[name], err = formatting.RenderFromContext(ctx, template, value); err != nil {
+				return "", publishing, retry.Permanent(err)
 			}
-			log.Debug().Msg("reconnect success")
-			break
+		}
+	}
+
+	if publishing.MessageId, err = formatting.RenderFromContext(ctx, c.config.Properties.MessageID, value); err != nil {
+		return "", publishing, retry.Permanent(err)
+	}
+
+	if publishing.CorrelationId, err = formatting.RenderFromContext(ctx, c.config.Properties.CorrelationID, value); err != nil {
+		return "", publishing, retry.Permanent(err)
+	}
+
+	if publishing.Expiration, err = formatting.RenderFromContext(ctx, c.config.Properties.Expiration, value); err != nil {
+		return "", publishing, retry.Permanent(err)
+	}
+
+	if c.config.Properties.Priority != "" {
+		priority, err := formatting.RenderFromContext(ctx, c.config.Properties.Priority, value)
+		if err != nil {
+			return "", publishing, retry.Permanent(err)
 		}
 
-		log.Error().Err(err).Msg("reconnect failed")
+		p, err := strconv.ParseUint(strings.TrimSpace(priority), 10, 8)
+		if err != nil || p > 9 {
+			return "", publishing, retry.Permanent(fmt.Errorf("invalid priority %s, must be a number between 0 and 9", priority))
+		}
+		publishing.Priority = uint8(p)
 	}
+
+	return routingKey, publishing, nil
 }
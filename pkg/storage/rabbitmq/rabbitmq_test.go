@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
 )
 
 type RabbitMQSetupTestSuite struct {
@@ -73,6 +79,50 @@ func (suite *RabbitMQSetupTestSuite) TestRabbitMQPush() {
 	assert.NoError(suite.T(), err)
 }
 
+func (suite *RabbitMQSetupTestSuite) TestRabbitMQPushExchangeWithConfirms() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"databaseUrl":       suite.amqpUrl,
+		"queueName":         "helloExchange",
+		"exchange":          "webhooked",
+		"exchangeType":      "topic",
+		"bindingKey":        "webhooks.#",
+		"routingKey":        "webhooks.{{ .Spec.Name }}",
+		"publisherConfirms": true,
+		"confirmTimeout":    "5s",
+		"mandatory":         true,
+		"headers": map[string]string{
+			"x-spec": "{{ .Spec.Name }}",
+		},
+		"properties": map[string]string{
+			"messageId":  "{{ .Spec.Name }}-1",
+			"priority":   "5",
+			"expiration": "60000",
+		},
+	})
+	assert.NoError(suite.T(), err)
+
+	ctx := formatting.ToContext(
+		context.Background(),
+		formatting.New().WithData("Spec", map[string]string{"Name": "test"}),
+	)
+	assert.NoError(suite.T(), newClient.Push(ctx, []byte("Hello")))
+
+	ch, err := newClient.manager.acquire(context.Background())
+	assert.NoError(suite.T(), err)
+	defer newClient.manager.release(ch, nil)
+
+	delivery, ok, err := ch.Get("helloExchange", true)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), "webhooks.test", delivery.RoutingKey)
+	assert.Equal(suite.T(), "test-1", delivery.MessageId)
+	assert.Equal(suite.T(), "test", delivery.Headers["x-spec"])
+	assert.Equal(suite.T(), []byte("Hello"), delivery.Body)
+
+	newClient.config.RoutingKey = "unroutable"
+	assert.ErrorIs(suite.T(), newClient.Push(ctx, []byte("Hello")), errReturned)
+}
+
 func TestRunRabbitMQPush(t *testing.T) {
 	if testing.Short() {
 		t.Skip("rabbitmq testing is skiped in short version of test")
@@ -95,21 +145,121 @@ func (suite *RabbitMQSetupTestSuite) TestReconnect() {
 	}
 
 	newClient, err := NewStorage(map[string]interface{}{
-		"databaseUrl":      suite.amqpUrl,
-		"queueName":        "hello",
-		"contentType":      "text/plain",
-		"durable":          false,
-		"deleteWhenUnused": false,
-		"exclusive":        false,
-		"noWait":           false,
-		"mandatory":        false,
-		"immediate":        false,
+		"databaseUrl":       suite.amqpUrl,
+		"queueName":         "hello",
+		"contentType":       "text/plain",
+		"durable":           false,
+		"deleteWhenUnused":  false,
+		"exclusive":         false,
+		"noWait":            false,
+		"mandatory":         false,
+		"immediate":         false,
+		"reconnectInterval": "10ms",
 	})
 	assert.NoError(suite.T(), err)
 
 	assert.NoError(suite.T(), newClient.Push(context.Background(), []byte("Hello")))
-	assert.NoError(suite.T(), newClient.client.Close())
+	assert.NoError(suite.T(), newClient.Ping(context.Background()))
+
+	// close the connection, the push must wait for the reconnection
+	newClient.manager.mu.RLock()
+	conn := newClient.manager.conn
+	newClient.manager.mu.RUnlock()
+	assert.NoError(suite.T(), conn.Close())
 	assert.NoError(suite.T(), newClient.Push(context.Background(), []byte("Hello")))
-	assert.NoError(suite.T(), newClient.channel.Close())
+	assert.NoError(suite.T(), newClient.Ping(context.Background()))
+
+	// close a pooled channel, the push must open a new one
+	ch, err := newClient.manager.acquire(context.Background())
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), ch.Close())
+	newClient.manager.release(ch, nil)
 	assert.NoError(suite.T(), newClient.Push(context.Background(), []byte("Hello")))
+
+	// push concurrently with more goroutines than channels in the pool
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(suite.T(), newClient.Push(context.Background(), []byte("Hello")))
+		}()
+	}
+	wg.Wait()
+
+	assert.NoError(suite.T(), newClient.manager.close())
+	assert.NoError(suite.T(), newClient.manager.close())
+	assert.ErrorIs(suite.T(), newClient.Push(context.Background(), []byte("Hello")), errManagerClosed)
+	assert.ErrorIs(suite.T(), newClient.Ping(context.Background()), errDisconnected)
+}
+
+func TestConfigSetDefaults(t *testing.T) {
+	var c = &config{}
+	c.setDefaults()
+
+	assert.Equal(t, 5*time.Second, c.ConfirmTimeout)
+	assert.Equal(t, 10, c.ChannelPoolSize)
+	assert.Equal(t, 10*time.Second, c.PublishTimeout)
+	assert.Equal(t, 500*time.Millisecond, c.ReconnectInterval)
+	assert.Equal(t, 30*time.Second, c.ReconnectMaxInterval)
+
+	// the publishes are retried by default, as before the retry policies
+	retryConfig := (&storage{config: c}).DefaultRetry()
+	assert.Equal(t, 5, retryConfig.MaxAttempts)
+	assert.Equal(t, c.ReconnectInterval, retryConfig.InitialInterval)
+	assert.Equal(t, c.ReconnectMaxInterval, retryConfig.MaxInterval)
+}
+
+func TestMessage(t *testing.T) {
+	assert := assert.New(t)
+	ctx := formatting.ToContext(
+		context.Background(),
+		formatting.New().WithData("Spec", map[string]string{"Name": "test"}),
+	)
+
+	var s = &storage{config: &config{}, queue: amqp.Queue{Name: "hello"}}
+	routingKey, publishing, err := s.message(context.Background(), []byte("Hello"))
+	assert.NoError(err)
+	assert.Equal("hello", routingKey)
+	assert.Equal("text/plain", publishing.ContentType)
+	assert.Equal([]byte("Hello"), publishing.Body)
+	assert.Nil(publishing.Headers)
+
+	s.config = &config{
+		RoutingKey: "webhooks.{{ .Spec.Name }}",
+		Headers:    map[string]string{"x-spec": "{{ .Spec.Name }}"},
+		Properties: properties{
+			MessageID:     "{{ .Payload }}",
+			CorrelationID: "correlation",
+			Priority:      "{{ len .Payload }}",
+			Expiration:    "1000",
+		},
+	}
+	routingKey, publishing, err = s.message(ctx, []byte("Hello"))
+	assert.NoError(err)
+	assert.Equal("webhooks.test", routingKey)
+	assert.Equal(amqp.Table{"x-spec": "test"}, publishing.Headers)
+	assert.Equal("Hello", publishing.MessageId)
+	assert.Equal("correlation", publishing.CorrelationId)
+	assert.Equal(uint8(5), publishing.Priority)
+	assert.Equal("1000", publishing.Expiration)
+
+	_, _, err = s.message(context.Background(), []byte("Hello"))
+	assert.ErrorIs(err, formatting.ErrNotFoundInContext)
+
+	// the invalid messages are not retried
+	s.config = &config{Properties: properties{Priority: "10"}}
+	_, _, err = s.message(ctx, []byte("Hello"))
+	assert.Error(err)
+	assert.False(retry.IsRetryable(err))
+
+	s.config = &config{Properties: properties{Priority: "high"}}
+	_, _, err = s.message(ctx, []byte("Hello"))
+	assert.Error(err)
+	assert.False(retry.IsRetryable(err))
+
+	s.config = &config{RoutingKey: "{{ .Unknown.Field }}"}
+	_, _, err = s.message(ctx, []byte("Hello"))
+	assert.Error(err)
+	assert.False(retry.IsRetryable(err))
 }
@@ -3,14 +3,19 @@ package redis
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 
+	"atomys.codes/webhooked/internal/tlsconfig"
 	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
 )
 
 type storage struct {
-	client *redis.Client
+	client redis.UniversalClient
 	config *config
 }
 
@@ -20,9 +25,82 @@ type config struct {
 	Username valuable.Valuable `mapstructure:"username" json:"username"`
 	Password valuable.Valuable `mapstructure:"password" json:"password"`
 	Database int               `mapstructure:"database" json:"database"`
-	Key      string            `mapstructure:"key" json:"key"`
+	// Addresses is the list of host:port addresses of the cluster nodes or
+	// the sentinels. When empty, the host and port fields are used instead
+	Addresses []string `mapstructure:"addresses" json:"addresses"`
+	// Cluster forces the usage of a cluster client, even with a single
+	// address. A cluster client is always used when many addresses are
+	// defined without master name
+	Cluster bool `mapstructure:"cluster" json:"cluster"`
+	// Sentinel is the configuration of the sentinel (failover) client
+	Sentinel sentinelConfig `mapstructure:"sentinel" json:"sentinel"`
+	// TLS is the TLS configuration used to connect to redis
+	TLS tlsconfig.Config `mapstructure:"tls" json:"tls"`
+	// Pool is the configuration of the connection pool and the timeouts
+	Pool poolConfig `mapstructure:"pool" json:"pool"`
+	// Mode is the way the data is pushed in redis: list, stream or pubsub
+	// (default: list)
+	Mode string `mapstructure:"mode" json:"mode"`
+	// Key is the key of the list or the stream where the data is pushed.
+	// The key can use the formatting feature (see pkg/formatting)
+	Key string `mapstructure:"key" json:"key"`
+	// TTL is the expiration applied on the key of the list after each push
+	// as duration (eg: 24h). The TTL can use the formatting feature.
+	// Only used with the list mode
+	TTL string `mapstructure:"ttl" json:"ttl"`
+	// Channel is the channel where the data is published. The channel can
+	// use the formatting feature. Only used with the pubsub mode
+	Channel string `mapstructure:"channel" json:"channel"`
+	// Stream is the configuration of the stream mode
+	Stream streamConfig `mapstructure:"stream" json:"stream"`
 }
 
+// streamConfig is the struct contains the configuration of the stream mode
+type streamConfig struct {
+	// MaxLen trims the stream to the given length on each push (default: 0,
+	// no trimming)
+	MaxLen int64 `mapstructure:"maxLen" json:"maxLen"`
+	// Approximate allows redis to trim the stream more efficiently with
+	// the `~` flag, the stream can be a bit longer than MaxLen
+	Approximate bool `mapstructure:"approximate" json:"approximate"`
+	// Fields is the list of fields added to the stream entry. Each value can
+	// use the formatting feature. When empty, the data is pushed in the
+	// `payload` field
+	Fields map[string]string `mapstructure:"fields" json:"fields"`
+}
+
+// sentinelConfig is the struct contains the configuration of the sentinel
+type sentinelConfig struct {
+	// MasterName is the name of the master monitored by the sentinels.
+	// When defined, a failover client is used with the addresses of the
+	// sentinels
+	MasterName string            `mapstructure:"masterName" json:"masterName"`
+	Username   valuable.Valuable `mapstructure:"username" json:"username"`
+	Password   valuable.Valuable `mapstructure:"password" json:"password"`
+}
+
+// poolConfig is the struct contains the configuration of the connection
+// pool. Zero values use the defaults of the redis client
+type poolConfig struct {
+	Size         int           `mapstructure:"size" json:"size"`
+	MinIdleConns int           `mapstructure:"minIdleConns" json:"minIdleConns"`
+	MaxRetries   int           `mapstructure:"maxRetries" json:"maxRetries"`
+	DialTimeout  time.Duration `mapstructure:"dialTimeout" json:"dialTimeout"`
+	ReadTimeout  time.Duration `mapstructure:"readTimeout" json:"readTimeout"`
+	WriteTimeout time.Duration `mapstructure:"writeTimeout" json:"writeTimeout"`
+	PoolTimeout  time.Duration `mapstructure:"poolTimeout" json:"poolTimeout"`
+	IdleTimeout  time.Duration `mapstructure:"idleTimeout" json:"idleTimeout"`
+}
+
+const (
+	// modeList pushes the data at the end of a list with RPUSH
+	modeList = "list"
+	// modeStream adds the data as a new entry of a stream with XADD
+	modeStream = "stream"
+	// modePubSub publishes the data on a channel with PUBLISH
+	modePubSub = "pubsub"
+)
+
 // NewStorage is the function for create new Redis storage client
 // Run is made from external caller at begins programs
 // @param config contains config define in the webhooks yaml file
@@ -38,14 +116,20 @@ func NewStorage(configRaw map[string]interface{}) (*storage, error) {
 		return nil, err
 	}
 
-	newClient.client = redis.NewClient(
-		&redis.Options{
-			Addr:     fmt.Sprintf("%s:%s", newClient.config.Host, newClient.config.Port),
-			Username: newClient.config.Username.First(),
-			Password: newClient.config.Password.First(),
-			DB:       newClient.config.Database,
-		},
-	)
+	if err := newClient.config.validate(); err != nil {
+		return nil, err
+	}
+
+	options, err := newClient.config.universalOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	if newClient.config.Cluster {
+		newClient.client = redis.NewClusterClient(options.Cluster())
+	} else {
+		newClient.client = redis.NewUniversalClient(options)
+	}
 
 	// Ping Redis for testing config
 	if err := newClient.client.Ping(context.Background()).Err(); err != nil {
@@ -55,20 +139,156 @@ func NewStorage(configRaw map[string]interface{}) (*storage, error) {
 	return &newClient, nil
 }
 
+// validate checks the mode and the required fields of the mode. When no
+// mode is defined, the list mode is used
+func (c *config) validate() error {
+	switch c.Mode {
+	case "":
+		c.Mode = modeList
+		return c.validate()
+	case modeList, modeStream:
+		if c.Key == "" {
+			return fmt.Errorf("the key is required with the %s mode", c.Mode)
+		}
+	case modePubSub:
+		if c.Channel == "" {
+			return fmt.Errorf("the channel is required with the %s mode", c.Mode)
+		}
+	default:
+		return fmt.Errorf("invalid mode %s, must be one of %s, %s or %s", c.Mode, modeList, modeStream, modePubSub)
+	}
+
+	return nil
+}
+
+// universalOptions returns the options of the universal client. The client
+// kind is resolved by the universal client: failover when a master name is
+// defined, cluster when many addresses are defined and single node otherwise
+func (c *config) universalOptions() (*redis.UniversalOptions, error) {
+	tlsConfig, err := c.TLS.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := c.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{fmt.Sprintf("%s:%s", c.Host, c.Port)}
+	}
+
+	return &redis.UniversalOptions{
+		Addrs:            addresses,
+		DB:               c.Database,
+		Username:         c.Username.First(),
+		Password:         c.Password.First(),
+		MasterName:       c.Sentinel.MasterName,
+		SentinelUsername: c.Sentinel.Username.First(),
+		SentinelPassword: c.Sentinel.Password.First(),
+		TLSConfig:        tlsConfig,
+		PoolSize:         c.Pool.Size,
+		MinIdleConns:     c.Pool.MinIdleConns,
+		MaxRetries:       c.Pool.MaxRetries,
+		DialTimeout:      c.Pool.DialTimeout,
+		ReadTimeout:      c.Pool.ReadTimeout,
+		WriteTimeout:     c.Pool.WriteTimeout,
+		PoolTimeout:      c.Pool.PoolTimeout,
+		IdleTimeout:      c.Pool.IdleTimeout,
+	}, nil
+}
+
 // Name is the function for identified if the storage config is define in the webhooks
 // @return name of the storage
 func (c storage) Name() string {
 	return "redis"
 }
 
+// Ping checks that redis is reachable
+func (c storage) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
+
+// Close closes the connections to redis
+func (c storage) Close(ctx context.Context) error {
+	return c.client.Close()
+}
+
 // Push is the function for push data in the storage
 // A run is made from external caller
 // @param value that will be pushed
 // @return an error if the push failed
 func (c storage) Push(ctx context.Context, value []byte) error {
-	if err := c.client.RPush(ctx, c.config.Key, value).Err(); err != nil {
-		return err
+	switch c.config.Mode {
+	case modeStream:
+		return c.pushStream(ctx, value)
+	case modePubSub:
+		return c.publish(ctx, value)
+	default:
+		return c.pushList(ctx, value)
 	}
+}
 
-	return nil
+// pushList pushes the value at the end of the list and refreshes the TTL
+// of the key when defined
+func (c storage) pushList(ctx context.Context, value []byte) error {
+	key, err := formatting.RenderFromContext(ctx, c.config.Key, value)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	if c.config.TTL == "" {
+		return c.client.RPush(ctx, key, value).Err()
+	}
+
+	rawTTL, err := formatting.RenderFromContext(ctx, c.config.TTL, value)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	ttl, err := time.ParseDuration(strings.TrimSpace(rawTTL))
+	if err != nil {
+		return retry.Permanent(fmt.Errorf("invalid ttl %s: %s", rawTTL, err.Error()))
+	}
+
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, value)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+// pushStream adds the value as a new entry of the stream. The entry
+// contains the rendered fields or the value in the `payload` field
+func (c storage) pushStream(ctx context.Context, value []byte) error {
+	key, err := formatting.RenderFromContext(ctx, c.config.Key, value)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	var fields = make(map[string]interface{}, len(c.config.Stream.Fields))
+	for name, template := range c.config.Stream.Fields {
+		if fields[name], err = formatting.RenderFromContext(ctx, template, value); err != nil {
+			return retry.Permanent(err)
+		}
+	}
+
+	if len(fields) == 0 {
+		fields["payload"] = value
+	}
+
+	return c.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: c.config.Stream.MaxLen,
+		Approx: c.config.Stream.Approximate,
+		Values: fields,
+	}).Err()
+}
+
+// publish publishes the value on the rendered channel
+func (c storage) publish(ctx context.Context, value []byte) error {
+	channel, err := formatting.RenderFromContext(ctx, c.config.Channel, value)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	return c.client.Publish(ctx, channel, value).Err()
 }
@@ -2,15 +2,31 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/internal/tlsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/retry"
 )
 
 type RedisSetupTestSuite struct {
 	suite.Suite
+	ctx context.Context
+}
+
+func (suite *RedisSetupTestSuite) BeforeTest(suiteName, testName string) {
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().WithData("Spec", map[string]string{"Name": "test", "TTL": "1m"}),
+	)
 }
 
 func (suite *RedisSetupTestSuite) TestRedisName() {
@@ -34,6 +50,25 @@ func (suite *RedisSetupTestSuite) TestRedisNewStorage() {
 		"key":      "testKey",
 	})
 	assert.NoError(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"addresses": []string{os.Getenv("REDIS_HOST") + ":" + os.Getenv("REDIS_PORT")},
+		"database":  0,
+		"key":       "testKey",
+		"pool": map[string]interface{}{
+			"size":        5,
+			"dialTimeout": "1s",
+		},
+	})
+	assert.NoError(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"host": os.Getenv("REDIS_HOST"),
+		"port": os.Getenv("REDIS_PORT"),
+		"key":  "testKey",
+		"tls":  map[string]interface{}{"ca": "/not/exist.pem"},
+	})
+	assert.Error(suite.T(), err)
 }
 
 func (suite *RedisSetupTestSuite) TestRedisPush() {
@@ -49,6 +84,80 @@ func (suite *RedisSetupTestSuite) TestRedisPush() {
 	assert.NoError(suite.T(), err)
 }
 
+func (suite *RedisSetupTestSuite) TestRedisPushListWithTTL() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"host":     os.Getenv("REDIS_HOST"),
+		"port":     os.Getenv("REDIS_PORT"),
+		"database": 0,
+		"key":      "testKey:{{ .Spec.Name }}",
+		"ttl":      "{{ .Spec.TTL }}",
+	})
+	assert.NoError(suite.T(), err)
+
+	err = newClient.Push(context.Background(), []byte("Hello"))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	err = newClient.Push(suite.ctx, []byte("Hello"))
+	assert.NoError(suite.T(), err)
+
+	ttl, err := newClient.client.TTL(context.Background(), "testKey:test").Result()
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), ttl > 0 && ttl <= time.Minute)
+
+	newClient.config.TTL = "invalid"
+	err = newClient.Push(suite.ctx, []byte("Hello"))
+	assert.Error(suite.T(), err)
+}
+
+func (suite *RedisSetupTestSuite) TestRedisPushStream() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"host":     os.Getenv("REDIS_HOST"),
+		"port":     os.Getenv("REDIS_PORT"),
+		"database": 0,
+		"mode":     "stream",
+		"key":      "testStream",
+		"stream": map[string]interface{}{
+			"maxLen": 2,
+			"fields": map[string]string{
+				"spec":    "{{ .Spec.Name }}",
+				"payload": "{{ .Payload }}",
+			},
+		},
+	})
+	assert.NoError(suite.T(), err)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+	}
+
+	entries, err := newClient.client.XRange(context.Background(), "testStream", "-", "+").Result()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), entries, 2)
+	assert.Equal(suite.T(), map[string]interface{}{"spec": "test", "payload": "Hello"}, entries[0].Values)
+}
+
+func (suite *RedisSetupTestSuite) TestRedisPushPubSub() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"host":     os.Getenv("REDIS_HOST"),
+		"port":     os.Getenv("REDIS_PORT"),
+		"database": 0,
+		"mode":     "pubsub",
+		"channel":  "testChannel:{{ .Spec.Name }}",
+	})
+	assert.NoError(suite.T(), err)
+
+	pubsub := newClient.client.Subscribe(context.Background(), "testChannel:test")
+	defer pubsub.Close()
+	_, err = pubsub.Receive(context.Background())
+	assert.NoError(suite.T(), err)
+
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+
+	msg, err := pubsub.ReceiveMessage(context.Background())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "Hello", msg.Payload)
+}
+
 func TestRunRedisPush(t *testing.T) {
 	if testing.Short() {
 		t.Skip("redis testing is skiped in short version of test")
@@ -57,3 +166,129 @@ func TestRunRedisPush(t *testing.T) {
 
 	suite.Run(t, new(RedisSetupTestSuite))
 }
+
+func TestConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	var c = &config{Key: "testKey"}
+	assert.NoError(c.validate())
+	assert.Equal("list", c.Mode)
+
+	assert.Error((&config{}).validate())
+	assert.Error((&config{Mode: "stream"}).validate())
+	assert.NoError((&config{Mode: "stream", Key: "testKey"}).validate())
+	assert.Error((&config{Mode: "pubsub", Key: "testKey"}).validate())
+	assert.NoError((&config{Mode: "pubsub", Channel: "testChannel"}).validate())
+	assert.Error((&config{Mode: "invalid", Key: "testKey"}).validate())
+}
+
+// recorder records the commands sent to redis and fails them before they
+// reach the network, so the rendering is tested without a server
+type recorder struct {
+	commands [][]interface{}
+}
+
+var errRecorded = errors.New("recorded")
+
+func (r *recorder) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	r.commands = append(r.commands, cmd.Args())
+	return ctx, errRecorded
+}
+
+func (r *recorder) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (r *recorder) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		r.commands = append(r.commands, cmd.Args())
+	}
+	return ctx, errRecorded
+}
+
+func (r *recorder) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestPushRender(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := formatting.ToContext(
+		context.Background(),
+		formatting.New().WithData("Spec", map[string]string{"Name": "test", "TTL": "1m"}),
+	)
+	newStorage := func(c *config) (storage, *recorder) {
+		client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{"127.0.0.1:0"}})
+		r := &recorder{}
+		client.AddHook(r)
+		return storage{client: client, config: c}, r
+	}
+
+	// the key and the channel are rendered with the request data
+	s, r := newStorage(&config{Mode: modeList, Key: "testKey:{{ .Spec.Name }}"})
+	assert.ErrorIs(s.Push(ctx, []byte("Hello")), errRecorded)
+	assert.Equal([][]interface{}{{"rpush", "testKey:test", []byte("Hello")}}, r.commands)
+
+	s, r = newStorage(&config{Mode: modePubSub, Channel: "testChannel:{{ .Spec.Name }}"})
+	assert.ErrorIs(s.Push(ctx, []byte("Hello")), errRecorded)
+	assert.Equal([][]interface{}{{"publish", "testChannel:test", []byte("Hello")}}, r.commands)
+
+	s, r = newStorage(&config{Mode: modeList, Key: "testKey:{{ .Spec.Name }}", TTL: "{{ .Spec.TTL }}"})
+	assert.ErrorIs(s.Push(ctx, []byte("Hello")), errRecorded)
+	assert.Contains(r.commands, []interface{}{"expire", "testKey:test", int64(60)})
+
+	// the render errors are not retried and nothing is sent to redis
+	for _, c := range []*config{
+		{Mode: modeList, Key: "testKey:{{ .Spec.Name }}"},
+		{Mode: modeStream, Key: "testStream", Stream: streamConfig{Fields: map[string]string{"spec": "{{ .Spec.Name }}"}}},
+		{Mode: modePubSub, Channel: "testChannel:{{ .Spec.Name }}"},
+	} {
+		s, r = newStorage(c)
+		err := s.Push(context.Background(), []byte("Hello"))
+		assert.ErrorIs(err, formatting.ErrNotFoundInContext)
+		assert.False(retry.IsRetryable(err))
+		assert.Empty(r.commands)
+	}
+
+	s, r = newStorage(&config{Mode: modeList, Key: "testKey", TTL: "{{ .Payload }}"})
+	err := s.Push(ctx, []byte("Hello"))
+	assert.Error(err)
+	assert.False(retry.IsRetryable(err))
+	assert.Empty(r.commands)
+}
+
+func TestConfigUniversalOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	options, err := (&config{
+		Host:     valuable.Valuable{Values: []string{"127.0.0.1"}},
+		Port:     valuable.Valuable{Values: []string{"6379"}},
+		Database: 1,
+	}).universalOptions()
+	assert.NoError(err)
+	assert.Equal([]string{"127.0.0.1:6379"}, options.Addrs)
+	assert.Equal(1, options.DB)
+	assert.Nil(options.TLSConfig)
+
+	options, err = (&config{
+		Addresses: []string{"sentinel-1:26379", "sentinel-2:26379"},
+		Sentinel: sentinelConfig{
+			MasterName: "mymaster",
+			Password:   valuable.Valuable{Values: []string{"secret"}},
+		},
+		TLS:  tlsconfig.Config{Enabled: true},
+		Pool: poolConfig{Size: 20, DialTimeout: time.Second},
+	}).universalOptions()
+	assert.NoError(err)
+	assert.Equal([]string{"sentinel-1:26379", "sentinel-2:26379"}, options.Addrs)
+	assert.Equal("mymaster", options.MasterName)
+	assert.Equal("secret", options.SentinelPassword)
+	assert.NotNil(options.TLSConfig)
+	assert.Equal(20, options.PoolSize)
+	assert.Equal(time.Second, options.DialTimeout)
+
+	_, err = (&config{
+		TLS: tlsconfig.Config{CA: valuable.Valuable{Values: []string{"/not/exist.pem"}}},
+	}).universalOptions()
+	assert.Error(err)
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"atomys.codes/webhooked/pkg/storage/clickhouse"
+	"atomys.codes/webhooked/pkg/storage/console"
+	"atomys.codes/webhooked/pkg/storage/elasticsearch"
+	"atomys.codes/webhooked/pkg/storage/gcppubsub"
+	"atomys.codes/webhooked/pkg/storage/http"
+	"atomys.codes/webhooked/pkg/storage/mongodb"
+	"atomys.codes/webhooked/pkg/storage/mqtt"
+	"atomys.codes/webhooked/pkg/storage/mysql"
+	"atomys.codes/webhooked/pkg/storage/postgres"
+	"atomys.codes/webhooked/pkg/storage/rabbitmq"
+	"atomys.codes/webhooked/pkg/storage/redis"
+	"atomys.codes/webhooked/pkg/storage/sns"
+	"atomys.codes/webhooked/pkg/storage/sqs"
+)
+
+// Constructor is the function creating a storage from the specs defined in
+// the webhooks yaml file
+type Constructor func(storageSpecs map[string]interface{}) (Pusher, error)
+
+var (
+	// registryMu protects the constructorMap
+	registryMu sync.RWMutex
+	// constructorMap contains the map of storage types to their constructor
+	// This is used to validate the storage type and to create the storage
+	constructorMap = map[string]Constructor{
+		"redis":         func(specs map[string]interface{}) (Pusher, error) { return redis.NewStorage(specs) },
+		"postgres":      func(specs map[string]interface{}) (Pusher, error) { return postgres.NewStorage(specs) },
+		"http":          func(specs map[string]interface{}) (Pusher, error) { return http.NewStorage(specs) },
+		"mongodb":       func(specs map[string]interface{}) (Pusher, error) { return mongodb.NewStorage(specs) },
+		"mysql":         func(specs map[string]interface{}) (Pusher, error) { return mysql.NewStorage(specs) },
+		"rabbitmq":      func(specs map[string]interface{}) (Pusher, error) { return rabbitmq.NewStorage(specs) },
+		"mqtt":          func(specs map[string]interface{}) (Pusher, error) { return mqtt.NewStorage(specs) },
+		"elasticsearch": func(specs map[string]interface{}) (Pusher, error) { return elasticsearch.NewStorage(specs) },
+		"clickhouse":    func(specs map[string]interface{}) (Pusher, error) { return clickhouse.NewStorage(specs) },
+		"sqs":           func(specs map[string]interface{}) (Pusher, error) { return sqs.NewStorage(specs) },
+		"sns":           func(specs map[string]interface{}) (Pusher, error) { return sns.NewStorage(specs) },
+		"gcppubsub":     func(specs map[string]interface{}) (Pusher, error) { return gcppubsub.NewStorage(specs) },
+		"stdout":        func(specs map[string]interface{}) (Pusher, error) { return console.NewStdoutStorage(specs) },
+		"stderr":        func(specs map[string]interface{}) (Pusher, error) { return console.NewStderrStorage(specs) },
+	}
+)
+
+// GetConstructorByName returns the constructor of the storage type and true
+// if the storage type is registered
+func GetConstructorByName(name string) (Constructor, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return lookupConstructor(name)
+}
+
+// Register a new storage type with its constructor. The custom storages
+// must be registered before the configuration is loaded
+func Register(name string, constructor Constructor) error {
+	if name == "" || constructor == nil {
+		return fmt.Errorf("storage name and constructor are required")
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := lookupConstructor(name); ok {
+		return fmt.Errorf("storage %s is already exist", name)
+	}
+	constructorMap[name] = constructor
+	return nil
+}
+
+// lookupConstructor returns the constructor of the storage type, the names
+// are case insensitive. The caller must hold the registryMu
+func lookupConstructor(name string) (Constructor, bool) {
+	for k, v := range constructorMap {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
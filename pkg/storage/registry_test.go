@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type customPusher struct {
+	url string
+}
+
+func (s customPusher) Name() string                             { return "custom" }
+func (s customPusher) Push(ctx context.Context, v []byte) error { return nil }
+
+func TestRegister(t *testing.T) {
+	assert := assert.New(t)
+	defer func() {
+		registryMu.Lock()
+		delete(constructorMap, "custom")
+		registryMu.Unlock()
+	}()
+
+	var actualRegistrySize = len(constructorMap)
+	assert.NoError(Register("custom", func(specs map[string]interface{}) (Pusher, error) {
+		return customPusher{url: specs["url"].(string)}, nil
+	}))
+	assert.Equal(actualRegistrySize+1, len(constructorMap))
+
+	pusher, err := Load("custom", map[string]interface{}{"url": "http://localhost"})
+	assert.NoError(err)
+	assert.Equal(customPusher{url: "http://localhost"}, pusher)
+
+	assert.Error(Register("custom", func(specs map[string]interface{}) (Pusher, error) { return nil, nil }))
+	assert.Error(Register("Redis", func(specs map[string]interface{}) (Pusher, error) { return nil, nil }))
+	assert.Error(Register("", func(specs map[string]interface{}) (Pusher, error) { return nil, nil }))
+	assert.Error(Register("nil", nil))
+}
+
+func TestGetConstructorByName(t *testing.T) {
+	for _, name := range []string{"redis", "postgres", "http", "mongodb", "mysql", "rabbitmq", "mqtt", "elasticsearch", "clickhouse", "sqs", "sns", "gcppubsub", "stdout", "stderr"} {
+		constructor, ok := GetConstructorByName(name)
+		assert.True(t, ok, name)
+		assert.NotNil(t, constructor, name)
+	}
+
+	constructor, ok := GetConstructorByName("invalid")
+	assert.False(t, ok)
+	assert.Nil(t, constructor)
+}
@@ -0,0 +1,209 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// BreakerConfig is the configuration of the circuit breaker of a storage
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed attempts opening
+	// the circuit (default: 5)
+	FailureThreshold int `mapstructure:"failureThreshold" json:"failureThreshold"`
+	// OpenDuration is the duration of the open state, the pushes fail
+	// immediately during this duration (default: 30s)
+	OpenDuration time.Duration `mapstructure:"openDuration" json:"openDuration"`
+	// HalfOpenRequests is the number of trial pushes allowed concurrently
+	// after the open duration. The circuit is closed when a trial succeeds
+	// and opened again when it fails (default: 1)
+	HalfOpenRequests int `mapstructure:"halfOpenRequests" json:"halfOpenRequests"`
+}
+
+// state is the state of the circuit breaker, the values are exposed in the
+// metrics
+type state int
+
+const (
+	// stateClosed lets all the pushes go through
+	stateClosed state = iota
+	// stateHalfOpen lets a limited number of trial pushes go through
+	stateHalfOpen
+	// stateOpen rejects all the pushes
+	stateOpen
+)
+
+// breaker is the circuit breaker of a storage. A nil breaker lets all the
+// pushes go through
+type breaker struct {
+	config *BreakerConfig
+	labels prometheus.Labels
+	// now returns the current time, replaced by the tests
+	now func() time.Time
+
+	mu sync.Mutex // protect following fields
+	// state is the current state of the circuit
+	state state
+	// failures is the number of consecutive failed attempts
+	failures int
+	// openedAt is the time of the last opening of the circuit
+	openedAt time.Time
+	// trials is the number of trial pushes in progress in half-open state
+	trials int
+	// generation is incremented on each change of state, the results of
+	// the pushes admitted in a previous state are ignored
+	generation uint64
+}
+
+// admission is the admission of a push by the circuit, given back with the
+// result of the push
+type admission struct {
+	// generation is the generation of the state admitting the push
+	generation uint64
+	// trial is true when the push is a trial of the half-open circuit
+	trial bool
+}
+
+var (
+	// errCircuitOpen is returned when the push is rejected by the circuit
+	// breaker
+	errCircuitOpen = errors.New("circuit breaker is open")
+
+	// breakerState is the state of the circuit breaker of each storage
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "webhooked",
+		Name:      "storage_circuit_breaker_state",
+		Help:      "State of the circuit breaker of the storage (0: closed, 1: half-open, 2: open)",
+	}, []string{"spec", "storage"})
+	// breakerRejectionsTotal is the number of pushes rejected by the
+	// circuit breaker of each storage
+	breakerRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webhooked",
+		Name:      "storage_circuit_breaker_rejections_total",
+		Help:      "Number of pushes rejected by the open circuit breaker of the storage",
+	}, []string{"spec", "storage"})
+)
+
+// validate checks the configuration and sets the default values
+func (c *BreakerConfig) validate() error {
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = 5
+	}
+
+	if c.OpenDuration == 0 {
+		c.OpenDuration = 30 * time.Second
+	}
+
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = 1
+	}
+
+	if c.FailureThreshold < 0 || c.OpenDuration < 0 || c.HalfOpenRequests < 0 {
+		return fmt.Errorf("the circuit breaker settings must be positive")
+	}
+
+	return nil
+}
+
+// newBreaker returns a closed circuit breaker
+func newBreaker(config *BreakerConfig, labels prometheus.Labels) *breaker {
+	breakerState.With(labels).Set(float64(stateClosed))
+	return &breaker{config: config, labels: labels, now: time.Now}
+}
+
+// allow returns errCircuitOpen when the push must be rejected. The open
+// circuit becomes half-open after the open duration. The admission of the
+// push must be given back to record with its result
+func (b *breaker) allow() (admission, error) {
+	if b == nil {
+		return admission{}, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == stateOpen && b.now().Sub(b.openedAt) >= b.config.OpenDuration {
+		b.setState(stateHalfOpen)
+	}
+
+	switch {
+	case b.state == stateOpen,
+		b.state == stateHalfOpen && b.trials >= b.config.HalfOpenRequests:
+		breakerRejectionsTotal.With(b.labels).Inc()
+		return admission{}, errCircuitOpen
+	case b.state == stateHalfOpen:
+		b.trials++
+		return admission{generation: b.generation, trial: true}, nil
+	}
+
+	return admission{generation: b.generation}, nil
+}
+
+// record updates the circuit with the result of an attempt. The
+// cancellations and the permanent errors are not failures of the storage,
+// the timeouts are. Only a success closes the half-open circuit, the other
+// attempts ignored by the circuit only give back their trial. The results
+// of the attempts admitted before the last change of state are ignored, so
+// only the trials decide of the half-open circuit
+func (b *breaker) record(a admission, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if a.generation != b.generation {
+		return
+	}
+
+	if a.trial {
+		b.trials--
+	}
+
+	switch {
+	case err == nil:
+		b.failures = 0
+		if b.state == stateHalfOpen {
+			b.setState(stateClosed)
+		}
+	case IsRetryable(err) || errors.Is(err, context.DeadlineExceeded):
+		b.failures++
+		if b.state == stateHalfOpen || b.failures >= b.config.FailureThreshold {
+			b.openedAt = b.now()
+			b.setState(stateOpen)
+		}
+	}
+}
+
+// setState changes the state of the circuit and exposes it in the
+// metrics. The caller must hold the mutex
+func (b *breaker) setState(s state) {
+	if b.state == s {
+		return
+	}
+
+	log.Warn().Str("spec", b.labels["spec"]).Str("storage", b.labels["storage"]).Msgf("circuit breaker is %s", s)
+	b.state = s
+	b.trials = 0
+	b.generation++
+	breakerState.With(b.labels).Set(float64(s))
+}
+
+// String returns the name of the state
+func (s state) String() string {
+	switch s {
+	case stateHalfOpen:
+		return "half-open"
+	case stateOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
@@ -0,0 +1,299 @@
+// Package retry wraps the storages with a retry layer, retrying the failed
+// pushes with an exponential backoff, and a circuit breaker failing fast
+// while the storage is down. The package does not depend on the storage
+// package, so the storages can classify their errors with Permanent
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+)
+
+// Config is the configuration of the retry of the pushes of a storage
+type Config struct {
+	// MaxAttempts is the maximum number of attempts of a push, including the
+	// first one (default: 3)
+	MaxAttempts int `mapstructure:"maxAttempts" json:"maxAttempts"`
+	// InitialInterval is the delay before the first retry (default: 100ms)
+	InitialInterval time.Duration `mapstructure:"initialInterval" json:"initialInterval"`
+	// MaxInterval is the maximum delay between two attempts (default: 10s)
+	MaxInterval time.Duration `mapstructure:"maxInterval" json:"maxInterval"`
+	// Multiplier is the factor applied to the delay after each retry
+	// (default: 2)
+	Multiplier float64 `mapstructure:"multiplier" json:"multiplier"`
+	// Jitter is the randomization factor of the delay, between 0 and 1. A
+	// jitter of 0.2 gives a delay between 80% and 120% of the computed
+	// delay (default: 0.2)
+	Jitter *float64 `mapstructure:"jitter" json:"jitter"`
+}
+
+// Pusher is the storage wrapped by the retry layer, it has the same
+// methods than storage.Pusher
+type Pusher interface {
+	Name() string
+	Push(ctx context.Context, value []byte) error
+}
+
+// pusher is the storage wrapped with the retry and the circuit breaker.
+// The optional interfaces of the storage are forwarded
+type pusher struct {
+	Pusher
+	retry   *Config
+	breaker *breaker
+	labels  prometheus.Labels
+}
+
+// permanentError is an error that must not be retried
+type permanentError struct {
+	err error
+}
+
+// attemptsError is the error of the last attempt of a push, with the
+// number of attempts made
+type attemptsError struct {
+	err      error
+	attempts int
+}
+
+var (
+	// retriesTotal is the number of retried pushes of each storage
+	retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webhooked",
+		Name:      "storage_push_retries_total",
+		Help:      "Number of retried pushes of the storage",
+	}, []string{"spec", "storage"})
+)
+
+// Permanent marks the error as permanent, the push is not retried and the
+// error is not counted by the circuit breaker
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Error returns the message of the wrapped error
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Retryable reports the permanent errors as not retryable
+func (e *permanentError) Retryable() bool {
+	return false
+}
+
+// Error returns the message of the wrapped error
+func (e *attemptsError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *attemptsError) Unwrap() error {
+	return e.err
+}
+
+// Attempts returns the number of attempts made by the retry layer before
+// failing with the error. It returns 1 when the error does not come from
+// the retry layer and 0 when there is no error
+func Attempts(err error) int {
+	var attemptsErr *attemptsError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &attemptsErr):
+		return attemptsErr.attempts
+	default:
+		return 1
+	}
+}
+
+// IsPermanentStatus returns true when a request rejected with the HTTP
+// status code must not be retried: the 4xx, except 408 Request Timeout and
+// 429 Too Many Requests
+func IsPermanentStatus(statusCode int) bool {
+	return statusCode >= 400 && statusCode < 500 &&
+		statusCode != http.StatusRequestTimeout &&
+		statusCode != http.StatusTooManyRequests
+}
+
+// IsRetryable returns true when the push failed with the error can be
+// retried. The errors implementing `Retryable() bool` decide by themselves,
+// the cancellation of the push and the formatting errors are not
+// retryable, the other errors are considered transient
+func IsRetryable(err error) bool {
+	var retryable interface{ Retryable() bool }
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &retryable):
+		return retryable.Retryable()
+	case errors.Is(err, context.Canceled),
+		errors.Is(err, errCircuitOpen),
+		errors.Is(err, formatting.ErrNotFoundInContext),
+		errors.Is(err, formatting.ErrNoTemplate):
+		return false
+	default:
+		return true
+	}
+}
+
+// Wrap returns the storage wrapped with the retry and the circuit breaker.
+// When the retry is not configured, the storage implementing
+// `DefaultRetry() *Config` is retried with its default retry policy. The
+// storage is returned as is when both are not configured
+// @param spec and name identify the storage in the metrics
+func Wrap(p Pusher, retry *Config, breakerConfig *BreakerConfig, spec, name string) (Pusher, error) {
+	if defaulter, ok := p.(interface{ DefaultRetry() *Config }); ok && retry == nil {
+		retry = defaulter.DefaultRetry()
+	}
+
+	if retry == nil && breakerConfig == nil {
+		return p, nil
+	}
+
+	if retry == nil {
+		retry = &Config{MaxAttempts: 1}
+	}
+	if err := retry.validate(); err != nil {
+		return nil, err
+	}
+
+	labels := prometheus.Labels{"spec": spec, "storage": name}
+	wrapped := &pusher{Pusher: p, retry: retry, labels: labels}
+
+	if breakerConfig != nil {
+		if err := breakerConfig.validate(); err != nil {
+			return nil, err
+		}
+		wrapped.breaker = newBreaker(breakerConfig, labels)
+	}
+
+	return wrapped, nil
+}
+
+// validate checks the configuration and sets the default values
+func (c *Config) validate() error {
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 3
+	}
+
+	if c.InitialInterval == 0 {
+		c.InitialInterval = 100 * time.Millisecond
+	}
+
+	if c.MaxInterval == 0 {
+		c.MaxInterval = 10 * time.Second
+	}
+
+	if c.Multiplier == 0 {
+		c.Multiplier = 2
+	}
+
+	if c.Jitter == nil {
+		jitter := 0.2
+		c.Jitter = &jitter
+	}
+
+	switch {
+	case c.MaxAttempts < 1:
+		return fmt.Errorf("the max attempts must be greater than 0")
+	case c.InitialInterval < 0 || c.MaxInterval < c.InitialInterval:
+		return fmt.Errorf("the max interval must be greater than the initial interval")
+	case c.Multiplier < 1:
+		return fmt.Errorf("the multiplier must be greater or equal to 1")
+	case *c.Jitter < 0 || *c.Jitter > 1:
+		return fmt.Errorf("the jitter must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// backoff returns the delay before the next attempt, after the given
+// number of attempts
+func (c *Config) backoff(attempt int) time.Duration {
+	delay := float64(c.InitialInterval)
+	for i := 1; i < attempt && delay < float64(c.MaxInterval); i++ {
+		delay *= c.Multiplier
+	}
+
+	if delay > float64(c.MaxInterval) {
+		delay = float64(c.MaxInterval)
+	}
+
+	// nolint:gosec // the jitter does not need a secure random
+	delay *= 1 + *c.Jitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
+
+// Push pushes the value to the storage, retrying the retryable errors with
+// an exponential backoff until the max attempts are reached or the context
+// is done. While the circuit breaker is open, the push fails immediately
+func (p *pusher) Push(ctx context.Context, value []byte) error {
+	for attempt := 1; ; attempt++ {
+		admission, err := p.breaker.allow()
+		if err != nil {
+			return &attemptsError{err: err, attempts: attempt - 1}
+		}
+
+		err = p.Pusher.Push(ctx, value)
+		p.breaker.record(admission, err)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= p.retry.MaxAttempts || !IsRetryable(err) || ctx.Err() != nil {
+			return &attemptsError{err: err, attempts: attempt}
+		}
+
+		retriesTotal.With(p.labels).Inc()
+		timer := time.NewTimer(p.retry.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &attemptsError{err: err, attempts: attempt}
+		}
+	}
+}
+
+// Ping checks the health of the wrapped storage
+func (p *pusher) Ping(ctx context.Context) error {
+	if checker, ok := p.Pusher.(interface{ Ping(context.Context) error }); ok {
+		return checker.Ping(ctx)
+	}
+	return nil
+}
+
+// Close closes the wrapped storage
+func (p *pusher) Close(ctx context.Context) error {
+	if closer, ok := p.Pusher.(interface{ Close(context.Context) error }); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
+
+// Capabilities returns the capabilities of the wrapped storage
+func (p *pusher) Capabilities() []capability.Capability {
+	if reporter, ok := p.Pusher.(interface {
+		Capabilities() []capability.Capability
+	}); ok {
+		return reporter.Capabilities()
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+)
+
+// testStorage fails the first pushes with the given error
+type testStorage struct {
+	err      error
+	failures int32
+	pushes   int32
+}
+
+func (s *testStorage) Name() string { return "test" }
+func (s *testStorage) Push(ctx context.Context, value []byte) error {
+	if atomic.AddInt32(&s.pushes, 1) <= s.failures {
+		return s.err
+	}
+	return nil
+}
+func (s *testStorage) Ping(ctx context.Context) error { return io.ErrClosedPipe }
+func (s *testStorage) Capabilities() []capability.Capability {
+	return []capability.Capability{capability.Batch}
+}
+
+func fastConfig(maxAttempts int) *Config {
+	jitter := 0.0
+	return &Config{MaxAttempts: maxAttempts, InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Jitter: &jitter}
+}
+
+func TestWrap(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &testStorage{}
+	p, err := Wrap(s, nil, nil, "spec", "test")
+	assert.NoError(err)
+	assert.Same(s, p)
+
+	_, err = Wrap(s, &Config{MaxAttempts: -1}, nil, "spec", "test")
+	assert.Error(err)
+	_, err = Wrap(s, nil, &BreakerConfig{OpenDuration: -time.Second}, "spec", "test")
+	assert.Error(err)
+
+	p, err = Wrap(s, nil, &BreakerConfig{}, "spec", "test")
+	assert.NoError(err)
+	assert.Equal("test", p.Name())
+	assert.Equal(1, p.(*pusher).retry.MaxAttempts)
+	assert.ErrorIs(p.(*pusher).Ping(context.Background()), io.ErrClosedPipe)
+	assert.NoError(p.(*pusher).Close(context.Background()))
+	assert.Equal([]capability.Capability{capability.Batch}, p.(*pusher).Capabilities())
+}
+
+// defaultRetryStorage is a storage with a default retry policy
+type defaultRetryStorage struct {
+	testStorage
+}
+
+func (s *defaultRetryStorage) DefaultRetry() *Config { return fastConfig(2) }
+
+func TestWrapDefaultRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &defaultRetryStorage{testStorage{err: io.ErrUnexpectedEOF, failures: 1}}
+	p, err := Wrap(s, nil, nil, "spec", "test")
+	assert.NoError(err)
+	assert.Equal(2, p.(*pusher).retry.MaxAttempts)
+	assert.NoError(p.Push(context.Background(), nil))
+	assert.Equal(int32(2), s.pushes)
+
+	// the configured retry takes precedence
+	p, err = Wrap(s, fastConfig(5), nil, "spec", "test")
+	assert.NoError(err)
+	assert.Equal(5, p.(*pusher).retry.MaxAttempts)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Config{}
+	assert.NoError(c.validate())
+	assert.Equal(3, c.MaxAttempts)
+	assert.Equal(100*time.Millisecond, c.InitialInterval)
+	assert.Equal(10*time.Second, c.MaxInterval)
+	assert.Equal(2.0, c.Multiplier)
+	assert.Equal(0.2, *c.Jitter)
+
+	jitter := 1.5
+	assert.Error((&Config{Jitter: &jitter}).validate())
+	assert.Error((&Config{Multiplier: 0.5}).validate())
+	assert.Error((&Config{InitialInterval: time.Minute, MaxInterval: time.Second}).validate())
+}
+
+func TestConfigBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	jitter := 0.0
+	c := &Config{InitialInterval: 100 * time.Millisecond, MaxInterval: time.Second, Multiplier: 2, Jitter: &jitter}
+	assert.Equal(100*time.Millisecond, c.backoff(1))
+	assert.Equal(200*time.Millisecond, c.backoff(2))
+	assert.Equal(800*time.Millisecond, c.backoff(4))
+	assert.Equal(time.Second, c.backoff(10))
+
+	jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := c.backoff(2)
+		assert.GreaterOrEqual(delay, 100*time.Millisecond)
+		assert.LessOrEqual(delay, 300*time.Millisecond)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(IsRetryable(nil))
+	assert.True(IsRetryable(io.ErrUnexpectedEOF))
+	assert.True(IsRetryable(context.DeadlineExceeded))
+	assert.False(IsRetryable(context.Canceled))
+	assert.False(IsRetryable(fmt.Errorf("render: %w", formatting.ErrNotFoundInContext)))
+	assert.False(IsRetryable(Permanent(io.ErrUnexpectedEOF)))
+	assert.ErrorIs(Permanent(io.ErrUnexpectedEOF), io.ErrUnexpectedEOF)
+	assert.Nil(Permanent(nil))
+}
+
+func TestIsPermanentStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(IsPermanentStatus(http.StatusBadRequest))
+	assert.True(IsPermanentStatus(http.StatusNotFound))
+	assert.False(IsPermanentStatus(http.StatusRequestTimeout))
+	assert.False(IsPermanentStatus(http.StatusTooManyRequests))
+	assert.False(IsPermanentStatus(http.StatusBadGateway))
+	assert.False(IsPermanentStatus(http.StatusOK))
+}
+
+func TestAttempts(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, Attempts(nil))
+	assert.Equal(1, Attempts(io.ErrUnexpectedEOF))
+	assert.Equal(2, Attempts(fmt.Errorf("push: %w", &attemptsError{err: io.ErrUnexpectedEOF, attempts: 2})))
+}
+
+func TestPusher_Push(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &testStorage{err: io.ErrUnexpectedEOF, failures: 2}
+	p, err := Wrap(s, fastConfig(3), nil, "push", "test")
+	assert.NoError(err)
+	assert.NoError(p.Push(context.Background(), nil))
+	assert.Equal(int32(3), s.pushes)
+	assert.Equal(2.0, testutil.ToFloat64(retriesTotal.WithLabelValues("push", "test")))
+
+	s = &testStorage{err: io.ErrUnexpectedEOF, failures: 5}
+	p, _ = Wrap(s, fastConfig(3), nil, "push", "test")
+	err = p.Push(context.Background(), nil)
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+	assert.Equal(3, Attempts(err))
+	assert.Equal(int32(3), s.pushes)
+
+	s = &testStorage{err: Permanent(io.ErrUnexpectedEOF), failures: 5}
+	p, _ = Wrap(s, fastConfig(3), nil, "push", "test")
+	assert.ErrorIs(p.Push(context.Background(), nil), io.ErrUnexpectedEOF)
+	assert.Equal(int32(1), s.pushes)
+
+	// the context stops the backoff
+	s = &testStorage{err: io.ErrUnexpectedEOF, failures: 5}
+	p, _ = Wrap(s, &Config{MaxAttempts: 5, InitialInterval: time.Hour, MaxInterval: time.Hour}, nil, "push", "test")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(p.Push(ctx, nil), io.ErrUnexpectedEOF)
+	assert.Equal(int32(1), s.pushes)
+}
+
+func TestBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &testStorage{err: errors.New("connection refused"), failures: 4}
+	p, err := Wrap(s, fastConfig(1), &BreakerConfig{FailureThreshold: 2, OpenDuration: time.Minute}, "breaker", "test")
+	assert.NoError(err)
+
+	b := p.(*pusher).breaker
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	gauge := breakerState.WithLabelValues("breaker", "test")
+
+	// the permanent errors and the cancellations are not counted
+	b.record(admission{}, Permanent(io.ErrUnexpectedEOF))
+	b.record(admission{}, context.Canceled)
+	assert.Equal(stateClosed, b.state)
+
+	// a push admitted by the closed circuit, finishing after its opening
+	closedAdmission, err := b.allow()
+	assert.NoError(err)
+	assert.False(closedAdmission.trial)
+
+	assert.Error(p.Push(context.Background(), nil))
+	assert.Error(p.Push(context.Background(), nil))
+	assert.Equal(stateOpen, b.state)
+	assert.Equal(float64(stateOpen), testutil.ToFloat64(gauge))
+
+	// the open circuit fails fast
+	assert.ErrorIs(p.Push(context.Background(), nil), errCircuitOpen)
+	assert.Equal(int32(2), s.pushes)
+	assert.Equal(1.0, testutil.ToFloat64(breakerRejectionsTotal.WithLabelValues("breaker", "test")))
+
+	// the canceled and the permanent trials keep the circuit half-open
+	now = now.Add(time.Minute)
+	for _, trialErr := range []error{context.Canceled, Permanent(io.ErrUnexpectedEOF)} {
+		trial, err := b.allow()
+		assert.NoError(err)
+		assert.True(trial.trial)
+		assert.Equal(stateHalfOpen, b.state)
+		_, err = b.allow()
+		assert.ErrorIs(err, errCircuitOpen)
+		b.record(trial, trialErr)
+		assert.Equal(stateHalfOpen, b.state)
+	}
+
+	// the pushes admitted before the half-open state are not trials, they
+	// neither give back a trial nor decide of the circuit
+	trial, err := b.allow()
+	assert.NoError(err)
+	b.record(closedAdmission, nil)
+	assert.Equal(stateHalfOpen, b.state)
+	assert.Equal(1, b.trials)
+
+	// the failed trial opens the circuit again
+	b.record(trial, io.ErrUnexpectedEOF)
+	assert.Equal(stateOpen, b.state)
+
+	// the successful trial closes the circuit
+	now = now.Add(time.Minute)
+	s.failures = 0
+	assert.NoError(p.Push(context.Background(), nil))
+	assert.Equal(stateClosed, b.state)
+	assert.Equal(float64(stateClosed), testutil.ToFloat64(gauge))
+	assert.Equal("half-open", stateHalfOpen.String())
+}
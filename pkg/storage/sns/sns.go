@@ -0,0 +1,180 @@
+package sns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+
+	"atomys.codes/webhooked/internal/awsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+)
+
+// storage is the struct contains client and config
+// Run is made from external caller at begins programs
+type storage struct {
+	client *sns.Client
+	config *config
+}
+
+// config is the struct contains config for connect client
+// Run is made from internal caller
+type config struct {
+	// AWS is the configuration of the AWS client (region, credentials and
+	// custom endpoint)
+	AWS awsconfig.Config `mapstructure:"aws" json:"aws"`
+	// TopicARN is the ARN of the topic where the messages are published
+	TopicARN valuable.Valuable `mapstructure:"topicArn" json:"topicArn"`
+	// Subject is the subject of the message, used by the email
+	// subscriptions. The subject can use the formatting feature
+	// (see pkg/formatting)
+	Subject string `mapstructure:"subject" json:"subject"`
+	// MessageGroupID is the group of the message, required by FIFO topics.
+	// The group can use the formatting feature
+	MessageGroupID string `mapstructure:"messageGroupId" json:"messageGroupId"`
+	// MessageDeduplicationID is the deduplication identifier of the message
+	// for FIFO topics. The identifier can use the formatting feature. When
+	// empty, the content based deduplication of the topic must be enabled
+	MessageDeduplicationID string `mapstructure:"messageDeduplicationId" json:"messageDeduplicationId"`
+	// Attributes are the message attributes. Each value can use the
+	// formatting feature to forward the request headers
+	// (eg: {{ .Request.Header | getHeader "X-Event" }}). Empty values are
+	// not sent
+	Attributes map[string]string `mapstructure:"attributes" json:"attributes"`
+}
+
+// NewStorage is the function for create new SNS client storage
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return SNSStorage the struct contains client connected and config
+// @return an error if the the client is not initialized successfully
+func NewStorage(configRaw map[string]interface{}) (*storage, error) {
+	newClient := storage{
+		config: &config{},
+	}
+
+	if err := valuable.Decode(configRaw, &newClient.config); err != nil {
+		return nil, err
+	}
+
+	if newClient.config.TopicARN.First() == "" {
+		return nil, fmt.Errorf("the topic arn is required")
+	}
+
+	if newClient.config.isFIFO() && newClient.config.MessageGroupID == "" {
+		return nil, fmt.Errorf("the message group id is required with a FIFO topic")
+	}
+
+	ctx := context.Background()
+	awsConfig, err := newClient.config.AWS.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	newClient.client = sns.NewFromConfig(awsConfig)
+
+	// Get the topic attributes for testing config
+	if err := newClient.Ping(ctx); err != nil {
+		return nil, err
+	}
+
+	return &newClient, nil
+}
+
+// isFIFO returns true when the topic is a FIFO topic
+func (c *config) isFIFO() bool {
+	return strings.HasSuffix(c.TopicARN.First(), ".fifo")
+}
+
+// Name is the function for identified if the storage config is define in the webhooks
+// Run is made from external caller
+func (c storage) Name() string {
+	return "sns"
+}
+
+// Push is the function for push data in the storage
+// A run is made from external caller
+// @param value that will be pushed
+// @return an error if the push failed
+func (c storage) Push(ctx context.Context, value []byte) error {
+	input, err := c.message(ctx, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.Publish(ctx, input)
+	return awsconfig.ClassifyError(err)
+}
+
+// Ping checks that the topic is reachable with the configured credentials
+func (c storage) Ping(ctx context.Context) error {
+	_, err := c.client.GetTopicAttributes(ctx, &sns.GetTopicAttributesInput{
+		TopicArn: aws.String(c.config.TopicARN.First()),
+	})
+	return err
+}
+
+// Capabilities returns the capabilities of the storage, the FIFO topics
+// keep the order of the messages of a group and deduplicate them
+func (c storage) Capabilities() []capability.Capability {
+	if c.config.isFIFO() {
+		return []capability.Capability{capability.Ordering, capability.Deduplication}
+	}
+	return nil
+}
+
+// message builds the message published on the topic with the rendered
+// subject, group, deduplication identifier and attributes
+func (c storage) message(ctx context.Context, value []byte) (*sns.PublishInput, error) {
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(c.config.TopicARN.First()),
+		Message:           aws.String(string(value)),
+		MessageAttributes: make(map[string]types.MessageAttributeValue, len(c.config.Attributes)),
+	}
+
+	if c.config.Subject != "" {
+		subject, err := formatting.RenderFromContext(ctx, c.config.Subject, value)
+		if err != nil {
+			return nil, err
+		}
+		input.Subject = aws.String(subject)
+	}
+
+	if c.config.isFIFO() {
+		groupID, err := formatting.RenderFromContext(ctx, c.config.MessageGroupID, value)
+		if err != nil {
+			return nil, err
+		}
+		input.MessageGroupId = aws.String(groupID)
+
+		if c.config.MessageDeduplicationID != "" {
+			deduplicationID, err := formatting.RenderFromContext(ctx, c.config.MessageDeduplicationID, value)
+			if err != nil {
+				return nil, err
+			}
+			input.MessageDeduplicationId = aws.String(deduplicationID)
+		}
+	}
+
+	for name, template := range c.config.Attributes {
+		attribute, err := formatting.RenderFromContext(ctx, template, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if attribute == "" {
+			continue
+		}
+
+		input.MessageAttributes[name] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(attribute),
+		}
+	}
+
+	return input, nil
+}
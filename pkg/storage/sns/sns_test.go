@@ -0,0 +1,168 @@
+package sns
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/internal/awsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+type SNSSetupTestSuite struct {
+	suite.Suite
+	client   *sns.Client
+	aws      map[string]interface{}
+	topicArn string
+	ctx      context.Context
+}
+
+// Create the topic for running test
+func (suite *SNSSetupTestSuite) BeforeTest(suiteName, testName string) {
+	suite.aws = map[string]interface{}{
+		"region":          "us-east-1",
+		"endpoint":        os.Getenv("SNS_ENDPOINT"),
+		"accessKeyId":     "test",
+		"secretAccessKey": "test",
+	}
+
+	config := &awsconfig.Config{
+		Region:          "us-east-1",
+		Endpoint:        os.Getenv("SNS_ENDPOINT"),
+		AccessKeyID:     valuable.Valuable{Values: []string{"test"}},
+		SecretAccessKey: valuable.Valuable{Values: []string{"test"}},
+	}
+
+	awsConfig, err := config.Load(context.Background())
+	if err != nil {
+		suite.T().Error(err)
+	}
+	suite.client = sns.NewFromConfig(awsConfig)
+
+	output, err := suite.client.CreateTopic(context.Background(), &sns.CreateTopicInput{Name: aws.String("webhooks")})
+	if err != nil {
+		suite.T().Error(err)
+		return
+	}
+	suite.topicArn = aws.ToString(output.TopicArn)
+
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().
+			WithData("Spec", map[string]string{"Name": "test"}).
+			WithRequest(&http.Request{Header: http.Header{"X-Event": []string{"push"}}}),
+	)
+}
+
+// Delete the topic after test
+func (suite *SNSSetupTestSuite) AfterTest(suiteName, testName string) {
+	if _, err := suite.client.DeleteTopic(context.Background(), &sns.DeleteTopicInput{TopicArn: aws.String(suite.topicArn)}); err != nil {
+		suite.T().Error(err)
+	}
+}
+
+func (suite *SNSSetupTestSuite) TestSNSNewStorage() {
+	_, err := NewStorage(map[string]interface{}{
+		"aws":      suite.aws,
+		"topicArn": "arn:aws:sns:us-east-1:000000000000:unknown",
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"aws":      suite.aws,
+		"topicArn": suite.topicArn,
+	})
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *SNSSetupTestSuite) TestSNSPush() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"aws":      suite.aws,
+		"topicArn": suite.topicArn,
+		"subject":  "{{ .Spec.Name }}",
+		"attributes": map[string]string{
+			"event": `{{ .Request.Header | getHeader "X-Event" }}`,
+		},
+	})
+	require.NoError(suite.T(), err)
+
+	err = newClient.Push(context.Background(), []byte("Hello"))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+}
+
+func TestRunSNSPush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sns testing is skiped in short version of test")
+		return
+	}
+
+	suite.Run(t, new(SNSSetupTestSuite))
+}
+
+func TestSNSName(t *testing.T) {
+	assert.Equal(t, "sns", storage{}.Name())
+}
+
+func TestNewStorageValidation(t *testing.T) {
+	_, err := NewStorage(map[string]interface{}{})
+	assert.ErrorContains(t, err, "topic arn is required")
+
+	_, err = NewStorage(map[string]interface{}{
+		"topicArn": "arn:aws:sns:us-east-1:000000000000:webhooks.fifo",
+	})
+	assert.ErrorContains(t, err, "message group id is required")
+}
+
+func TestMessage(t *testing.T) {
+	assert := assert.New(t)
+	ctx := formatting.ToContext(
+		context.Background(),
+		formatting.New().
+			WithData("Spec", map[string]string{"Name": "test"}).
+			WithRequest(&http.Request{Header: http.Header{"X-Event": []string{"push"}}}),
+	)
+
+	c := storage{config: &config{
+		TopicARN: valuable.Valuable{Values: []string{"arn:aws:sns:us-east-1:000000000000:webhooks"}},
+		Subject:  "New {{ .Spec.Name }} event",
+		Attributes: map[string]string{
+			"event":    `{{ .Request.Header | getHeader "X-Event" }}`,
+			"delivery": `{{ .Request.Header | getHeader "X-Delivery" }}`,
+		},
+	}}
+
+	input, err := c.message(ctx, []byte("Hello"))
+	assert.NoError(err)
+	assert.Equal("Hello", aws.ToString(input.Message))
+	assert.Equal("New test event", aws.ToString(input.Subject))
+	assert.Nil(input.MessageGroupId)
+	assert.Equal(map[string]types.MessageAttributeValue{
+		"event": {DataType: aws.String("String"), StringValue: aws.String("push")},
+	}, input.MessageAttributes)
+
+	c.config = &config{
+		TopicARN:               valuable.Valuable{Values: []string{"arn:aws:sns:us-east-1:000000000000:webhooks.fifo"}},
+		MessageGroupID:         "{{ .Spec.Name }}",
+		MessageDeduplicationID: "{{ .Payload }}",
+	}
+
+	input, err = c.message(ctx, []byte("Hello"))
+	assert.NoError(err)
+	assert.Nil(input.Subject)
+	assert.Equal("test", aws.ToString(input.MessageGroupId))
+	assert.Equal("Hello", aws.ToString(input.MessageDeduplicationId))
+
+	_, err = c.message(context.Background(), []byte("Hello"))
+	assert.ErrorIs(err, formatting.ErrNotFoundInContext)
+}
@@ -0,0 +1,193 @@
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"atomys.codes/webhooked/internal/awsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+	"atomys.codes/webhooked/pkg/storage/capability"
+)
+
+// storage is the struct contains client and config
+// Run is made from external caller at begins programs
+type storage struct {
+	client *sqs.Client
+	config *config
+}
+
+// config is the struct contains config for connect client
+// Run is made from internal caller
+type config struct {
+	// AWS is the configuration of the AWS client (region, credentials and
+	// custom endpoint)
+	AWS awsconfig.Config `mapstructure:"aws" json:"aws"`
+	// QueueURL is the url of the queue. When empty, the url is resolved from
+	// the queue name at startup
+	QueueURL valuable.Valuable `mapstructure:"queueUrl" json:"queueUrl"`
+	// QueueName is the name of the queue, used when the url is not defined
+	QueueName string `mapstructure:"queueName" json:"queueName"`
+	// MessageGroupID is the group of the message, required by FIFO queues.
+	// The group can use the formatting feature (see pkg/formatting)
+	MessageGroupID string `mapstructure:"messageGroupId" json:"messageGroupId"`
+	// MessageDeduplicationID is the deduplication identifier of the message
+	// for FIFO queues. The identifier can use the formatting feature. When
+	// empty, the content based deduplication of the queue must be enabled
+	MessageDeduplicationID string `mapstructure:"messageDeduplicationId" json:"messageDeduplicationId"`
+	// DelaySeconds delays the delivery of the messages, only supported by
+	// standard queues
+	DelaySeconds int32 `mapstructure:"delaySeconds" json:"delaySeconds"`
+	// Attributes are the message attributes. Each value can use the
+	// formatting feature to forward the request headers
+	// (eg: {{ .Request.Header | getHeader "X-Event" }}). Empty values are
+	// not sent
+	Attributes map[string]string `mapstructure:"attributes" json:"attributes"`
+}
+
+// NewStorage is the function for create new SQS client storage
+// Run is made from external caller at begins programs
+// @param config contains config define in the webhooks yaml file
+// @return SQSStorage the struct contains client connected and config
+// @return an error if the the client is not initialized successfully
+func NewStorage(configRaw map[string]interface{}) (*storage, error) {
+	newClient := storage{
+		config: &config{},
+	}
+
+	if err := valuable.Decode(configRaw, &newClient.config); err != nil {
+		return nil, err
+	}
+
+	if newClient.config.QueueURL.First() == "" && newClient.config.QueueName == "" {
+		return nil, fmt.Errorf("the queue url or the queue name is required")
+	}
+
+	ctx := context.Background()
+	awsConfig, err := newClient.config.AWS.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	newClient.client = sqs.NewFromConfig(awsConfig)
+
+	if newClient.config.QueueURL.First() == "" {
+		output, err := newClient.client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+			QueueName: aws.String(newClient.config.QueueName),
+		})
+		if err != nil {
+			return nil, err
+		}
+		newClient.config.QueueURL = valuable.Valuable{Values: []string{aws.ToString(output.QueueUrl)}}
+	}
+
+	if newClient.config.isFIFO() {
+		if newClient.config.MessageGroupID == "" {
+			return nil, fmt.Errorf("the message group id is required with a FIFO queue")
+		}
+
+		if newClient.config.DelaySeconds != 0 {
+			return nil, fmt.Errorf("the delay is not supported by FIFO queues")
+		}
+	}
+
+	// Get the queue attributes for testing config
+	if err := newClient.Ping(ctx); err != nil {
+		return nil, err
+	}
+
+	return &newClient, nil
+}
+
+// isFIFO returns true when the queue is a FIFO queue
+func (c *config) isFIFO() bool {
+	return strings.HasSuffix(c.QueueURL.First(), ".fifo")
+}
+
+// Name is the function for identified if the storage config is define in the webhooks
+// Run is made from external caller
+func (c storage) Name() string {
+	return "sqs"
+}
+
+// Push is the function for push data in the storage
+// A run is made from external caller
+// @param value that will be pushed
+// @return an error if the push failed
+func (c storage) Push(ctx context.Context, value []byte) error {
+	input, err := c.message(ctx, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.SendMessage(ctx, input)
+	return awsconfig.ClassifyError(err)
+}
+
+// Ping checks that the queue is reachable with the configured credentials
+func (c storage) Ping(ctx context.Context) error {
+	_, err := c.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(c.config.QueueURL.First()),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn},
+	})
+	return err
+}
+
+// Capabilities returns the capabilities of the storage, the FIFO queues
+// keep the order of the messages of a group and deduplicate them
+func (c storage) Capabilities() []capability.Capability {
+	if c.config.isFIFO() {
+		return []capability.Capability{capability.Ordering, capability.Deduplication}
+	}
+	return nil
+}
+
+// message builds the message sent to the queue with the rendered group,
+// deduplication identifier and attributes
+func (c storage) message(ctx context.Context, value []byte) (*sqs.SendMessageInput, error) {
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(c.config.QueueURL.First()),
+		MessageBody:       aws.String(string(value)),
+		MessageAttributes: make(map[string]types.MessageAttributeValue, len(c.config.Attributes)),
+	}
+
+	if c.config.isFIFO() {
+		groupID, err := formatting.RenderFromContext(ctx, c.config.MessageGroupID, value)
+		if err != nil {
+			return nil, err
+		}
+		input.MessageGroupId = aws.String(groupID)
+
+		if c.config.MessageDeduplicationID != "" {
+			deduplicationID, err := formatting.RenderFromContext(ctx, c.config.MessageDeduplicationID, value)
+			if err != nil {
+				return nil, err
+			}
+			input.MessageDeduplicationId = aws.String(deduplicationID)
+		}
+	} else {
+		input.DelaySeconds = c.config.DelaySeconds
+	}
+
+	for name, template := range c.config.Attributes {
+		attribute, err := formatting.RenderFromContext(ctx, template, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if attribute == "" {
+			continue
+		}
+
+		input.MessageAttributes[name] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(attribute),
+		}
+	}
+
+	return input, nil
+}
@@ -0,0 +1,208 @@
+package sqs
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"atomys.codes/webhooked/internal/awsconfig"
+	"atomys.codes/webhooked/internal/valuable"
+	"atomys.codes/webhooked/pkg/formatting"
+)
+
+type SQSSetupTestSuite struct {
+	suite.Suite
+	client *sqs.Client
+	aws    map[string]interface{}
+	ctx    context.Context
+}
+
+// Create the queues for running test
+func (suite *SQSSetupTestSuite) BeforeTest(suiteName, testName string) {
+	suite.aws = map[string]interface{}{
+		"region":          "us-east-1",
+		"endpoint":        os.Getenv("SQS_ENDPOINT"),
+		"accessKeyId":     "test",
+		"secretAccessKey": "test",
+	}
+
+	config := &awsconfig.Config{
+		Region:          "us-east-1",
+		Endpoint:        os.Getenv("SQS_ENDPOINT"),
+		AccessKeyID:     valuable.Valuable{Values: []string{"test"}},
+		SecretAccessKey: valuable.Valuable{Values: []string{"test"}},
+	}
+
+	awsConfig, err := config.Load(context.Background())
+	if err != nil {
+		suite.T().Error(err)
+	}
+	suite.client = sqs.NewFromConfig(awsConfig)
+
+	for _, input := range []*sqs.CreateQueueInput{
+		{QueueName: aws.String("webhooks")},
+		{QueueName: aws.String("webhooks.fifo"), Attributes: map[string]string{"FifoQueue": "true"}},
+	} {
+		if _, err := suite.client.CreateQueue(context.Background(), input); err != nil {
+			suite.T().Error(err)
+		}
+	}
+
+	suite.ctx = formatting.ToContext(
+		context.Background(),
+		formatting.New().
+			WithData("Spec", map[string]string{"Name": "test"}).
+			WithRequest(&http.Request{Header: http.Header{"X-Event": []string{"push"}}}),
+	)
+}
+
+// Delete the queues after test
+func (suite *SQSSetupTestSuite) AfterTest(suiteName, testName string) {
+	for _, name := range []string{"webhooks", "webhooks.fifo"} {
+		output, err := suite.client.GetQueueUrl(context.Background(), &sqs.GetQueueUrlInput{QueueName: aws.String(name)})
+		if err != nil {
+			suite.T().Error(err)
+			continue
+		}
+
+		if _, err := suite.client.DeleteQueue(context.Background(), &sqs.DeleteQueueInput{QueueUrl: output.QueueUrl}); err != nil {
+			suite.T().Error(err)
+		}
+	}
+}
+
+func (suite *SQSSetupTestSuite) TestSQSNewStorage() {
+	_, err := NewStorage(map[string]interface{}{
+		"aws":       suite.aws,
+		"queueName": "unknown",
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"aws":       suite.aws,
+		"queueName": "webhooks.fifo",
+	})
+	assert.Error(suite.T(), err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"aws":       suite.aws,
+		"queueName": "webhooks",
+	})
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *SQSSetupTestSuite) TestSQSPush() {
+	newClient, err := NewStorage(map[string]interface{}{
+		"aws":                    suite.aws,
+		"queueName":              "webhooks.fifo",
+		"messageGroupId":         "{{ .Spec.Name }}",
+		"messageDeduplicationId": "{{ .Payload }}",
+		"attributes": map[string]string{
+			"event": `{{ .Request.Header | getHeader "X-Event" }}`,
+		},
+	})
+	require.NoError(suite.T(), err)
+
+	err = newClient.Push(context.Background(), []byte("Hello"))
+	assert.ErrorIs(suite.T(), err, formatting.ErrNotFoundInContext)
+
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+	// deduplicated by the queue
+	assert.NoError(suite.T(), newClient.Push(suite.ctx, []byte("Hello")))
+
+	output, err := suite.client.ReceiveMessage(context.Background(), &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(newClient.config.QueueURL.First()),
+		MaxNumberOfMessages:   10,
+		MessageAttributeNames: []string{"All"},
+		WaitTimeSeconds:       1,
+	})
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), output.Messages, 1)
+	assert.Equal(suite.T(), "Hello", aws.ToString(output.Messages[0].Body))
+	assert.Equal(suite.T(), "push", aws.ToString(output.Messages[0].MessageAttributes["event"].StringValue))
+}
+
+func TestRunSQSPush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sqs testing is skiped in short version of test")
+		return
+	}
+
+	suite.Run(t, new(SQSSetupTestSuite))
+}
+
+func TestSQSName(t *testing.T) {
+	assert.Equal(t, "sqs", storage{}.Name())
+}
+
+func TestNewStorageValidation(t *testing.T) {
+	_, err := NewStorage(map[string]interface{}{})
+	assert.Error(t, err)
+
+	_, err = NewStorage(map[string]interface{}{
+		"aws":      map[string]interface{}{"region": "us-east-1"},
+		"queueUrl": "http://localhost:9324/000000000000/webhooks.fifo",
+	})
+	assert.ErrorContains(t, err, "message group id is required")
+
+	_, err = NewStorage(map[string]interface{}{
+		"aws":            map[string]interface{}{"region": "us-east-1"},
+		"queueUrl":       "http://localhost:9324/000000000000/webhooks.fifo",
+		"messageGroupId": "webhooks",
+		"delaySeconds":   10,
+	})
+	assert.ErrorContains(t, err, "delay is not supported")
+}
+
+func TestMessage(t *testing.T) {
+	assert := assert.New(t)
+	ctx := formatting.ToContext(
+		context.Background(),
+		formatting.New().
+			WithData("Spec", map[string]string{"Name": "test"}).
+			WithRequest(&http.Request{Header: http.Header{"X-Event": []string{"push"}}}),
+	)
+
+	c := storage{config: &config{
+		QueueURL:     valuable.Valuable{Values: []string{"http://localhost:9324/000000000000/webhooks"}},
+		DelaySeconds: 5,
+		Attributes: map[string]string{
+			"event":    `{{ .Request.Header | getHeader "X-Event" }}`,
+			"delivery": `{{ .Request.Header | getHeader "X-Delivery" }}`,
+			"source":   "webhooked",
+		},
+	}}
+
+	input, err := c.message(ctx, []byte("Hello"))
+	assert.NoError(err)
+	assert.Equal("Hello", aws.ToString(input.MessageBody))
+	assert.Equal(int32(5), input.DelaySeconds)
+	assert.Nil(input.MessageGroupId)
+	assert.Equal(map[string]types.MessageAttributeValue{
+		"event":  {DataType: aws.String("String"), StringValue: aws.String("push")},
+		"source": {DataType: aws.String("String"), StringValue: aws.String("webhooked")},
+	}, input.MessageAttributes)
+
+	c.config = &config{
+		QueueURL:               valuable.Valuable{Values: []string{"http://localhost:9324/000000000000/webhooks.fifo"}},
+		MessageGroupID:         "{{ .Spec.Name }}",
+		MessageDeduplicationID: "{{ .Payload }}",
+	}
+
+	input, err = c.message(ctx, []byte("Hello"))
+	assert.NoError(err)
+	assert.Equal("test", aws.ToString(input.MessageGroupId))
+	assert.Equal("Hello", aws.ToString(input.MessageDeduplicationId))
+	assert.Equal(int32(0), input.DelaySeconds)
+
+	_, err = c.message(context.Background(), []byte("Hello"))
+	assert.ErrorIs(err, formatting.ErrNotFoundInContext)
+}
@@ -4,9 +4,7 @@ import (
 	"context"
 	"fmt"
 
-	"atomys.codes/webhooked/pkg/storage/postgres"
-	"atomys.codes/webhooked/pkg/storage/rabbitmq"
-	"atomys.codes/webhooked/pkg/storage/redis"
+	"atomys.codes/webhooked/pkg/storage/capability"
 )
 
 // Pusher is the interface for storage pusher
@@ -20,18 +18,88 @@ type Pusher interface {
 	Push(ctx context.Context, value []byte) error
 }
 
-// Load will fetch and return the built-in storage based on the given
-// storageType params and initialize it with given storageSpecs given
-func Load(storageType string, storageSpecs map[string]interface{}) (pusher Pusher, err error) {
-	switch storageType {
-	case "redis":
-		pusher, err = redis.NewStorage(storageSpecs)
-	case "postgres":
-		pusher, err = postgres.NewStorage(storageSpecs)
-	case "rabbitmq":
-		pusher, err = rabbitmq.NewStorage(storageSpecs)
-	default:
-		err = fmt.Errorf("storage %s is undefined", storageType)
+// HealthChecker is the optional interface implemented by the storages able
+// to report the state of their connection. It is used by the server to
+// report its readiness
+type HealthChecker interface {
+	// Ping returns an error when the storage cannot receive data
+	Ping(ctx context.Context) error
+}
+
+// Closer is the optional interface implemented by the storages holding
+// connections or buffered data. It is called when the server shuts down
+type Closer interface {
+	// Close flushes the pending data and releases the resources
+	Close(ctx context.Context) error
+}
+
+// CapabilityReporter is the optional interface implemented by the storages
+// declaring their capabilities. The capabilities can depend on the storage
+// configuration
+type CapabilityReporter interface {
+	// Capabilities returns the capabilities of the storage
+	Capabilities() []capability.Capability
+}
+
+// Lifecycle is the extended interface of the storages implementing all the
+// optional interfaces. The server detects each optional interface at
+// runtime, so a storage can implement only a part of them
+type Lifecycle interface {
+	Pusher
+	HealthChecker
+	Closer
+	CapabilityReporter
+}
+
+// Ping checks the health of the storage. The storages not implementing
+// HealthChecker are considered healthy
+func Ping(ctx context.Context, pusher Pusher) error {
+	if checker, ok := pusher.(HealthChecker); ok {
+		return checker.Ping(ctx)
+	}
+	return nil
+}
+
+// Close closes the storage when it implements Closer
+func Close(ctx context.Context, pusher Pusher) error {
+	if closer, ok := pusher.(Closer); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
+
+// Capabilities returns the capabilities declared by the storage, or nil
+// when it does not implement CapabilityReporter
+func Capabilities(pusher Pusher) []capability.Capability {
+	if reporter, ok := pusher.(CapabilityReporter); ok {
+		return reporter.Capabilities()
+	}
+	return nil
+}
+
+// HasCapability returns true when the storage declares the capability
+func HasCapability(pusher Pusher, c capability.Capability) bool {
+	for _, declared := range Capabilities(pusher) {
+		if declared == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Load will fetch and return the storage registered with the given
+// storageType name and initialize it with given storageSpecs given
+func Load(storageType string, storageSpecs map[string]interface{}) (Pusher, error) {
+	constructor, ok := GetConstructorByName(storageType)
+	if !ok {
+		return nil, fmt.Errorf("storage %s is undefined", storageType)
+	}
+
+	pusher, err := constructor(storageSpecs)
+	// the constructors return a typed nil on error, which must not be
+	// seen as a loaded storage
+	if err != nil {
+		return nil, err
 	}
-	return
+	return pusher, nil
 }
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"atomys.codes/webhooked/pkg/storage/capability"
+)
+
+type testPusher struct{}
+
+func (s testPusher) Name() string                             { return "test" }
+func (s testPusher) Push(ctx context.Context, v []byte) error { return nil }
+
+type testLifecycle struct {
+	testPusher
+	err error
+}
+
+func (s testLifecycle) Ping(ctx context.Context) error  { return s.err }
+func (s testLifecycle) Close(ctx context.Context) error { return s.err }
+func (s testLifecycle) Capabilities() []capability.Capability {
+	return []capability.Capability{capability.Batch}
+}
+
+var _ Lifecycle = testLifecycle{}
+
+func TestLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	err := errors.New("connection lost")
+
+	assert.NoError(Ping(ctx, testPusher{}))
+	assert.NoError(Close(ctx, testPusher{}))
+	assert.Nil(Capabilities(testPusher{}))
+	assert.False(HasCapability(testPusher{}, capability.Batch))
+
+	assert.ErrorIs(Ping(ctx, testLifecycle{err: err}), err)
+	assert.ErrorIs(Close(ctx, testLifecycle{err: err}), err)
+	assert.Equal([]capability.Capability{capability.Batch}, Capabilities(testLifecycle{}))
+	assert.True(HasCapability(testLifecycle{}, capability.Batch))
+	assert.False(HasCapability(testLifecycle{}, capability.Ordering))
+}
+
+func TestLoad(t *testing.T) {
+	pusher, err := Load("unknown", nil)
+	assert.Error(t, err)
+	assert.Nil(t, pusher)
+
+	// the typed nil returned by the constructor is not kept
+	pusher, err = Load("redis", map[string]interface{}{"mode": "unknown"})
+	assert.Error(t, err)
+	assert.Nil(t, pusher)
+}